@@ -2,16 +2,21 @@ package v1
 
 import (
 	"fmt"
+	"strconv"
 
 	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	codes "google.golang.org/grpc/codes"
 	status "google.golang.org/grpc/status"
 )
 
-// ErrOffsetOutOfRange represents an error found when the offset
-// is too large
+// ErrOffsetOutOfRange represents an error found when the offset is too
+// large, or too small once the log's been truncated
 type ErrOffsetOutOfRange struct {
 	Offset uint64
+	// Lowest and Next are the log's range of offsets, from its lowest to
+	// the offset its next record gets
+	Lowest uint64
+	Next   uint64
 }
 
 // GRPCStatus implements the GRPC status interface
@@ -23,14 +28,137 @@ func (e ErrOffsetOutOfRange) GRPCStatus() *status.Status {
 		Locale:  "en-GB",
 		Message: msg,
 	}
-	std, err := st.WithDetails(d)
+	r := &errdetails.ErrorInfo{
+		Reason: "OFFSET_OUT_OF_RANGE",
+		Domain: "proglog",
+		Metadata: map[string]string{
+			"lowest": strconv.FormatUint(e.Lowest, 10),
+			"next":   strconv.FormatUint(e.Next, 10),
+		},
+	}
+	std, err := st.WithDetails(d, r)
 	if err != nil {
 		return st
 	}
 	return std
 }
 
+// OffsetRange returns the range of offsets of the log an
+// ErrOffsetOutOfRange came from, once it's been through gRPC
+func OffsetRange(err error) (lowest, next uint64, ok bool) {
+	for _, d := range status.Convert(err).Details() {
+		info, isInfo := d.(*errdetails.ErrorInfo)
+		if !isInfo || info.Reason != "OFFSET_OUT_OF_RANGE" {
+			continue
+		}
+		lowest, lerr := strconv.ParseUint(info.Metadata["lowest"], 10, 64)
+		next, nerr := strconv.ParseUint(info.Metadata["next"], 10, 64)
+		return lowest, next, lerr == nil && nerr == nil
+	}
+	return 0, 0, false
+}
+
 // Error implements the error interface
 func (e ErrOffsetOutOfRange) Error() string {
 	return e.GRPCStatus().Err().Error()
 }
+
+// ErrRecordTooLarge is returned for records whose value is bigger than the
+// server accepts
+type ErrRecordTooLarge struct {
+	Size uint64
+	Max  uint64
+}
+
+// GRPCStatus implements the GRPC status interface
+func (e ErrRecordTooLarge) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.InvalidArgument,
+		fmt.Sprintf("record too large: %d bytes, max %d", e.Size, e.Max),
+	)
+	d := &errdetails.BadRequest{
+		FieldViolations: []*errdetails.BadRequest_FieldViolation{{
+			Field: "record.value",
+			Description: fmt.Sprintf(
+				"The record's value is %d bytes, bigger than the max of %d bytes", e.Size, e.Max,
+			),
+		}},
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+// Error implements the error interface
+func (e ErrRecordTooLarge) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// CheckRecordSize returns ErrRecordTooLarge if the record's value is bigger
+// than max bytes. A max of 0 is unlimited.
+func CheckRecordSize(record *Record, max uint64) error {
+	if size := uint64(len(record.GetValue())); max > 0 && size > max {
+		return ErrRecordTooLarge{Size: size, Max: max}
+	}
+	return nil
+}
+
+// ErrNotLeader is returned for writes to a server that isn't the leader,
+// with the leader's address if the server knows it
+type ErrNotLeader struct {
+	Leader string
+}
+
+// GRPCStatus implements the GRPC status interface
+func (e ErrNotLeader) GRPCStatus() *status.Status {
+	// clients retry Unavailable requests, which find the leader
+	st := status.New(codes.Unavailable, "node is not the leader")
+	if e.Leader == "" {
+		return st
+	}
+	d := &errdetails.ErrorInfo{
+		Reason:   "NOT_LEADER",
+		Domain:   "proglog",
+		Metadata: map[string]string{"leader": e.Leader},
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+// Error implements the error interface
+func (e ErrNotLeader) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
+
+// ErrLeadershipLost is returned for writes the leader lost its leadership
+// before committing. They may still be committed by the new leader.
+type ErrLeadershipLost struct {
+	Leader string
+}
+
+// GRPCStatus implements the GRPC status interface
+func (e ErrLeadershipLost) GRPCStatus() *status.Status {
+	st := status.New(codes.Unavailable, "leadership lost while committing log")
+	d := &errdetails.ErrorInfo{
+		Reason: "LEADERSHIP_LOST",
+		Domain: "proglog",
+	}
+	if e.Leader != "" {
+		d.Metadata = map[string]string{"leader": e.Leader}
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+// Error implements the error interface
+func (e ErrLeadershipLost) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
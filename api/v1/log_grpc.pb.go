@@ -22,6 +22,10 @@ type LogClient interface {
 	ConsumeStream(ctx context.Context, in *ConsumeRequest, opts ...grpc.CallOption) (Log_ConsumeStreamClient, error)
 	ProduceStream(ctx context.Context, opts ...grpc.CallOption) (Log_ProduceStreamClient, error)
 	GetServers(ctx context.Context, in *GetServersRequest, opts ...grpc.CallOption) (*GetServersResponse, error)
+	WatchServers(ctx context.Context, in *WatchServersRequest, opts ...grpc.CallOption) (Log_WatchServersClient, error)
+	GetPolicy(ctx context.Context, in *GetPolicyRequest, opts ...grpc.CallOption) (*GetPolicyResponse, error)
+	SetPolicy(ctx context.Context, in *SetPolicyRequest, opts ...grpc.CallOption) (*SetPolicyResponse, error)
+	Backup(ctx context.Context, in *BackupRequest, opts ...grpc.CallOption) (Log_BackupClient, error)
 }
 
 type logClient struct {
@@ -122,6 +126,88 @@ func (c *logClient) GetServers(ctx context.Context, in *GetServersRequest, opts
 	return out, nil
 }
 
+func (c *logClient) WatchServers(ctx context.Context, in *WatchServersRequest, opts ...grpc.CallOption) (Log_WatchServersClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_Log_serviceDesc.Streams[2], "/v1.Log/WatchServers", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &logWatchServersClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Log_WatchServersClient interface {
+	Recv() (*WatchServersResponse, error)
+	grpc.ClientStream
+}
+
+type logWatchServersClient struct {
+	grpc.ClientStream
+}
+
+func (x *logWatchServersClient) Recv() (*WatchServersResponse, error) {
+	m := new(WatchServersResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *logClient) GetPolicy(ctx context.Context, in *GetPolicyRequest, opts ...grpc.CallOption) (*GetPolicyResponse, error) {
+	out := new(GetPolicyResponse)
+	err := c.cc.Invoke(ctx, "/v1.Log/GetPolicy", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *logClient) SetPolicy(ctx context.Context, in *SetPolicyRequest, opts ...grpc.CallOption) (*SetPolicyResponse, error) {
+	out := new(SetPolicyResponse)
+	err := c.cc.Invoke(ctx, "/v1.Log/SetPolicy", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *logClient) Backup(ctx context.Context, in *BackupRequest, opts ...grpc.CallOption) (Log_BackupClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_Log_serviceDesc.Streams[3], "/v1.Log/Backup", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &logBackupClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Log_BackupClient interface {
+	Recv() (*BackupResponse, error)
+	grpc.ClientStream
+}
+
+type logBackupClient struct {
+	grpc.ClientStream
+}
+
+func (x *logBackupClient) Recv() (*BackupResponse, error) {
+	m := new(BackupResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
 // LogServer is the server API for Log service.
 // All implementations must embed UnimplementedLogServer
 // for forward compatibility
@@ -131,6 +217,10 @@ type LogServer interface {
 	ConsumeStream(*ConsumeRequest, Log_ConsumeStreamServer) error
 	ProduceStream(Log_ProduceStreamServer) error
 	GetServers(context.Context, *GetServersRequest) (*GetServersResponse, error)
+	WatchServers(*WatchServersRequest, Log_WatchServersServer) error
+	GetPolicy(context.Context, *GetPolicyRequest) (*GetPolicyResponse, error)
+	SetPolicy(context.Context, *SetPolicyRequest) (*SetPolicyResponse, error)
+	Backup(*BackupRequest, Log_BackupServer) error
 	mustEmbedUnimplementedLogServer()
 }
 
@@ -153,6 +243,18 @@ func (UnimplementedLogServer) ProduceStream(Log_ProduceStreamServer) error {
 func (UnimplementedLogServer) GetServers(context.Context, *GetServersRequest) (*GetServersResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method GetServers not implemented")
 }
+func (UnimplementedLogServer) WatchServers(*WatchServersRequest, Log_WatchServersServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchServers not implemented")
+}
+func (UnimplementedLogServer) GetPolicy(context.Context, *GetPolicyRequest) (*GetPolicyResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetPolicy not implemented")
+}
+func (UnimplementedLogServer) SetPolicy(context.Context, *SetPolicyRequest) (*SetPolicyResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SetPolicy not implemented")
+}
+func (UnimplementedLogServer) Backup(*BackupRequest, Log_BackupServer) error {
+	return status.Errorf(codes.Unimplemented, "method Backup not implemented")
+}
 func (UnimplementedLogServer) mustEmbedUnimplementedLogServer() {}
 
 // UnsafeLogServer may be embedded to opt out of forward compatibility for this service.
@@ -267,6 +369,84 @@ func _Log_GetServers_Handler(srv interface{}, ctx context.Context, dec func(inte
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Log_WatchServers_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchServersRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(LogServer).WatchServers(m, &logWatchServersServer{stream})
+}
+
+type Log_WatchServersServer interface {
+	Send(*WatchServersResponse) error
+	grpc.ServerStream
+}
+
+type logWatchServersServer struct {
+	grpc.ServerStream
+}
+
+func (x *logWatchServersServer) Send(m *WatchServersResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Log_GetPolicy_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetPolicyRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LogServer).GetPolicy(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/v1.Log/GetPolicy",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LogServer).GetPolicy(ctx, req.(*GetPolicyRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Log_SetPolicy_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SetPolicyRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LogServer).SetPolicy(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/v1.Log/SetPolicy",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LogServer).SetPolicy(ctx, req.(*SetPolicyRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Log_Backup_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(BackupRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(LogServer).Backup(m, &logBackupServer{stream})
+}
+
+type Log_BackupServer interface {
+	Send(*BackupResponse) error
+	grpc.ServerStream
+}
+
+type logBackupServer struct {
+	grpc.ServerStream
+}
+
+func (x *logBackupServer) Send(m *BackupResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
 var _Log_serviceDesc = grpc.ServiceDesc{
 	ServiceName: "v1.Log",
 	HandlerType: (*LogServer)(nil),
@@ -283,6 +463,14 @@ var _Log_serviceDesc = grpc.ServiceDesc{
 			MethodName: "GetServers",
 			Handler:    _Log_GetServers_Handler,
 		},
+		{
+			MethodName: "GetPolicy",
+			Handler:    _Log_GetPolicy_Handler,
+		},
+		{
+			MethodName: "SetPolicy",
+			Handler:    _Log_SetPolicy_Handler,
+		},
 	},
 	Streams: []grpc.StreamDesc{
 		{
@@ -296,6 +484,16 @@ var _Log_serviceDesc = grpc.ServiceDesc{
 			ServerStreams: true,
 			ClientStreams: true,
 		},
+		{
+			StreamName:    "WatchServers",
+			Handler:       _Log_WatchServers_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "Backup",
+			Handler:       _Log_Backup_Handler,
+			ServerStreams: true,
+		},
 	},
 	Metadata: "api/v1/log.proto",
 }
@@ -0,0 +1,89 @@
+// Package client provides a Go client for proglog clusters. It routes
+// requests through the proglog resolver and picker so produces go to the
+// leader and consumes are spread across followers.
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"time"
+
+	"github.com/michael-diggin/proglog/internal/loadbalance"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+)
+
+// Dial connects to the cluster that the server at `addr` belongs to.
+// A nil tlsConfig dials without transport security.
+func Dial(addr string, tlsConfig *tls.Config, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
+	return DialZone(addr, "", tlsConfig, opts...)
+}
+
+// DialZone is like Dial but consumes prefer followers in the given zone,
+// falling back to followers in other zones when none are available.
+func DialZone(addr, zone string, tlsConfig *tls.Config, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
+	if tlsConfig != nil {
+		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+	} else {
+		opts = append(opts, grpc.WithInsecure())
+	}
+	return grpc.Dial(loadbalance.Target(addr, zone), opts...)
+}
+
+// WithToken sends the token as a bearer token with every request, including
+// the resolver's requests for the cluster's servers, for clusters that
+// authenticate clients by token or JWT. It needs TLS.
+func WithToken(token string) []grpc.DialOption {
+	return []grpc.DialOption{
+		grpc.WithPerRPCCredentials(bearerToken(token)),
+		loadbalance.WithPerRPCCredentials(bearerToken(token)),
+	}
+}
+
+type bearerToken string
+
+func (t bearerToken) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + string(t)}, nil
+}
+
+func (t bearerToken) RequireTransportSecurity() bool {
+	return true
+}
+
+// retryable returns whether the request that failed with err is worth
+// retrying, either because the server could not be reached, because it hit
+// a server that lost leadership or because it was over quota. Only
+// ResourceExhausted errors with a RetryInfo are over quota, the rest, like
+// messages bigger than the server accepts, fail the same way every time.
+func retryable(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.Aborted:
+		return true
+	case codes.ResourceExhausted:
+		return retryInfo(err) != nil
+	}
+	return false
+}
+
+// retryBackoff returns how long to wait before retrying the request that
+// failed with err: the delay the server asked for when it rejected the
+// request for being over quota, or backoff otherwise
+func retryBackoff(err error, backoff time.Duration) time.Duration {
+	if info := retryInfo(err); info != nil {
+		return info.RetryDelay.AsDuration()
+	}
+	return backoff
+}
+
+// retryInfo returns the RetryInfo detail of err, if it has one
+func retryInfo(err error) *errdetails.RetryInfo {
+	for _, d := range status.Convert(err).Details() {
+		if info, ok := d.(*errdetails.RetryInfo); ok {
+			return info
+		}
+	}
+	return nil
+}
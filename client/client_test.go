@@ -0,0 +1,365 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	api "github.com/michael-diggin/proglog/api/v1"
+	"github.com/michael-diggin/proglog/internal/auth"
+	"github.com/michael-diggin/proglog/internal/config"
+	"github.com/michael-diggin/proglog/internal/log"
+	"github.com/michael-diggin/proglog/internal/server"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+func TestClient(t *testing.T) {
+	for scenario, fn := range map[string]func(
+		t *testing.T, conn *grpc.ClientConn, clog *flakyLog,
+	){
+		"producer delivers batches":        testProducerBatches,
+		"producer limits batch bytes":      testProducerBatchBytes,
+		"producer retries unavailable":     testProducerRetries,
+		"producer gives up on bad request": testProducerGivesUp,
+		"producer waits out quota":         testProducerQuota,
+		"producer gives up on big message": testProducerExhausted,
+		"consumer tracks offset":           testConsumerOffset,
+		"consumer continues trace":         testConsumerTrace,
+		"close unblocks consumer":          testConsumerClose,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			conn, clog, teardown := setupTest(t)
+			defer teardown()
+			fn(t, conn, clog)
+		})
+	}
+}
+
+func setupTest(t *testing.T) (*grpc.ClientConn, *flakyLog, func()) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	serverTLSConfig, err := config.SetUpTLSConfig(config.TLSConfig{
+		CertFile:      config.ServerCertFile,
+		KeyFile:       config.ServerKeyFile,
+		CAFile:        config.CAFile,
+		ServerAddress: l.Addr().String(),
+		Server:        true,
+	})
+	require.NoError(t, err)
+
+	dir, err := ioutil.TempDir("", "client-test")
+	require.NoError(t, err)
+	l2, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+	clog := &flakyLog{Log: l2}
+
+	srv, err := server.NewGRPCSever(&server.Config{
+		CommitLog:   clog,
+		Authorizer:  auth.New(config.ACLModelFile, config.ACLPolicyFile),
+		GetServerer: &getServers{addr: l.Addr().String()},
+	}, grpc.Creds(credentials.NewTLS(serverTLSConfig)))
+	require.NoError(t, err)
+	go srv.Serve(l)
+
+	clientTLSConfig, err := config.SetUpTLSConfig(config.TLSConfig{
+		CertFile:      config.RootClientCertFile,
+		KeyFile:       config.RootClientKeyFile,
+		CAFile:        config.CAFile,
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+	conn, err := Dial(l.Addr().String(), clientTLSConfig)
+	require.NoError(t, err)
+
+	return conn, clog, func() {
+		conn.Close()
+		srv.Stop()
+		l.Close()
+		l2.Remove()
+	}
+}
+
+// TestClientToken checks that clients authenticating with a token find the
+// cluster's servers, with a policy from before there were describe rules
+func TestClientToken(t *testing.T) {
+	dir, err := ioutil.TempDir("", "client-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "tokens.csv")
+	require.NoError(t, ioutil.WriteFile(tokenFile, []byte("root,secret\n"), 0644))
+	policyFile := filepath.Join(dir, "policy.csv")
+	require.NoError(t, ioutil.WriteFile(policyFile, []byte("p, root, *, produce\n"), 0644))
+	authenticator, err := auth.NewAuthenticator(auth.AuthenticatorConfig{
+		Method:    auth.MethodToken,
+		TokenFile: tokenFile,
+	})
+	require.NoError(t, err)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	serverTLSConfig, err := config.SetUpTLSConfig(config.TLSConfig{
+		CertFile:      config.ServerCertFile,
+		KeyFile:       config.ServerKeyFile,
+		CAFile:        config.CAFile,
+		ServerAddress: l.Addr().String(),
+		Server:        true,
+	})
+	require.NoError(t, err)
+	// clients authenticate with tokens rather than certificates
+	serverTLSConfig.ClientAuth = tls.NoClientCert
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "log"), 0755))
+	clog, err := log.NewLog(filepath.Join(dir, "log"), log.Config{})
+	require.NoError(t, err)
+	defer clog.Close()
+	srv, err := server.NewGRPCSever(&server.Config{
+		CommitLog:     clog,
+		Authorizer:    auth.New(config.ACLModelFile, policyFile),
+		Authenticator: authenticator,
+		GetServerer:   &getServers{addr: l.Addr().String()},
+	}, grpc.Creds(credentials.NewTLS(serverTLSConfig)))
+	require.NoError(t, err)
+	go srv.Serve(l)
+	defer srv.Stop()
+
+	clientTLSConfig, err := config.SetUpTLSConfig(config.TLSConfig{
+		CAFile:        config.CAFile,
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+	conn, err := Dial(l.Addr().String(), clientTLSConfig, WithToken("secret")...)
+	require.NoError(t, err)
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	res, err := api.NewLogClient(conn).Produce(ctx,
+		&api.ProduceRequest{Record: &api.Record{Value: []byte("hello")}},
+		grpc.WaitForReady(true),
+	)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), res.Offset)
+}
+
+func testProducerBatches(t *testing.T, conn *grpc.ClientConn, _ *flakyLog) {
+	p := NewProducer(conn, ProducerConfig{BatchSize: 3, Linger: time.Second})
+	var mu sync.Mutex
+	offsets := map[string]uint64{}
+	for _, v := range []string{"a", "b", "c", "d"} {
+		v := v
+		err := p.Produce(&api.Record{Value: []byte(v)}, func(off uint64, err error) {
+			require.NoError(t, err)
+			mu.Lock()
+			offsets[v] = off
+			mu.Unlock()
+		})
+		require.NoError(t, err)
+	}
+	p.Flush()
+	require.Equal(t, map[string]uint64{"a": 0, "b": 1, "c": 2, "d": 3}, offsets)
+
+	require.NoError(t, p.Close())
+	require.Equal(t, ErrProducerClosed, p.Produce(&api.Record{}, nil))
+}
+
+func testProducerBatchBytes(t *testing.T, conn *grpc.ClientConn, _ *flakyLog) {
+	p := NewProducer(conn, ProducerConfig{MaxBatchBytes: 4, Linger: time.Hour})
+	defer p.Close()
+	delivered := make(chan uint64, 2)
+	for _, v := range []string{"ab", "cd"} {
+		err := p.Produce(&api.Record{Value: []byte(v)}, func(off uint64, err error) {
+			require.NoError(t, err)
+			delivered <- off
+		})
+		require.NoError(t, err)
+	}
+	// the batch is sent once it's full, without waiting out the linger
+	for _, want := range []uint64{0, 1} {
+		select {
+		case off := <-delivered:
+			require.Equal(t, want, off)
+		case <-time.After(time.Second):
+			t.Fatal("batch wasn't sent")
+		}
+	}
+}
+
+func testProducerRetries(t *testing.T, conn *grpc.ClientConn, clog *flakyLog) {
+	// the errors servers return when leadership changes
+	for off, failure := range []error{
+		status.Error(codes.Unavailable, "leader changed"),
+		api.ErrNotLeader{Leader: "127.0.0.1:8400"},
+		api.ErrLeadershipLost{},
+	} {
+		clog.failures(2, failure)
+		p := NewProducer(conn, ProducerConfig{RetryBackoff: time.Millisecond})
+		done := make(chan error, 1)
+		err := p.Produce(&api.Record{Value: []byte("retried")}, func(off uint64, err error) {
+			done <- err
+		})
+		require.NoError(t, err)
+		require.NoError(t, p.Close())
+		require.NoError(t, <-done, failure.Error())
+
+		record, err := clog.Read(uint64(off))
+		require.NoError(t, err)
+		require.Equal(t, []byte("retried"), record.Value)
+	}
+}
+
+func testProducerGivesUp(t *testing.T, conn *grpc.ClientConn, clog *flakyLog) {
+	clog.failures(1, status.Error(codes.InvalidArgument, "bad record"))
+	p := NewProducer(conn, ProducerConfig{RetryBackoff: time.Millisecond})
+	done := make(chan error, 1)
+	err := p.Produce(&api.Record{Value: []byte("bad")}, func(off uint64, err error) {
+		done <- err
+	})
+	require.NoError(t, err)
+	require.NoError(t, p.Close())
+	require.Equal(t, codes.InvalidArgument, status.Code(<-done))
+}
+
+func testProducerQuota(t *testing.T, conn *grpc.ClientConn, clog *flakyLog) {
+	delay := 50 * time.Millisecond
+	st, err := status.New(codes.ResourceExhausted, "over quota").WithDetails(
+		&errdetails.RetryInfo{RetryDelay: durationpb.New(delay)},
+	)
+	require.NoError(t, err)
+	clog.failures(1, st.Err())
+	p := NewProducer(conn, ProducerConfig{RetryBackoff: time.Millisecond})
+	done := make(chan error, 1)
+	start := time.Now()
+	err = p.Produce(&api.Record{Value: []byte("retried")}, func(off uint64, err error) {
+		done <- err
+	})
+	require.NoError(t, err)
+	require.NoError(t, p.Close())
+	require.NoError(t, <-done)
+	// the retry waits for the delay the server asked for, not the backoff
+	require.GreaterOrEqual(t, int64(time.Since(start)), int64(delay))
+}
+
+func testProducerExhausted(t *testing.T, conn *grpc.ClientConn, clog *flakyLog) {
+	clog.failures(1, status.Error(codes.ResourceExhausted, "message larger than max"))
+	p := NewProducer(conn, ProducerConfig{RetryBackoff: time.Millisecond})
+	done := make(chan error, 1)
+	err := p.Produce(&api.Record{Value: []byte("big")}, func(off uint64, err error) {
+		done <- err
+	})
+	require.NoError(t, err)
+	require.NoError(t, p.Close())
+	require.Equal(t, codes.ResourceExhausted, status.Code(<-done))
+	_, err = clog.Read(0)
+	require.Error(t, err)
+}
+
+func testConsumerTrace(t *testing.T, conn *grpc.ClientConn, clog *flakyLog) {
+	sc := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{1},
+		SpanID:     trace.SpanID{2},
+		TraceFlags: trace.FlagsSampled,
+	})
+	ctx := trace.ContextWithSpanContext(context.Background(), sc)
+	p := NewProducer(conn, ProducerConfig{})
+	done := make(chan error, 1)
+	err := p.ProduceContext(ctx, &api.Record{Value: []byte("traced")}, func(off uint64, err error) {
+		done <- err
+	})
+	require.NoError(t, err)
+	require.NoError(t, p.Close())
+	require.NoError(t, <-done)
+
+	c := NewConsumer(conn, ConsumerConfig{})
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	record, err := c.Next(ctx)
+	require.NoError(t, err)
+	got := trace.SpanContextFromContext(RecordContext(context.Background(), record))
+	require.Equal(t, sc.TraceID(), got.TraceID())
+	require.Equal(t, sc.SpanID(), got.SpanID())
+}
+
+func testConsumerOffset(t *testing.T, conn *grpc.ClientConn, clog *flakyLog) {
+	for _, v := range []string{"a", "b", "c"} {
+		_, err := clog.Append(&api.Record{Value: []byte(v)})
+		require.NoError(t, err)
+	}
+	c := NewConsumer(conn, ConsumerConfig{Offset: 1})
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	record, err := c.Next(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []byte("b"), record.Value)
+	require.Equal(t, uint64(2), c.Offset())
+
+	c.Seek(0)
+	for _, want := range []string{"a", "b", "c"} {
+		record, err := c.Next(ctx)
+		require.NoError(t, err)
+		require.Equal(t, []byte(want), record.Value)
+	}
+	require.Equal(t, uint64(3), c.Offset())
+}
+
+func testConsumerClose(t *testing.T, conn *grpc.ClientConn, _ *flakyLog) {
+	c := NewConsumer(conn, ConsumerConfig{})
+	errc := make(chan error)
+	go func() {
+		_, err := c.Next(context.Background())
+		errc <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	require.NoError(t, c.Close())
+	require.Equal(t, ErrConsumerClosed, <-errc)
+}
+
+// flakyLog fails the next appends with the configured error
+type flakyLog struct {
+	*log.Log
+	mu   sync.Mutex
+	fail int
+	err  error
+}
+
+func (l *flakyLog) failures(n int, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.fail, l.err = n, err
+}
+
+func (l *flakyLog) Append(record *api.Record) (uint64, error) {
+	l.mu.Lock()
+	if l.fail > 0 {
+		l.fail--
+		l.mu.Unlock()
+		return 0, l.err
+	}
+	l.mu.Unlock()
+	return l.Log.Append(record)
+}
+
+type getServers struct {
+	addr string
+}
+
+func (s *getServers) GetServers() ([]*api.Server, error) {
+	return []*api.Server{{Id: "leader", RpcAddr: s.addr, IsLeader: true}}, nil
+}
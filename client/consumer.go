@@ -0,0 +1,172 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	api "github.com/michael-diggin/proglog/api/v1"
+	"github.com/michael-diggin/proglog/internal/tracing"
+	"google.golang.org/grpc"
+)
+
+// ErrConsumerClosed is returned when reading from a closed Consumer
+var ErrConsumerClosed = errors.New("consumer is closed")
+
+// RecordContext returns ctx with the trace the record was produced in, as
+// carried in its headers, so the record's consumption can be traced as
+// part of the producer's trace
+func RecordContext(ctx context.Context, record *api.Record) context.Context {
+	return tracing.Extract(ctx, record)
+}
+
+// ConsumerConfig configures where a Consumer starts and how it reconnects
+type ConsumerConfig struct {
+	// Offset is the first offset to consume
+	Offset uint64
+	// RetryBackoff is the time waited before reconnecting after the
+	// stream fails
+	RetryBackoff time.Duration
+}
+
+// Consumer reads records sequentially from the log. It tracks the offset
+// of the next record and, when the stream breaks, reconnects and resumes
+// from that offset. Next and Seek must not be called concurrently, Close
+// can be called at any time to unblock Next.
+type Consumer struct {
+	config ConsumerConfig
+	client api.LogClient
+
+	mu     sync.Mutex
+	offset uint64
+	stream api.Log_ConsumeStreamClient
+	cancel context.CancelFunc
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// NewConsumer returns a Consumer that reads records over conn
+func NewConsumer(conn grpc.ClientConnInterface, config ConsumerConfig) *Consumer {
+	if config.RetryBackoff == 0 {
+		config.RetryBackoff = 100 * time.Millisecond
+	}
+	return &Consumer{
+		config: config,
+		client: api.NewLogClient(conn),
+		offset: config.Offset,
+		closed: make(chan struct{}),
+	}
+}
+
+// Next blocks until the next record is available or ctx is done
+func (c *Consumer) Next(ctx context.Context) (*api.Record, error) {
+	for {
+		select {
+		case <-c.closed:
+			return nil, ErrConsumerClosed
+		default:
+		}
+		stream, err := c.connect()
+		if err != nil {
+			return nil, err
+		}
+		record, err := c.recv(ctx, stream)
+		if err == nil {
+			c.mu.Lock()
+			c.offset = record.Offset + 1
+			c.mu.Unlock()
+			return record, nil
+		}
+		c.disconnect()
+		if err == ErrConsumerClosed || ctx.Err() != nil {
+			return nil, err
+		}
+		if !retryable(err) {
+			return nil, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-c.closed:
+			return nil, ErrConsumerClosed
+		case <-time.After(retryBackoff(err, c.config.RetryBackoff)):
+		}
+	}
+}
+
+// recv waits for the next record on the stream, giving up when ctx is done
+func (c *Consumer) recv(ctx context.Context, stream api.Log_ConsumeStreamClient) (*api.Record, error) {
+	type result struct {
+		res *api.ConsumeResponse
+		err error
+	}
+	resc := make(chan result, 1)
+	go func(stream api.Log_ConsumeStreamClient) {
+		res, err := stream.Recv()
+		resc <- result{res, err}
+	}(stream)
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.closed:
+		return nil, ErrConsumerClosed
+	case r := <-resc:
+		if r.err != nil {
+			return nil, r.err
+		}
+		return r.res.Record, nil
+	}
+}
+
+// connect returns the current stream, opening a new one from the tracked
+// offset if there isn't one
+func (c *Consumer) connect() (api.Log_ConsumeStreamClient, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stream != nil {
+		return c.stream, nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := c.client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: c.offset})
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	c.stream = stream
+	c.cancel = cancel
+	return stream, nil
+}
+
+func (c *Consumer) disconnect() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cancel != nil {
+		c.cancel()
+	}
+	c.stream = nil
+	c.cancel = nil
+}
+
+// Offset returns the offset of the next record the Consumer will return
+func (c *Consumer) Offset() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.offset
+}
+
+// Seek moves the Consumer to the given offset
+func (c *Consumer) Seek(offset uint64) {
+	c.disconnect()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.offset = offset
+}
+
+// Close stops the Consumer
+func (c *Consumer) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	c.disconnect()
+	return nil
+}
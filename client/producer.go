@@ -0,0 +1,244 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	api "github.com/michael-diggin/proglog/api/v1"
+	"github.com/michael-diggin/proglog/internal/tracing"
+	"google.golang.org/grpc"
+)
+
+// ErrProducerClosed is returned when producing to a closed Producer
+var ErrProducerClosed = errors.New("producer is closed")
+
+// DeliveryFunc is called once a record has been produced, or once the
+// Producer has given up on it
+type DeliveryFunc func(offset uint64, err error)
+
+// ProducerConfig configures the batching and retry behaviour of a Producer
+type ProducerConfig struct {
+	// BatchSize is the max number of records sent in one batch
+	BatchSize int
+	// MaxBatchBytes is the max size of the record values sent in one
+	// batch, a batch is sent as soon as it reaches it. Defaults to 1MB.
+	// Servers only limit the size of each record, not of batches.
+	MaxBatchBytes int
+	// Linger is how long to wait for a batch to fill before sending it
+	Linger time.Duration
+	// BufferSize is the number of records that can be queued before
+	// Produce blocks
+	BufferSize int
+	// MaxRetries is the number of times a batch is retried when the leader
+	// is unavailable or has changed
+	MaxRetries int
+	// RetryBackoff is the time waited between retries
+	RetryBackoff time.Duration
+}
+
+type message struct {
+	record   *api.Record
+	callback DeliveryFunc
+}
+
+// Producer produces records asynchronously, sending them to the leader in
+// batches. Records are delivered at least once: a batch that fails part way
+// through is retried from the first record that wasn't acknowledged.
+type Producer struct {
+	config ProducerConfig
+	client api.LogClient
+
+	mu       sync.RWMutex
+	closed   bool
+	messages chan *message
+	flushes  chan chan struct{}
+	done     chan struct{}
+}
+
+// NewProducer returns a Producer that sends records over conn
+func NewProducer(conn grpc.ClientConnInterface, config ProducerConfig) *Producer {
+	if config.BatchSize == 0 {
+		config.BatchSize = 100
+	}
+	if config.MaxBatchBytes == 0 {
+		config.MaxBatchBytes = 1 << 20
+	}
+	if config.Linger == 0 {
+		config.Linger = 10 * time.Millisecond
+	}
+	if config.BufferSize == 0 {
+		config.BufferSize = 1000
+	}
+	if config.MaxRetries == 0 {
+		config.MaxRetries = 5
+	}
+	if config.RetryBackoff == 0 {
+		config.RetryBackoff = 100 * time.Millisecond
+	}
+	p := &Producer{
+		config:   config,
+		client:   api.NewLogClient(conn),
+		messages: make(chan *message, config.BufferSize),
+		flushes:  make(chan chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+// Produce queues the record to be produced. The callback, if not nil,
+// is called from the Producer's goroutine once the record is delivered.
+func (p *Producer) Produce(record *api.Record, callback DeliveryFunc) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		return ErrProducerClosed
+	}
+	p.messages <- &message{record: record, callback: callback}
+	return nil
+}
+
+// ProduceContext is like Produce but carries the trace in ctx in the
+// record's headers, so the record's replication and consumption can be
+// traced back to the producer
+func (p *Producer) ProduceContext(ctx context.Context, record *api.Record, callback DeliveryFunc) error {
+	tracing.Inject(ctx, record)
+	return p.Produce(record, callback)
+}
+
+// Flush blocks until every record queued before the call has been delivered
+func (p *Producer) Flush() {
+	p.mu.RLock()
+	if p.closed {
+		p.mu.RUnlock()
+		return
+	}
+	flushed := make(chan struct{})
+	p.flushes <- flushed
+	p.mu.RUnlock()
+	<-flushed
+}
+
+// Close delivers any queued records and stops the Producer
+func (p *Producer) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	close(p.messages)
+	p.mu.Unlock()
+	<-p.done
+	return nil
+}
+
+func (p *Producer) run() {
+	defer close(p.done)
+	batch := make([]*message, 0, p.config.BatchSize)
+	var batchBytes int
+	timer := time.NewTimer(p.config.Linger)
+	defer timer.Stop()
+	send := func() {
+		if len(batch) > 0 {
+			p.send(batch)
+			batch = batch[:0]
+			batchBytes = 0
+		}
+	}
+	add := func(msg *message) {
+		batch = append(batch, msg)
+		batchBytes += len(msg.record.Value)
+		if len(batch) >= p.config.BatchSize || batchBytes >= p.config.MaxBatchBytes {
+			send()
+		}
+	}
+	for {
+		select {
+		case msg, ok := <-p.messages:
+			if !ok {
+				send()
+				return
+			}
+			if len(batch) == 0 {
+				resetTimer(timer, p.config.Linger)
+			}
+			add(msg)
+		case <-timer.C:
+			send()
+		case flushed := <-p.flushes:
+			// drain whatever was queued before the flush
+			for n := len(p.messages); n > 0; n-- {
+				add(<-p.messages)
+			}
+			send()
+			close(flushed)
+		}
+	}
+}
+
+func resetTimer(t *time.Timer, d time.Duration) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+	t.Reset(d)
+}
+
+// send produces the batch, retrying the records that weren't acknowledged
+// when the stream fails with a retryable error
+func (p *Producer) send(batch []*message) {
+	var err error
+	for attempt := 0; attempt <= p.config.MaxRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(retryBackoff(err, p.config.RetryBackoff))
+		}
+		var n int
+		n, err = p.sendBatch(batch)
+		batch = batch[n:]
+		if err == nil || !retryable(err) {
+			break
+		}
+	}
+	for _, msg := range batch {
+		if msg.callback != nil {
+			msg.callback(0, err)
+		}
+	}
+}
+
+// sendBatch pipelines the batch over a produce stream and returns how many
+// records were acknowledged
+func (p *Producer) sendBatch(batch []*message) (int, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := p.client.ProduceStream(ctx)
+	if err != nil {
+		return 0, err
+	}
+	errc := make(chan error, 1)
+	go func() {
+		for _, msg := range batch {
+			if err := stream.Send(&api.ProduceRequest{Record: msg.record}); err != nil {
+				errc <- err
+				return
+			}
+		}
+		errc <- stream.CloseSend()
+	}()
+	for i, msg := range batch {
+		res, err := stream.Recv()
+		if err != nil {
+			return i, err
+		}
+		if msg.callback != nil {
+			msg.callback(res.Offset, nil)
+		}
+	}
+	<-errc
+	return len(batch), nil
+}
@@ -1,11 +1,13 @@
 package main
 
 import (
+	"io"
 	"log"
 	"os"
 	"os/signal"
 	"path"
 	"syscall"
+	"time"
 
 	"github.com/michael-diggin/proglog/internal/agent"
 	"github.com/michael-diggin/proglog/internal/config"
@@ -33,6 +35,7 @@ func main() {
 	if err := setupFlags(cmd); err != nil {
 		log.Fatal(err)
 	}
+	cmd.AddCommand(restoreCmd())
 	if err := cmd.Execute(); err != nil {
 		log.Fatal(err)
 	}
@@ -47,12 +50,30 @@ func setupFlags(cmd *cobra.Command) error {
 	dataDir := path.Join(os.TempDir(), "proglog")
 	cmd.Flags().String("data-dir", dataDir, "Directory to store log and Raft data")
 	cmd.Flags().String("node-name", hostname, "Unique server ID")
+	cmd.Flags().String("zone", "", "Availability zone the server runs in")
 	cmd.Flags().String("bind-addr", "127.0.0.1:8401", "Address to bind Serf on")
 	cmd.Flags().Int("rpc-port", 8400, "Port for RPC clients (and Raft) connections")
+	cmd.Flags().Bool("http-gateway", false, "Serve the Log service as JSON over HTTP on the RPC port, over TLS when the server has a certificate")
+	cmd.Flags().String("trace-endpoint", "", "host:port of the OTLP/HTTP collector to export traces to")
+	cmd.Flags().Bool("trace-insecure", false, "Export traces without TLS")
+	cmd.Flags().Float64("trace-sample-ratio", 1, "Fraction of new traces to sample")
+	cmd.Flags().String("metrics-addr", "", "Address to serve Prometheus metrics on, e.g. 127.0.0.1:9400")
 	cmd.Flags().StringSlice("start-join-addrs", nil, "Serf Addresses to join")
 	cmd.Flags().Bool("bootstrap", false, "Boostrap the cluster")
+	cmd.Flags().String("auth-method", "tls-cn", "How clients are authenticated: tls-cn, tls-uri, token or jwt")
+	cmd.Flags().String("auth-token-file", "", "Path to the subject,token CSV file for token authentication")
+	cmd.Flags().String("auth-jwks-file", "", "Path to the JWKS file JWTs are verified against")
+	cmd.Flags().String("auth-jwt-issuer", "", "Issuer JWTs must be issued by")
+	cmd.Flags().String("auth-jwt-audience", "", "Audience JWTs must be issued for")
+	cmd.Flags().Uint64("max-record-bytes", 0, "Largest record value accepted, 0 for no limit beyond gRPC's 4MiB max request size")
+	cmd.Flags().String("compression", "none", "Codec new records are compressed with: none, gzip, snappy or zstd")
+	cmd.Flags().Duration("segment-max-age", 0, "How long after its first record a segment is closed, 0 to close segments by size only")
+	cmd.Flags().String("encryption-key-file", "", "Path to the keyfile segments are encrypted with, the last key is used for new segments")
+	cmd.Flags().String("tier-url", "", "Object store closed segments are offloaded to, e.g. file:///mnt/tier or s3://bucket?endpoint=host:9000")
+	cmd.Flags().Duration("tier-retention", time.Hour, "How long offloaded segments are kept on local disk")
 	cmd.Flags().String("acl-model-file", "", "Path to ACL model")
 	cmd.Flags().String("acl-policy-file", "", "Path to ACL policy")
+	cmd.Flags().String("quota-file", "", "Path to the JSON file of produce and consume quotas by subject")
 	cmd.Flags().String("server-tls-cert-file", "", "Path to server tls cert")
 	cmd.Flags().String("server-tls-key-file", "", "Path to server tls key")
 	cmd.Flags().String("server-tls-ca-file", "", "Path to server certificate authority")
@@ -76,12 +97,30 @@ func (c *cli) setupConfig(cmd *cobra.Command, args []string) (err error) {
 	}
 	c.cfg.DataDir = viper.GetString("data-dir")
 	c.cfg.NodeName = viper.GetString("node-name")
+	c.cfg.Zone = viper.GetString("zone")
 	c.cfg.BindAddr = viper.GetString("bind-addr")
 	c.cfg.RPCPort = viper.GetInt("rpc-port")
+	c.cfg.MetricsAddr = viper.GetString("metrics-addr")
+	c.cfg.HTTPGateway = viper.GetBool("http-gateway")
+	c.cfg.Tracing.Endpoint = viper.GetString("trace-endpoint")
+	c.cfg.Tracing.Insecure = viper.GetBool("trace-insecure")
+	c.cfg.Tracing.SampleRatio = viper.GetFloat64("trace-sample-ratio")
 	c.cfg.StartJoinAddrs = viper.GetStringSlice("start-join-addrs")
 	c.cfg.Bootstrap = viper.GetBool("bootstrap")
+	c.cfg.Authentication.Method = viper.GetString("auth-method")
+	c.cfg.Authentication.TokenFile = viper.GetString("auth-token-file")
+	c.cfg.Authentication.JWKSFile = viper.GetString("auth-jwks-file")
+	c.cfg.Authentication.Issuer = viper.GetString("auth-jwt-issuer")
+	c.cfg.Authentication.Audience = viper.GetString("auth-jwt-audience")
+	c.cfg.MaxRecordBytes = viper.GetUint64("max-record-bytes")
+	c.cfg.Compression = viper.GetString("compression")
+	c.cfg.SegmentMaxAge = viper.GetDuration("segment-max-age")
+	c.cfg.EncryptionKeyFile = viper.GetString("encryption-key-file")
+	c.cfg.TierURL = viper.GetString("tier-url")
+	c.cfg.TierRetention = viper.GetDuration("tier-retention")
 	c.cfg.ACLModelFile = viper.GetString("acl-model-file")
 	c.cfg.ACLPolicyFile = viper.GetString("acl-policy-file")
+	c.cfg.QuotaFile = viper.GetString("quota-file")
 	c.cfg.ServerTLSConfig.CertFile = viper.GetString("server-tls-cert-file")
 	c.cfg.ServerTLSConfig.KeyFile = viper.GetString("server-tls-key-file")
 	c.cfg.ServerTLSConfig.CAFile = viper.GetString("server-tls-ca-file")
@@ -115,3 +154,58 @@ func (c *cli) run(cmd *cobra.Command, args []string) error {
 	<-sigc
 	return agent.Shutdown()
 }
+
+func restoreCmd() *cobra.Command {
+	hostname, _ := os.Hostname()
+	cmd := &cobra.Command{
+		Use:   "restore [backup]",
+		Short: "Restore a server's data dir from a backup tarball, or - to read it from stdin",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			flags := cmd.Flags()
+			c := agent.Config{}
+			var err error
+			if c.DataDir, err = flags.GetString("data-dir"); err != nil {
+				return err
+			}
+			if c.NodeName, err = flags.GetString("node-name"); err != nil {
+				return err
+			}
+			if c.BindAddr, err = flags.GetString("bind-addr"); err != nil {
+				return err
+			}
+			if c.RPCPort, err = flags.GetInt("rpc-port"); err != nil {
+				return err
+			}
+			if c.EncryptionKeyFile, err = flags.GetString("encryption-key-file"); err != nil {
+				return err
+			}
+			if c.TierURL, err = flags.GetString("tier-url"); err != nil {
+				return err
+			}
+			rebuild, err := flags.GetBool("rebuild")
+			if err != nil {
+				return err
+			}
+			var r io.Reader = os.Stdin
+			if args[0] != "-" {
+				f, err := os.Open(args[0])
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				r = f
+			}
+			return agent.Restore(r, c, rebuild)
+		},
+	}
+	flags := cmd.Flags()
+	flags.String("data-dir", path.Join(os.TempDir(), "proglog"), "Empty directory to restore the backup into")
+	flags.Bool("rebuild", false, "Make the restored server a cluster of its own, for other servers to join")
+	flags.String("node-name", hostname, "Unique server ID the rebuilt cluster's server has")
+	flags.String("bind-addr", "127.0.0.1:8401", "Address the rebuilt cluster's server binds Serf on")
+	flags.Int("rpc-port", 8400, "Port the rebuilt cluster's server takes RPC and Raft connections on")
+	flags.String("encryption-key-file", "", "Path to the keyfile the backed up segments are encrypted with, when rebuilding")
+	flags.String("tier-url", "", "Object store the backed up segments were offloaded to, when rebuilding")
+	return cmd
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	api "github.com/michael-diggin/proglog/api/v1"
+	"github.com/michael-diggin/proglog/internal/log"
+	"github.com/spf13/cobra"
+)
+
+func (c *cli) exportCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "export [file]",
+		Short: "Export a range of the cluster's records to an archive file",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			from, err := cmd.Flags().GetUint64("from")
+			if err != nil {
+				return err
+			}
+			to, err := cmd.Flags().GetUint64("to")
+			if err != nil {
+				return err
+			}
+			name, err := cmd.Flags().GetString("compression")
+			if err != nil {
+				return err
+			}
+			codec, err := log.ParseCodec(name)
+			if err != nil {
+				return err
+			}
+			f, err := os.Create(args[0])
+			if err != nil {
+				return err
+			}
+			defer func() {
+				if cerr := f.Close(); err == nil {
+					err = cerr
+				}
+				if err != nil {
+					os.Remove(f.Name())
+				}
+			}()
+			w, err := log.NewArchiveWriter(f, codec)
+			if err != nil {
+				return err
+			}
+			// offsets that have been truncated are skipped, the archive
+			// starts from the log's lowest offset
+			err = c.consumeRange(cmd.Context(), cmd.ErrOrStderr(), from, to, w.Write)
+			if err != nil {
+				return err
+			}
+			m, err := w.Close()
+			if err != nil {
+				return err
+			}
+			if err := f.Sync(); err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "exported offsets %d to %d\n", m.FromOffset, m.NextOffset)
+			return nil
+		},
+	}
+	cmd.Flags().Uint64("from", 0, "Offset to start exporting from, or the lowest offset if it's been truncated")
+	cmd.Flags().Uint64("to", 0, "Offset to stop exporting before, 0 to export up to the last record")
+	cmd.Flags().String("compression", "none", "Codec the archive is compressed with: none, gzip, snappy or zstd")
+	return cmd
+}
+
+func (c *cli) importCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "import [file]",
+		Short: "Produce the records of an archive file, at the cluster's next offsets",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			f, err := os.Open(args[0])
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			fi, err := f.Stat()
+			if err != nil {
+				return err
+			}
+			a, err := log.OpenArchive(f, fi.Size())
+			if err != nil {
+				return err
+			}
+			stream, err := c.client.ProduceStream(cmd.Context())
+			if err != nil {
+				return err
+			}
+			var first, last uint64
+			for n := 0; ; n++ {
+				record, err := a.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					return err
+				}
+				record.Offset = 0
+				if err := stream.Send(&api.ProduceRequest{Record: record}); err != nil {
+					return err
+				}
+				res, err := stream.Recv()
+				if err != nil {
+					return err
+				}
+				if n == 0 {
+					first = res.Offset
+				}
+				last = res.Offset
+			}
+			if err := stream.CloseSend(); err != nil {
+				return err
+			}
+			m := a.Manifest()
+			if m.NextOffset == m.FromOffset {
+				fmt.Fprintln(cmd.OutOrStdout(), "archive has no records")
+				return nil
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "imported offsets %d to %d at %d to %d\n",
+				m.FromOffset, m.NextOffset, first, last+1,
+			)
+			return nil
+		},
+	}
+}
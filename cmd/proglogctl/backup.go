@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	api "github.com/michael-diggin/proglog/api/v1"
+	"github.com/spf13/cobra"
+)
+
+func (c *cli) backupCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "backup [file]",
+		Short: "Back up the data dir of the server the request's routed to, the leader, to a tarball file, or - to write it to stdout",
+		Long: `Back up the data dir of the server the request's routed to, the leader, to
+a tarball file, or - to write it to stdout.
+
+The tarball's the one the HTTP gateway's /v1/backup serves, which proglog
+restore restores a server's data dir from.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			stream, err := c.client.Backup(cmd.Context(), &api.BackupRequest{})
+			if err != nil {
+				return err
+			}
+			var f *os.File
+			w := cmd.OutOrStdout()
+			if args[0] != "-" {
+				f, err = os.Create(args[0])
+				if err != nil {
+					return err
+				}
+				defer func() {
+					if cerr := f.Close(); err == nil {
+						err = cerr
+					}
+					if err != nil {
+						os.Remove(f.Name())
+					}
+				}()
+				w = f
+			}
+			var n int64
+			for {
+				res, err := stream.Recv()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					return err
+				}
+				if _, err := w.Write(res.Chunk); err != nil {
+					return err
+				}
+				n += int64(len(res.Chunk))
+			}
+			if f != nil {
+				if err := f.Sync(); err != nil {
+					return err
+				}
+				fmt.Fprintf(cmd.ErrOrStderr(), "backed up %d bytes to %s\n", n, f.Name())
+			}
+			return nil
+		},
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	api "github.com/michael-diggin/proglog/api/v1"
+	"github.com/michael-diggin/proglog/internal/log"
+	"github.com/spf13/cobra"
+)
+
+// logCmd inspects a log's files directly, rather than through the cluster,
+// so it works on servers that are stopped or won't start
+func logCmd() *cobra.Command {
+	noop := func(cmd *cobra.Command, args []string) error { return nil }
+	cmd := &cobra.Command{
+		Use:   "log",
+		Short: "Inspect and repair the files of a stopped server's log",
+		Long: `Inspect and repair the files of a stopped server's log.
+
+The dir is the log's directory in the server's data dir: log for the
+commit log or raft/log for Raft's log.`,
+		PersistentPreRunE:  noop,
+		PersistentPostRunE: noop,
+	}
+	cmd.PersistentFlags().String("encryption-key-file", "", "Path to the keyfile the segments are encrypted with")
+	cmd.AddCommand(
+		logSegmentsCmd(),
+		logDumpCmd(),
+		logVerifyCmd(),
+		logLoadCmd(),
+	)
+	return cmd
+}
+
+// logConfig returns the config of the log, with the keyring in the keyfile
+// if there is one
+func logConfig(cmd *cobra.Command) (log.Config, error) {
+	c := log.Config{}
+	keyFile, err := cmd.Flags().GetString("encryption-key-file")
+	if err != nil {
+		return c, err
+	}
+	if keyFile != "" {
+		if c.Keyring, err = log.LoadKeyring(keyFile); err != nil {
+			return c, err
+		}
+	}
+	return c, nil
+}
+
+// inspector returns the inspector of the log in dir
+func inspector(cmd *cobra.Command, dir string) (*log.Inspector, error) {
+	c, err := logConfig(cmd)
+	if err != nil {
+		return nil, err
+	}
+	return log.NewInspector(dir, c), nil
+}
+
+func logSegmentsCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "segments [dir]",
+		Short: "List the log's segments",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			in, err := inspector(cmd, args[0])
+			if err != nil {
+				return err
+			}
+			segments, err := in.Segments()
+			if err != nil {
+				return err
+			}
+			w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "BASE OFFSET\tNEXT OFFSET\tSTATE\tSTORE BYTES\tINDEX ENTRIES\tKEY\tCREATED")
+			for _, s := range segments {
+				created := "-"
+				if !s.Created.IsZero() {
+					created = s.Created.Format(time.RFC3339)
+				}
+				fmt.Fprintf(w, "%d\t%d\t%s\t%d\t%d\t%s\t%s\n",
+					s.BaseOffset, s.NextOffset, s.State, s.StoreBytes, s.IndexEntries, s.Key, created,
+				)
+			}
+			return w.Flush()
+		},
+	}
+}
+
+// dumpedRecord is how records are dumped, one JSON object per line
+type dumpedRecord struct {
+	Offset  uint64            `json:"offset"`
+	Term    uint64            `json:"term"`
+	Type    uint32            `json:"type"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Value   []byte            `json:"value"`
+}
+
+func logDumpCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "dump [dir]",
+		Short: "Print the log's records as JSON, one per line, skipping offloaded segments",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			from, err := cmd.Flags().GetUint64("from")
+			if err != nil {
+				return err
+			}
+			in, err := inspector(cmd, args[0])
+			if err != nil {
+				return err
+			}
+			enc := json.NewEncoder(cmd.OutOrStdout())
+			return in.Dump(from, func(record *api.Record) error {
+				return enc.Encode(dumpedRecord{
+					Offset:  record.Offset,
+					Term:    record.Term,
+					Type:    record.Type,
+					Headers: record.Headers,
+					Value:   record.Value,
+				})
+			})
+		},
+	}
+	cmd.Flags().Uint64("from", 0, "Offset to start dumping from")
+	return cmd
+}
+
+func logVerifyCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "verify [dir]",
+		Short: "Check the log's records read back and its indexes agree with them",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			repair, err := cmd.Flags().GetBool("repair")
+			if err != nil {
+				return err
+			}
+			in, err := inspector(cmd, args[0])
+			if err != nil {
+				return err
+			}
+			var report *log.Report
+			if repair {
+				report, err = in.Repair()
+			} else {
+				report, err = in.Verify()
+			}
+			if err != nil {
+				return err
+			}
+			out := cmd.OutOrStdout()
+			for _, problem := range report.Problems {
+				fmt.Fprintln(out, problem)
+			}
+			switch {
+			case len(report.Problems) == 0:
+				fmt.Fprintf(out, "ok, %d segments up to offset %d\n", len(report.Segments), report.NextOffset)
+			case repair:
+				fmt.Fprintf(out, "repaired, truncated to offset %d\n", report.NextOffset)
+			default:
+				return fmt.Errorf("found %d problems, records are whole up to offset %d", len(report.Problems), report.NextOffset)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().Bool("repair", false, "Truncate the log after the last whole record and rebuild indexes that don't agree with their stores")
+	return cmd
+}
+
+func logLoadCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "load [dir] [file]",
+		Short: "Load an archive file's records into an empty log, at the offsets they were exported from",
+		Long: `Load an archive file's records into an empty log, at the offsets they were
+exported from.
+
+The records are written to the log's files directly, not through Raft, so
+the log can't be a server's: the other servers wouldn't have the records.
+Use import to produce an archive's records to a running cluster.`,
+		Args: cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if raftDataDir(args[0]) {
+				return fmt.Errorf(
+					"%s is in a server's data dir, which loading would make diverge from the other servers: import the archive instead",
+					args[0],
+				)
+			}
+			c, err := logConfig(cmd)
+			if err != nil {
+				return err
+			}
+			f, err := os.Open(args[1])
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			fi, err := f.Stat()
+			if err != nil {
+				return err
+			}
+			a, err := log.OpenArchive(f, fi.Size())
+			if err != nil {
+				return err
+			}
+			if err := os.MkdirAll(args[0], 0755); err != nil {
+				return err
+			}
+			l, err := log.NewLog(args[0], c)
+			if err != nil {
+				return err
+			}
+			if err := l.Load(a); err != nil {
+				l.Close()
+				return err
+			}
+			if err := l.Close(); err != nil {
+				return err
+			}
+			m := a.Manifest()
+			fmt.Fprintf(cmd.OutOrStdout(), "loaded offsets %d to %d\n", m.FromOffset, m.NextOffset)
+			return nil
+		},
+	}
+}
+
+// raftDataDir returns whether the log dir is in a server's data dir, as its
+// commit log or Raft's log, going by the raft dir they sit next to or in
+func raftDataDir(dir string) bool {
+	parent := filepath.Dir(filepath.Clean(dir))
+	if filepath.Base(parent) == "raft" {
+		return true
+	}
+	fi, err := os.Stat(filepath.Join(parent, "raft"))
+	return err == nil && fi.IsDir()
+}
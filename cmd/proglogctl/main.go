@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net"
+	"os"
+	"text/tabwriter"
+
+	api "github.com/michael-diggin/proglog/api/v1"
+	"github.com/michael-diggin/proglog/client"
+	"github.com/michael-diggin/proglog/internal/config"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type cli struct {
+	cfg    cfg
+	conn   *grpc.ClientConn
+	client api.LogClient
+}
+
+type cfg struct {
+	Addr      string
+	Zone      string
+	Token     string
+	TLSConfig config.TLSConfig
+}
+
+func main() {
+	cmd, err := newCmd()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := cmd.Execute(); err != nil {
+		os.Exit(1)
+	}
+}
+
+// newCmd returns the proglogctl command with all its subcommands
+func newCmd() (*cobra.Command, error) {
+	cli := &cli{}
+	cmd := &cobra.Command{
+		Use:               "proglogctl",
+		Short:             "Interact with a running proglog cluster",
+		PersistentPreRunE: cli.setupClient,
+		PersistentPostRunE: func(cmd *cobra.Command, args []string) error {
+			return cli.conn.Close()
+		},
+		SilenceUsage: true,
+	}
+	if err := setupFlags(cmd); err != nil {
+		return nil, err
+	}
+	cmd.AddCommand(
+		cli.produceCmd(),
+		cli.consumeCmd(),
+		cli.topicsCmd(),
+		cli.serversCmd(),
+		cli.policyCmd(),
+		cli.exportCmd(),
+		cli.importCmd(),
+		cli.backupCmd(),
+		logCmd(),
+	)
+	return cmd, nil
+}
+
+func setupFlags(cmd *cobra.Command) error {
+	flags := cmd.PersistentFlags()
+	flags.String("config-file", "", "Path to config file")
+	flags.String("addr", "127.0.0.1:8400", "RPC address of any server in the cluster")
+	flags.String("zone", "", "Zone to prefer followers in when consuming")
+	flags.String("tls-cert-file", "", "Path to client tls cert")
+	flags.String("tls-key-file", "", "Path to client tls key")
+	flags.String("tls-ca-file", "", "Path to client certificate authority")
+	flags.String("tls-server-name", "", "Server name to verify the servers' certs against")
+	flags.String("token", "", "Bearer token or JWT to authenticate with")
+
+	return viper.BindPFlags(flags)
+}
+
+// setupClient reads the config and dials the cluster, routing requests to
+// the leader or followers as needed
+func (c *cli) setupClient(cmd *cobra.Command, args []string) (err error) {
+	configFile := viper.GetString("config-file")
+	if configFile != "" {
+		viper.SetConfigFile(configFile)
+		if err := viper.ReadInConfig(); err != nil {
+			return err
+		}
+	}
+	c.cfg.Addr = viper.GetString("addr")
+	c.cfg.Zone = viper.GetString("zone")
+	c.cfg.Token = viper.GetString("token")
+	c.cfg.TLSConfig.CertFile = viper.GetString("tls-cert-file")
+	c.cfg.TLSConfig.KeyFile = viper.GetString("tls-key-file")
+	c.cfg.TLSConfig.CAFile = viper.GetString("tls-ca-file")
+	c.cfg.TLSConfig.ServerAddress = viper.GetString("tls-server-name")
+
+	var tlsConfig *tls.Config
+	if c.cfg.TLSConfig.CAFile != "" {
+		if c.cfg.TLSConfig.ServerAddress == "" {
+			host, _, err := net.SplitHostPort(c.cfg.Addr)
+			if err != nil {
+				return err
+			}
+			c.cfg.TLSConfig.ServerAddress = host
+		}
+		tlsConfig, err = config.SetUpTLSConfig(c.cfg.TLSConfig)
+		if err != nil {
+			return err
+		}
+	}
+	var opts []grpc.DialOption
+	if c.cfg.Token != "" {
+		opts = append(opts, client.WithToken(c.cfg.Token)...)
+	}
+	c.conn, err = client.DialZone(c.cfg.Addr, c.cfg.Zone, tlsConfig, opts...)
+	if err != nil {
+		return fmt.Errorf("failed to dial %s: %w", c.cfg.Addr, err)
+	}
+	c.client = api.NewLogClient(c.conn)
+	return nil
+}
+
+func (c *cli) produceCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "produce [value...]",
+		Short: "Produce records, one per argument or one per line of stdin",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			stream, err := c.client.ProduceStream(ctx)
+			if err != nil {
+				return err
+			}
+			produce := func(value []byte) error {
+				err := stream.Send(&api.ProduceRequest{
+					Record: &api.Record{Value: value},
+				})
+				if err != nil {
+					return err
+				}
+				res, err := stream.Recv()
+				if err != nil {
+					return err
+				}
+				fmt.Fprintln(cmd.OutOrStdout(), res.Offset)
+				return nil
+			}
+			if len(args) > 0 {
+				for _, arg := range args {
+					if err := produce([]byte(arg)); err != nil {
+						return err
+					}
+				}
+				return stream.CloseSend()
+			}
+			scanner := bufio.NewScanner(cmd.InOrStdin())
+			for scanner.Scan() {
+				if err := produce(scanner.Bytes()); err != nil {
+					return err
+				}
+			}
+			if err := scanner.Err(); err != nil {
+				return err
+			}
+			return stream.CloseSend()
+		},
+	}
+}
+
+func (c *cli) consumeCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "consume",
+		Short: "Consume records starting from an offset",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			from, err := cmd.Flags().GetUint64("from")
+			if err != nil {
+				return err
+			}
+			follow, err := cmd.Flags().GetBool("follow")
+			if err != nil {
+				return err
+			}
+			out := cmd.OutOrStdout()
+			ctx := cmd.Context()
+			if follow {
+				return c.follow(ctx, out, cmd.ErrOrStderr(), from)
+			}
+			return c.consumeRange(ctx, cmd.ErrOrStderr(), from, 0, func(record *api.Record) error {
+				printRecord(out, record)
+				return nil
+			})
+		},
+	}
+	cmd.Flags().Uint64("from", 0, "Offset to start consuming from, or the lowest offset if it's been truncated")
+	cmd.Flags().Bool("follow", false, "Keep consuming new records as they are produced")
+	return cmd
+}
+
+// follow consumes records from a stream, starting it again from the lowest
+// offset if the records it's up to are truncated
+func (c *cli) follow(ctx context.Context, out, errOut io.Writer, from uint64) error {
+	for {
+		stream, err := c.client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: from})
+		if err != nil {
+			return err
+		}
+		for {
+			res, err := stream.Recv()
+			if err == io.EOF || status.Code(err) == codes.Canceled {
+				return nil
+			}
+			if lowest, ok := truncated(err, from); ok {
+				printTruncated(errOut, from, lowest)
+				from = lowest
+				break
+			}
+			if err != nil {
+				return err
+			}
+			printRecord(out, res.Record)
+			from = res.Record.Offset + 1
+		}
+	}
+}
+
+// consumeRange streams the records from `from` up to, but not including,
+// `to`, or up to the log's last record if `to` is 0 or past it. Records
+// that have been truncated are skipped, carrying on from the log's lowest
+// offset.
+func (c *cli) consumeRange(
+	ctx context.Context,
+	errOut io.Writer,
+	from, to uint64,
+	fn func(*api.Record) error,
+) error {
+	lowest, next, err := c.offsets(ctx)
+	if err != nil {
+		return err
+	}
+	if to == 0 || to > next {
+		to = next
+	}
+	for {
+		if from < lowest {
+			printTruncated(errOut, from, lowest)
+			from = lowest
+		}
+		if from >= to {
+			return nil
+		}
+		if lowest, err = c.streamRange(ctx, &from, to, fn); err != nil {
+			return err
+		}
+	}
+}
+
+// streamRange streams the records from *from up to to, advancing *from
+// past each one. It returns the log's lowest offset if the stream stops
+// because the records it's up to have been truncated.
+func (c *cli) streamRange(
+	ctx context.Context,
+	from *uint64,
+	to uint64,
+	fn func(*api.Record) error,
+) (uint64, error) {
+	// the stream's cancelled once it's up to `to`, it'd wait for more
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := c.client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: *from})
+	if err != nil {
+		return 0, err
+	}
+	for *from < to {
+		res, err := stream.Recv()
+		if lowest, ok := truncated(err, *from); ok {
+			return lowest, nil
+		}
+		if err == io.EOF {
+			return 0, fmt.Errorf("stream ended at offset %d, before %d", *from, to)
+		}
+		if err != nil {
+			return 0, err
+		}
+		if err := fn(res.Record); err != nil {
+			return 0, err
+		}
+		*from = res.Record.Offset + 1
+	}
+	return 0, nil
+}
+
+// offsets returns the log's lowest offset and the offset its next record
+// gets, from the error consuming past its end
+func (c *cli) offsets(ctx context.Context) (lowest, next uint64, err error) {
+	_, err = c.client.Consume(ctx, &api.ConsumeRequest{Offset: math.MaxUint64})
+	lowest, next, ok := api.OffsetRange(err)
+	if !ok {
+		if err == nil {
+			err = errors.New("consuming past the log's end succeeded")
+		}
+		return 0, 0, fmt.Errorf("failed to get the log's offsets: %w", err)
+	}
+	return lowest, next, nil
+}
+
+// truncated returns the log's lowest offset if err is because off has
+// been truncated from the log
+func truncated(err error, off uint64) (uint64, bool) {
+	if status.Code(err) != codes.NotFound {
+		return 0, false
+	}
+	lowest, _, ok := api.OffsetRange(err)
+	return lowest, ok && off < lowest
+}
+
+func printTruncated(out io.Writer, off, lowest uint64) {
+	fmt.Fprintf(out, "offset %d has been truncated, consuming from %d\n", off, lowest)
+}
+
+func printRecord(out io.Writer, record *api.Record) {
+	fmt.Fprintf(out, "%d\t%s\n", record.Offset, record.Value)
+}
+
+func (c *cli) topicsCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "topics",
+		Short: "List the topics and their offsets. There's only the one log, every record's produced to it",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			lowest, next, err := c.offsets(cmd.Context())
+			if err != nil {
+				return err
+			}
+			w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "TOPIC\tLOWEST OFFSET\tNEXT OFFSET")
+			fmt.Fprintf(w, "%s\t%d\t%d\n", defaultTopic, lowest, next)
+			return w.Flush()
+		},
+	}
+}
+
+// defaultTopic is the name of the one log, as the servers authorize it
+const defaultTopic = "log"
+
+func (c *cli) serversCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "servers",
+		Short: "List the servers in the cluster",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			res, err := c.client.GetServers(cmd.Context(), &api.GetServersRequest{})
+			if err != nil {
+				return err
+			}
+			w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "ID\tRPC ADDRESS\tLEADER")
+			for _, server := range res.Servers {
+				fmt.Fprintf(w, "%s\t%s\t%t\n", server.Id, server.RpcAddr, server.IsLeader)
+			}
+			return w.Flush()
+		},
+	}
+}
+
+func (c *cli) policyCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "policy",
+		Short: "Show or replace the cluster's ACL policy",
+	}
+	cmd.AddCommand(&cobra.Command{
+		Use:   "get",
+		Short: "Print the ACL policy in effect",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			res, err := c.client.GetPolicy(cmd.Context(), &api.GetPolicyRequest{})
+			if err != nil {
+				return err
+			}
+			_, err = fmt.Fprint(cmd.OutOrStdout(), res.Policy)
+			return err
+		},
+	}, &cobra.Command{
+		Use:   "set [file]",
+		Short: "Replace the ACL policy on every server with the file's, in place of their policy files",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			policy, err := ioutil.ReadFile(args[0])
+			if err != nil {
+				return err
+			}
+			_, err = c.client.SetPolicy(cmd.Context(), &api.SetPolicyRequest{
+				Policy: string(policy),
+			})
+			return err
+		},
+	})
+	return cmd
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/michael-diggin/proglog/internal/agent"
+	"github.com/michael-diggin/proglog/internal/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCLI(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, run runFunc){
+		"produce then consume":  testProduceConsume,
+		"consume from offset":   testConsumeFrom,
+		"topics lists the log":  testTopics,
+		"servers lists servers": testServers,
+		"export then import":    testExportImport,
+		"backup writes tarball": testBackup,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			run, teardown := setupTest(t)
+			defer teardown()
+			fn(t, run)
+		})
+	}
+}
+
+// runFunc runs proglogctl with the args against the test's agent,
+// returning what it wrote to stdout
+type runFunc func(stdin string, args ...string) (string, error)
+
+func testProduceConsume(t *testing.T, run runFunc) {
+	out, err := run("", "produce", "first", "second")
+	require.NoError(t, err)
+	require.Equal(t, "0\n1\n", out)
+	out, err = run("third\nfourth\n", "produce")
+	require.NoError(t, err)
+	require.Equal(t, "2\n3\n", out)
+
+	out, err = run("", "consume")
+	require.NoError(t, err)
+	require.Equal(t, "0\tfirst\n1\tsecond\n2\tthird\n3\tfourth\n", out)
+}
+
+func testConsumeFrom(t *testing.T, run runFunc) {
+	_, err := run("", "produce", "first", "second", "third")
+	require.NoError(t, err)
+
+	out, err := run("", "consume", "--from", "1")
+	require.NoError(t, err)
+	require.Equal(t, "1\tsecond\n2\tthird\n", out)
+
+	// consuming from the end of the log consumes nothing
+	out, err = run("", "consume", "--from", "3")
+	require.NoError(t, err)
+	require.Equal(t, "", out)
+}
+
+func testTopics(t *testing.T, run runFunc) {
+	_, err := run("", "produce", "first", "second")
+	require.NoError(t, err)
+
+	out, err := run("", "topics")
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	require.Len(t, lines, 2)
+	require.Equal(t, []string{"TOPIC", "LOWEST", "OFFSET", "NEXT", "OFFSET"}, strings.Fields(lines[0]))
+	require.Equal(t, []string{"log", "0", "2"}, strings.Fields(lines[1]))
+}
+
+func testServers(t *testing.T, run runFunc) {
+	out, err := run("", "servers")
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	require.Len(t, lines, 2)
+	require.Equal(t, []string{"ID", "RPC", "ADDRESS", "LEADER"}, strings.Fields(lines[0]))
+	fields := strings.Fields(lines[1])
+	require.Equal(t, "0", fields[0])
+	require.Equal(t, "true", fields[2])
+}
+
+func testExportImport(t *testing.T, run runFunc) {
+	_, err := run("", "produce", "first", "second", "third")
+	require.NoError(t, err)
+
+	dir, err := ioutil.TempDir("", "proglogctl-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	archive := filepath.Join(dir, "archive")
+	out, err := run("", "export", "--from", "1", "--compression", "gzip", archive)
+	require.NoError(t, err)
+	require.Equal(t, "exported offsets 1 to 3\n", out)
+
+	out, err = run("", "import", archive)
+	require.NoError(t, err)
+	require.Equal(t, "imported offsets 1 to 3 at 3 to 5\n", out)
+	out, err = run("", "consume", "--from", "3")
+	require.NoError(t, err)
+	require.Equal(t, "3\tsecond\n4\tthird\n", out)
+
+	// archives are only loaded into logs outside servers' data dirs
+	logDir := filepath.Join(dir, "data", "log")
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "data", "raft"), 0755))
+	_, err = run("", "log", "load", logDir, archive)
+	require.Error(t, err)
+	out, err = run("", "log", "load", filepath.Join(dir, "loaded"), archive)
+	require.NoError(t, err)
+	require.Equal(t, "loaded offsets 1 to 3\n", out)
+}
+
+func testBackup(t *testing.T, run runFunc) {
+	_, err := run("", "produce", "first")
+	require.NoError(t, err)
+
+	dir, err := ioutil.TempDir("", "proglogctl-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "backup.tar")
+	_, err = run("", "backup", file)
+	require.NoError(t, err)
+
+	f, err := os.Open(file)
+	require.NoError(t, err)
+	defer f.Close()
+	var names []string
+	r := tar.NewReader(f)
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		names = append(names, hdr.Name)
+	}
+	require.Contains(t, names, "log/0.store")
+}
+
+// setupTest starts an agent, on its own as the cluster's leader, and
+// returns a func to run proglogctl against it as the root client
+func setupTest(t *testing.T) (runFunc, func()) {
+	t.Helper()
+
+	serverTLSConfig, err := config.SetUpTLSConfig(config.TLSConfig{
+		CertFile:      config.ServerCertFile,
+		KeyFile:       config.ServerKeyFile,
+		CAFile:        config.CAFile,
+		Server:        true,
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+	peerTLSConfig, err := config.SetUpTLSConfig(config.TLSConfig{
+		CertFile:      config.RootClientCertFile,
+		KeyFile:       config.RootClientKeyFile,
+		CAFile:        config.CAFile,
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+
+	dataDir, err := ioutil.TempDir("", "proglogctl-test")
+	require.NoError(t, err)
+	a, err := agent.New(agent.Config{
+		NodeName:        "0",
+		BindAddr:        fmt.Sprintf("127.0.0.1:%d", getFreePort(t)),
+		RPCPort:         getFreePort(t),
+		DataDir:         dataDir,
+		ACLModelFile:    config.ACLModelFile,
+		ACLPolicyFile:   config.ACLPolicyFile,
+		ServerTLSConfig: serverTLSConfig,
+		PeerTLSConfig:   peerTLSConfig,
+		Bootstrap:       true,
+	})
+	require.NoError(t, err)
+	rpcAddr, err := a.Config.RPCAddr()
+	require.NoError(t, err)
+
+	run := func(stdin string, args ...string) (string, error) {
+		cmd, err := newCmd()
+		if err != nil {
+			return "", err
+		}
+		var out bytes.Buffer
+		cmd.SetIn(strings.NewReader(stdin))
+		cmd.SetOut(&out)
+		cmd.SetErr(ioutil.Discard)
+		cmd.SetArgs(append([]string{
+			"--addr", rpcAddr,
+			"--tls-cert-file", config.RootClientCertFile,
+			"--tls-key-file", config.RootClientKeyFile,
+			"--tls-ca-file", config.CAFile,
+		}, args...))
+		err = cmd.Execute()
+		return out.String(), err
+	}
+	// the agent's ready once it's elected itself leader
+	require.Eventually(t, func() bool {
+		out, err := run("", "servers")
+		return err == nil && strings.Contains(out, "true")
+	}, 5*time.Second, 100*time.Millisecond)
+
+	return run, func() {
+		require.NoError(t, a.Shutdown())
+		require.NoError(t, os.RemoveAll(dataDir))
+	}
+}
+
+func getFreePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
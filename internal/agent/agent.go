@@ -2,10 +2,13 @@ package agent
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"net/http"
 	"sync"
 	"time"
 
@@ -13,7 +16,10 @@ import (
 	"github.com/michael-diggin/proglog/internal/auth"
 	"github.com/michael-diggin/proglog/internal/discovery"
 	"github.com/michael-diggin/proglog/internal/log"
+	"github.com/michael-diggin/proglog/internal/metrics"
+	"github.com/michael-diggin/proglog/internal/objstore"
 	"github.com/michael-diggin/proglog/internal/server"
+	"github.com/michael-diggin/proglog/internal/tracing"
 	"github.com/soheilhy/cmux"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
@@ -23,25 +29,42 @@ import (
 type Agent struct {
 	Config
 	mux          cmux.CMux
+	authorizer   *auth.Authorizer
+	quotas       *server.Quotas
 	log          *log.DistributedLog
 	server       *grpc.Server
 	membership   *discovery.Membership
+	metrics      *http.Server
+	gateway      *http.Server
+	tracing      func(context.Context) error
 	shutdown     bool
 	shutdowns    chan struct{}
 	shutdownLock sync.Mutex
 }
 
 type Config struct {
-	ServerTLSConfig *tls.Config
-	PeerTLSConfig   *tls.Config
-	DataDir         string
-	BindAddr        string
-	RPCPort         int
-	NodeName        string
-	StartJoinAddrs  []string
-	ACLModelFile    string
-	ACLPolicyFile   string
-	Bootstrap       bool
+	ServerTLSConfig   *tls.Config
+	PeerTLSConfig     *tls.Config
+	DataDir           string
+	BindAddr          string
+	RPCPort           int
+	NodeName          string
+	Zone              string
+	StartJoinAddrs    []string
+	MaxRecordBytes    uint64
+	Compression       string
+	SegmentMaxAge     time.Duration
+	EncryptionKeyFile string
+	TierURL           string
+	TierRetention     time.Duration
+	ACLModelFile      string
+	ACLPolicyFile     string
+	QuotaFile         string
+	Bootstrap         bool
+	MetricsAddr       string
+	HTTPGateway       bool
+	Authentication    auth.AuthenticatorConfig
+	Tracing           tracing.Config
 }
 
 func (c Config) RPCAddr() (string, error) {
@@ -52,6 +75,60 @@ func (c Config) RPCAddr() (string, error) {
 	return fmt.Sprintf("%s:%d", host, c.RPCPort), nil
 }
 
+// logConfig returns the config of the server's log
+func (c Config) logConfig() (logConfig log.Config, err error) {
+	logConfig.MaxRecordBytes = c.MaxRecordBytes
+	logConfig.Segment.Codec, err = log.ParseCodec(c.Compression)
+	if err != nil {
+		return logConfig, err
+	}
+	logConfig.Segment.MaxAge = c.SegmentMaxAge
+	if c.EncryptionKeyFile != "" {
+		logConfig.Keyring, err = log.LoadKeyring(c.EncryptionKeyFile)
+		if err != nil {
+			return logConfig, fmt.Errorf("failed to load encryption keys: %w", err)
+		}
+	}
+	if c.TierURL != "" {
+		logConfig.Tier.Store, err = objstore.Open(c.TierURL)
+		if err != nil {
+			return logConfig, fmt.Errorf("failed to open tiered storage: %w", err)
+		}
+		// the servers' segments differ, so each has its own
+		logConfig.Tier.Prefix = c.NodeName + "/"
+		logConfig.Tier.Retention = c.TierRetention
+	}
+	rpcAddr, err := c.RPCAddr()
+	if err != nil {
+		return logConfig, err
+	}
+	logConfig.Raft.BindAddr = rpcAddr
+	logConfig.Raft.LocalID = raft.ServerID(c.NodeName)
+	return logConfig, nil
+}
+
+// Restore restores the backup in r into the config's data dir, which must
+// be empty. The restored server takes the place of the one backed up,
+// unless rebuild is set and it's made a cluster of its own, with the
+// config's node name and address, for a cluster to be rebuilt by starting
+// it and joining other servers to it.
+func Restore(r io.Reader, config Config, rebuild bool) error {
+	if err := log.Restore(r, config.DataDir); err != nil {
+		return fmt.Errorf("failed to restore backup: %w", err)
+	}
+	if !rebuild {
+		return nil
+	}
+	logConfig, err := config.logConfig()
+	if err != nil {
+		return err
+	}
+	if err := log.RecoverNode(config.DataDir, logConfig); err != nil {
+		return fmt.Errorf("failed to recover node: %w", err)
+	}
+	return nil
+}
+
 func New(config Config) (*Agent, error) {
 	a := &Agent{
 		Config:    config,
@@ -59,9 +136,14 @@ func New(config Config) (*Agent, error) {
 	}
 	setup := []func() error{
 		a.setupLogger,
+		a.setupTracing,
 		a.setupMux,
+		a.setupAuthorizer,
+		a.setupQuotas,
 		a.setupLog,
+		a.setupGateway,
 		a.setupServer,
+		a.setupMetrics,
 		a.setupMembership,
 	}
 	for _, fn := range setup {
@@ -82,6 +164,20 @@ func (a *Agent) setupLogger() error {
 	return nil
 }
 
+func (a *Agent) setupTracing() (err error) {
+	if a.Config.Tracing.NodeName == "" {
+		a.Config.Tracing.NodeName = a.Config.NodeName
+	}
+	a.tracing, err = tracing.Setup(context.Background(), a.Config.Tracing)
+	return err
+}
+
+func (a *Agent) stopTracing() error {
+	ctx, cancel := context.WithTimeout(context.Background(), gracefulStopTimeout)
+	defer cancel()
+	return a.tracing(ctx)
+}
+
 func (a *Agent) setupMux() error {
 	addr, err := net.ResolveTCPAddr("tcp", a.Config.BindAddr)
 	if err != nil {
@@ -96,6 +192,34 @@ func (a *Agent) setupMux() error {
 	return nil
 }
 
+// setupAuthorizer loads the ACL policy and reloads it when the policy file
+// changes, until a policy's set through the SetPolicy RPC. Those are
+// replicated to every server and take precedence over their files, so the
+// servers enforce the same policy.
+func (a *Agent) setupAuthorizer() error {
+	a.authorizer = auth.New(a.Config.ACLModelFile, a.Config.ACLPolicyFile)
+	if err := a.authorizer.Watch(); err != nil {
+		return fmt.Errorf("failed to watch ACL policy: %w", err)
+	}
+	return nil
+}
+
+// setupQuotas loads the per-subject quotas, if there are any, and reloads
+// them when the quota file changes
+func (a *Agent) setupQuotas() (err error) {
+	if a.Config.QuotaFile == "" {
+		return nil
+	}
+	a.quotas, err = server.LoadQuotas(a.Config.QuotaFile)
+	if err != nil {
+		return err
+	}
+	if err := a.quotas.Watch(); err != nil {
+		return fmt.Errorf("failed to watch quotas: %w", err)
+	}
+	return nil
+}
+
 func (a *Agent) setupLog() (err error) {
 	raftLn := a.mux.Match(func(reader io.Reader) bool {
 		b := make([]byte, 1)
@@ -105,16 +229,14 @@ func (a *Agent) setupLog() (err error) {
 		return bytes.Compare(b, []byte{byte(log.RaftRPC)}) == 0
 	})
 
-	logConfig := log.Config{}
-	logConfig.Raft.StreamLayer = log.NewStreamLayer(
-		raftLn, a.Config.ServerTLSConfig, a.Config.PeerTLSConfig,
-	)
-	rpcAddr, err := a.Config.RPCAddr()
+	logConfig, err := a.Config.logConfig()
 	if err != nil {
 		return err
 	}
-	logConfig.Raft.BindAddr = rpcAddr
-	logConfig.Raft.LocalID = raft.ServerID(a.Config.NodeName)
+	logConfig.OnPolicy = a.authorizer.SetPolicy
+	logConfig.Raft.StreamLayer = log.NewStreamLayer(
+		raftLn, a.Config.ServerTLSConfig, a.Config.PeerTLSConfig,
+	)
 	logConfig.Raft.Bootstrap = a.Config.Bootstrap
 	a.log, err = log.NewDistributedLog(a.Config.DataDir, logConfig)
 	if err != nil {
@@ -129,12 +251,115 @@ func (a *Agent) setupLog() (err error) {
 	return nil
 }
 
+func (a *Agent) serverConfig() (*server.Config, error) {
+	authenticator, err := auth.NewAuthenticator(a.Config.Authentication)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up authentication: %w", err)
+	}
+	return &server.Config{
+		CommitLog:      a.log,
+		Authorizer:     a.authorizer,
+		Authenticator:  authenticator,
+		GetServerer:    a.log,
+		ServerWatcher:  a.log,
+		PolicySetter:   a.log,
+		Backuper:       a.log,
+		Quotas:         a.quotas,
+		MaxRecordBytes: a.Config.MaxRecordBytes,
+	}, nil
+}
+
+// setupGateway serves the HTTP gateway to connections that start with an
+// HTTP/1 request line, or over TLS when the server has a TLS config, to TLS
+// connections that don't only offer HTTP/2 as gRPC clients do. It has to be
+// set up before the gRPC server, which takes every other connection.
+func (a *Agent) setupGateway() error {
+	if !a.Config.HTTPGateway {
+		return nil
+	}
+	serverConfig, err := a.serverConfig()
+	if err != nil {
+		return err
+	}
+	handler, err := server.NewHTTPHandler(serverConfig)
+	if err != nil {
+		return err
+	}
+	var httpLn net.Listener
+	if a.Config.ServerTLSConfig != nil {
+		// browsers and scripts authenticate with tokens more often than
+		// certificates, so they're verified if they're given
+		tlsConfig := a.Config.ServerTLSConfig.Clone()
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		tlsConfig.NextProtos = []string{"http/1.1"}
+		httpLn = tls.NewListener(a.mux.Match(gatewayTLS), tlsConfig)
+	} else {
+		httpLn = a.mux.Match(cmux.HTTP1Fast())
+	}
+	a.gateway = &http.Server{Handler: handler}
+	go func() {
+		if err := a.gateway.Serve(httpLn); err != http.ErrServerClosed {
+			a.Shutdown()
+		}
+	}()
+	return nil
+}
+
+// gatewayTLS matches TLS connections whose clients don't only offer HTTP/2,
+// by reading the protocols they offer from their ClientHello
+func gatewayTLS(r io.Reader) bool {
+	var protos []string
+	errHello := errors.New("read ClientHello")
+	err := tls.Server(helloConn{r: r}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			protos = hello.SupportedProtos
+			return nil, errHello
+		},
+	}).Handshake()
+	if !errors.Is(err, errHello) {
+		return false
+	}
+	for _, proto := range protos {
+		if proto != "h2" {
+			return true
+		}
+	}
+	return len(protos) == 0
+}
+
+// helloConn is a connection that's only read from, for a ClientHello to be
+// read without answering it
+type helloConn struct {
+	r io.Reader
+}
+
+func (c helloConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+
+func (c helloConn) Write(b []byte) (int, error) { return len(b), nil }
+
+func (c helloConn) Close() error { return nil }
+
+func (c helloConn) LocalAddr() net.Addr { return &net.TCPAddr{} }
+
+func (c helloConn) RemoteAddr() net.Addr { return &net.TCPAddr{} }
+
+func (c helloConn) SetDeadline(t time.Time) error { return nil }
+
+func (c helloConn) SetReadDeadline(t time.Time) error { return nil }
+
+func (c helloConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func (a *Agent) stopGateway() error {
+	if a.gateway == nil {
+		return nil
+	}
+	return a.gateway.Close()
+}
+
 func (a *Agent) setupServer() (err error) {
-	authorizer := auth.New(a.Config.ACLModelFile, a.Config.ACLPolicyFile)
-	serverConfig := &server.Config{
-		CommitLog:   a.log,
-		Authorizer:  authorizer,
-		GetServerer: a.log,
+	serverConfig, err := a.serverConfig()
+	if err != nil {
+		return err
 	}
 	var opts []grpc.ServerOption
 	if a.Config.ServerTLSConfig != nil {
@@ -154,16 +379,51 @@ func (a *Agent) setupServer() (err error) {
 	return err
 }
 
+// setupMetrics serves Prometheus metrics on MetricsAddr, if it's set
+func (a *Agent) setupMetrics() error {
+	if a.Config.MetricsAddr == "" {
+		return nil
+	}
+	handler, err := metrics.NewHandler(a.log)
+	if err != nil {
+		return fmt.Errorf("failed to set up metrics: %w", err)
+	}
+	ln, err := net.Listen("tcp", a.Config.MetricsAddr)
+	if err != nil {
+		return fmt.Errorf("failed to set up metrics listener: %w", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", handler)
+	a.metrics = &http.Server{Handler: mux}
+	go func() {
+		if err := a.metrics.Serve(ln); err != http.ErrServerClosed {
+			a.Shutdown()
+		}
+	}()
+	return nil
+}
+
+func (a *Agent) stopMetrics() error {
+	if a.metrics == nil {
+		return nil
+	}
+	return a.metrics.Close()
+}
+
 func (a *Agent) setupMembership() error {
 	rpcAddr, err := a.Config.RPCAddr()
 	if err != nil {
 		return err
 	}
 
+	tags := map[string]string{"rpc_addr": rpcAddr}
+	if a.Config.Zone != "" {
+		tags["zone"] = a.Config.Zone
+	}
 	a.membership, err = discovery.New(a.log, discovery.Config{
 		NodeName:       a.Config.NodeName,
 		BindAddr:       a.Config.BindAddr,
-		Tags:           map[string]string{"rpc_addr": rpcAddr},
+		Tags:           tags,
 		StartJoinAddrs: a.Config.StartJoinAddrs,
 	})
 	if err != nil {
@@ -183,11 +443,13 @@ func (a *Agent) Shutdown() error {
 	close(a.shutdowns)
 	shutdown := []func() error{
 		a.membership.Leave,
-		func() error {
-			a.server.GracefulStop()
-			return nil
-		},
+		a.stopGateway,
+		a.stopServer,
+		a.stopMetrics,
 		a.log.Close,
+		a.authorizer.Close,
+		a.quotas.Close,
+		a.stopTracing,
 	}
 	for _, fn := range shutdown {
 		if err := fn(); err != nil {
@@ -197,6 +459,24 @@ func (a *Agent) Shutdown() error {
 	return nil
 }
 
+// gracefulStopTimeout bounds how long shutdown waits on streaming RPCs,
+// which only finish when their clients go away
+const gracefulStopTimeout = 5 * time.Second
+
+func (a *Agent) stopServer() error {
+	stopped := make(chan struct{})
+	go func() {
+		a.server.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(gracefulStopTimeout):
+		a.server.Stop()
+	}
+	return nil
+}
+
 func (a *Agent) serve() error {
 	if err := a.mux.Serve(); err != nil {
 		a.Shutdown()
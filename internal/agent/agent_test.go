@@ -1,11 +1,13 @@
 package agent
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
 	"fmt"
 	"io/ioutil"
 	"net"
+	"net/http"
 	"os"
 	"testing"
 	"time"
@@ -61,6 +63,7 @@ func TestAgent(t *testing.T) {
 			ServerTLSConfig: serverTLSConfig,
 			PeerTLSConfig:   peerTLSConfig,
 			Bootstrap:       i == 0,
+			HTTPGateway:     i == 0,
 		})
 		require.NoError(t, err)
 		agents = append(agents, agent)
@@ -76,7 +79,8 @@ func TestAgent(t *testing.T) {
 
 	message := &api.Record{Value: []byte("hello world")}
 	ctx := context.Background()
-	leaderClient := client(t, agents[0], peerTLSConfig)
+	leaderConn, leaderClient := client(t, agents[0], peerTLSConfig)
+	defer leaderConn.Close()
 	produceResponse, err := leaderClient.Produce(ctx, &api.ProduceRequest{Record: message})
 	require.NoError(t, err)
 
@@ -85,7 +89,8 @@ func TestAgent(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, message.Value, consumeResponse.Record.Value)
 
-	followClient := client(t, agents[1], peerTLSConfig)
+	followConn, followClient := client(t, agents[1], peerTLSConfig)
+	defer followConn.Close()
 	consumeResponse, err = followClient.Consume(ctx, &api.ConsumeRequest{Offset: produceResponse.Offset})
 	require.NoError(t, err)
 	require.Equal(t, message.Value, consumeResponse.Record.Value)
@@ -94,16 +99,40 @@ func TestAgent(t *testing.T) {
 	require.Error(t, err)
 	require.Nil(t, consumeResponse)
 	require.Equal(t, codes.NotFound, grpc.Code(err))
+
+	// the HTTP gateway shares the RPC port with gRPC and Raft, over TLS
+	// since the server has a TLS config. Anonymous clients reach it but
+	// can't describe the cluster.
+	rpcAddr, err := agents[0].Config.RPCAddr()
+	require.NoError(t, err)
+	url := fmt.Sprintf("https://%s/v1/servers", rpcAddr)
+	anonymousTLSConfig, err := config.SetUpTLSConfig(config.TLSConfig{
+		CAFile:        config.CAFile,
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+	for tlsConfig, status := range map[*tls.Config]int{
+		anonymousTLSConfig: http.StatusForbidden,
+		peerTLSConfig:      http.StatusOK,
+	} {
+		httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig.Clone()}}
+		res, err := httpClient.Get(url)
+		require.NoError(t, err)
+		res.Body.Close()
+		require.Equal(t, status, res.StatusCode)
+	}
+	_, err = http.Get(fmt.Sprintf("http://%s/v1/servers", rpcAddr))
+	require.Error(t, err)
 }
 
-func client(t *testing.T, agent *Agent, tlsConfig *tls.Config) api.LogClient {
+func client(t *testing.T, agent *Agent, tlsConfig *tls.Config) (*grpc.ClientConn, api.LogClient) {
 	tlsCreds := credentials.NewTLS(tlsConfig)
 	opts := []grpc.DialOption{grpc.WithTransportCredentials(tlsCreds)}
 	rpcAddr, err := agent.Config.RPCAddr()
 	require.NoError(t, err)
 	conn, err := grpc.Dial(fmt.Sprintf("%s:///%s", loadbalance.Name, rpcAddr), opts...)
 	require.NoError(t, err)
-	return api.NewLogClient(conn)
+	return conn, api.NewLogClient(conn)
 }
 
 func getFreePort() int {
@@ -119,3 +148,89 @@ func getFreePort() int {
 	defer l.Close()
 	return l.Addr().(*net.TCPAddr).Port
 }
+
+func TestBackupRestore(t *testing.T) {
+	serverTLSConfig, err := config.SetUpTLSConfig(config.TLSConfig{
+		CertFile:      config.ServerCertFile,
+		KeyFile:       config.ServerKeyFile,
+		CAFile:        config.CAFile,
+		Server:        true,
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+	peerTLSConfig, err := config.SetUpTLSConfig(config.TLSConfig{
+		CertFile:      config.RootClientCertFile,
+		KeyFile:       config.RootClientKeyFile,
+		CAFile:        config.CAFile,
+		Server:        false,
+		ServerAddress: "127.0.0.1",
+	})
+	require.NoError(t, err)
+
+	newConfig := func(name, dataDir string) Config {
+		return Config{
+			NodeName:        name,
+			BindAddr:        fmt.Sprintf("%s:%d", "127.0.0.1", getFreePort()),
+			RPCPort:         getFreePort(),
+			DataDir:         dataDir,
+			ACLModelFile:    config.ACLModelFile,
+			ACLPolicyFile:   config.ACLPolicyFile,
+			ServerTLSConfig: serverTLSConfig,
+			PeerTLSConfig:   peerTLSConfig,
+			Bootstrap:       true,
+		}
+	}
+	dataDir, err := ioutil.TempDir("", "agent-test-log")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+	agent, err := New(newConfig("0", dataDir))
+	require.NoError(t, err)
+	conn, logClient := client(t, agent, peerTLSConfig)
+	ctx := context.Background()
+	var values [][]byte
+	for i := 0; i < 3; i++ {
+		value := []byte(fmt.Sprintf("record %d", i))
+		_, err := logClient.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: value}})
+		require.NoError(t, err)
+		values = append(values, value)
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, agent.log.Backup(&buf))
+	b := buf.Bytes()
+
+	// what's produced after the backup isn't restored
+	_, err = logClient.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("later")}})
+	require.NoError(t, err)
+	conn.Close()
+	require.NoError(t, agent.Shutdown())
+
+	restoreDir, err := ioutil.TempDir("", "agent-test-restore")
+	require.NoError(t, err)
+	defer os.RemoveAll(restoreDir)
+	restoreConfig := newConfig("restored", restoreDir)
+	require.NoError(t, Restore(bytes.NewReader(b), restoreConfig, true))
+	// restores need an empty data dir
+	require.Error(t, Restore(bytes.NewReader(b), restoreConfig, false))
+
+	// the restored node is the server of its own cluster
+	restored, err := New(restoreConfig)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, restored.Shutdown())
+	}()
+	conn, logClient = client(t, restored, peerTLSConfig)
+	defer conn.Close()
+	for off, value := range values {
+		res, err := logClient.Consume(ctx, &api.ConsumeRequest{Offset: uint64(off)})
+		require.NoError(t, err)
+		require.Equal(t, value, res.Record.Value)
+	}
+	_, err = logClient.Consume(ctx, &api.ConsumeRequest{Offset: uint64(len(values))})
+	require.Equal(t, codes.NotFound, grpc.Code(err))
+
+	// and it takes produces after what was restored
+	produced, err := logClient.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("restored")}})
+	require.NoError(t, err)
+	require.Equal(t, uint64(len(values)), produced.Offset)
+}
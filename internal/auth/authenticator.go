@@ -0,0 +1,262 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	jose "gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// Authenticator returns the subject making the request in ctx, which
+// carries the gRPC peer and incoming metadata. Requests without credentials
+// get an empty subject, left to the Authorizer to reject, and requests with
+// invalid credentials fail with codes.Unauthenticated.
+type Authenticator interface {
+	Authenticate(ctx context.Context) (string, error)
+}
+
+const (
+	// MethodTLSCommonName identifies clients by their certificate's CN
+	MethodTLSCommonName = "tls-cn"
+	// MethodTLSURI identifies clients by their certificate's URI SAN, such
+	// as a SPIFFE ID
+	MethodTLSURI = "tls-uri"
+	// MethodToken identifies clients by static bearer tokens
+	MethodToken = "token"
+	// MethodJWT identifies clients by the subject of a bearer JWT
+	MethodJWT = "jwt"
+)
+
+// AuthenticatorConfig selects and configures an Authenticator
+type AuthenticatorConfig struct {
+	// Method is one of the Method constants, defaulting to MethodTLSCommonName
+	Method string
+	// TokenFile is a CSV file of subject,token lines for MethodToken
+	TokenFile string
+	// JWKSFile is the JSON Web Key Set JWTs are verified against
+	JWKSFile string
+	// Issuer and Audience, if set, must match the JWT's claims
+	Issuer   string
+	Audience string
+}
+
+// NewAuthenticator returns the Authenticator for the config's method
+func NewAuthenticator(c AuthenticatorConfig) (Authenticator, error) {
+	switch c.Method {
+	case "", MethodTLSCommonName:
+		return NewTLS(CommonName), nil
+	case MethodTLSURI:
+		return NewTLS(URI), nil
+	case MethodToken:
+		return LoadTokens(c.TokenFile)
+	case MethodJWT:
+		return NewJWT(c.JWKSFile, c.Issuer, c.Audience)
+	}
+	return nil, fmt.Errorf("unknown authentication method: %q", c.Method)
+}
+
+// Identity is the part of a client certificate that identifies the client
+type Identity int
+
+const (
+	// CommonName is the certificate subject's common name
+	CommonName Identity = iota
+	// URI is the certificate's URI SAN, e.g. spiffe://example.org/producer
+	URI
+)
+
+// TLS authenticates clients by their verified certificate
+type TLS struct {
+	identity Identity
+}
+
+var _ Authenticator = (*TLS)(nil)
+
+// NewTLS returns a TLS Authenticator taking the subject from the identity
+func NewTLS(identity Identity) *TLS {
+	return &TLS{identity: identity}
+}
+
+func (a *TLS) Authenticate(ctx context.Context) (string, error) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return "", status.Error(codes.Unknown, "couldn't find peer info")
+	}
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(tlsInfo.State.VerifiedChains) == 0 {
+		return "", nil
+	}
+	cert := tlsInfo.State.VerifiedChains[0][0]
+	switch a.identity {
+	case URI:
+		if len(cert.URIs) == 0 {
+			return "", status.Error(codes.Unauthenticated, "certificate has no URI SAN")
+		}
+		return cert.URIs[0].String(), nil
+	default:
+		return cert.Subject.CommonName, nil
+	}
+}
+
+// Tokens authenticates clients by static bearer tokens
+type Tokens struct {
+	// subjects maps tokens to the subjects they identify
+	subjects map[string]string
+}
+
+var _ Authenticator = (*Tokens)(nil)
+
+// NewTokens returns a Tokens Authenticator for the token to subject map
+func NewTokens(subjects map[string]string) *Tokens {
+	return &Tokens{subjects: subjects}
+}
+
+// LoadTokens reads a Tokens Authenticator from a CSV file of subject,token
+// lines
+func LoadTokens(file string) (*Tokens, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open token file: %w", err)
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = 2
+	r.TrimLeadingSpace = true
+	r.Comment = '#'
+	lines, err := r.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read token file: %w", err)
+	}
+	subjects := make(map[string]string, len(lines))
+	for _, line := range lines {
+		subjects[line[1]] = line[0]
+	}
+	return NewTokens(subjects), nil
+}
+
+func (a *Tokens) Authenticate(ctx context.Context) (string, error) {
+	token := bearerToken(ctx)
+	if token == "" {
+		return "", nil
+	}
+	// compare every token in constant time so the time taken doesn't leak
+	// how much of a token matched
+	var subject string
+	for t, s := range a.subjects {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			subject = s
+		}
+	}
+	if subject == "" {
+		return "", status.Error(codes.Unauthenticated, "invalid token")
+	}
+	return subject, nil
+}
+
+// jwtLeeway is the clock skew allowed when checking a JWT's times
+const jwtLeeway = time.Minute
+
+// JWT authenticates clients by bearer JWTs signed by a key in a local JSON
+// Web Key Set, taking the subject from the sub claim
+type JWT struct {
+	keys     jose.JSONWebKeySet
+	expected jwt.Expected
+}
+
+var _ Authenticator = (*JWT)(nil)
+
+// NewJWT returns a JWT Authenticator verifying tokens against the keys in
+// the JWKS file. Issuer and audience are checked if they're not empty.
+func NewJWT(jwksFile, issuer, audience string) (*JWT, error) {
+	b, err := ioutil.ReadFile(jwksFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read JWKS file: %w", err)
+	}
+	a := &JWT{expected: jwt.Expected{Issuer: issuer}}
+	if err := json.Unmarshal(b, &a.keys); err != nil {
+		return nil, fmt.Errorf("failed to parse JWKS file: %w", err)
+	}
+	if len(a.keys.Keys) == 0 {
+		return nil, fmt.Errorf("no keys in JWKS file: %s", jwksFile)
+	}
+	if audience != "" {
+		a.expected.Audience = jwt.Audience{audience}
+	}
+	return a, nil
+}
+
+func (a *JWT) Authenticate(ctx context.Context) (string, error) {
+	token := bearerToken(ctx)
+	if token == "" {
+		return "", nil
+	}
+	tok, err := jwt.ParseSigned(token)
+	if err != nil {
+		return "", status.Error(codes.Unauthenticated, "malformed token")
+	}
+	key, ok := a.key(tok)
+	if !ok {
+		return "", status.Error(codes.Unauthenticated, "unknown signing key")
+	}
+	var claims jwt.Claims
+	if err := tok.Claims(key.Key, &claims); err != nil {
+		return "", status.Error(codes.Unauthenticated, "invalid token signature")
+	}
+	expected := a.expected
+	expected.Time = time.Now()
+	if err := claims.ValidateWithLeeway(expected, jwtLeeway); err != nil {
+		return "", status.Errorf(codes.Unauthenticated, "invalid token: %v", err)
+	}
+	if claims.Subject == "" {
+		return "", status.Error(codes.Unauthenticated, "token has no subject")
+	}
+	return claims.Subject, nil
+}
+
+// key returns the key the token was signed with, by its key ID or, for
+// tokens without one, the set's only key
+func (a *JWT) key(tok *jwt.JSONWebToken) (jose.JSONWebKey, bool) {
+	if len(tok.Headers) == 0 {
+		return jose.JSONWebKey{}, false
+	}
+	kid := tok.Headers[0].KeyID
+	if kid == "" {
+		if len(a.keys.Keys) == 1 {
+			return a.keys.Keys[0], true
+		}
+		return jose.JSONWebKey{}, false
+	}
+	keys := a.keys.Key(kid)
+	if len(keys) == 0 {
+		return jose.JSONWebKey{}, false
+	}
+	return keys[0], true
+}
+
+// bearerToken returns the token in the request's authorization metadata
+func bearerToken(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	for _, v := range md.Get("authorization") {
+		const prefix = "bearer "
+		if len(v) > len(prefix) && strings.EqualFold(v[:len(prefix)], prefix) {
+			return v[len(prefix):]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,151 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	jose "gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+func TestTLS(t *testing.T) {
+	spiffeID, err := url.Parse("spiffe://proglog.dev/producer")
+	require.NoError(t, err)
+	ctx := tlsContext(&x509.Certificate{
+		Subject: pkix.Name{CommonName: "root"},
+		URIs:    []*url.URL{spiffeID},
+	})
+
+	subject, err := NewTLS(CommonName).Authenticate(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "root", subject)
+
+	subject, err = NewTLS(URI).Authenticate(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "spiffe://proglog.dev/producer", subject)
+
+	_, err = NewTLS(URI).Authenticate(tlsContext(&x509.Certificate{}))
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	// clients without certificates are anonymous
+	ctx = peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{}})
+	subject, err = NewTLS(CommonName).Authenticate(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "", subject)
+}
+
+func TestTokens(t *testing.T) {
+	f, err := ioutil.TempFile("", "tokens-*.csv")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString("# subject,token\nroot,s3cret\nnobody,0pen\n")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	a, err := NewAuthenticator(AuthenticatorConfig{Method: MethodToken, TokenFile: f.Name()})
+	require.NoError(t, err)
+
+	subject, err := a.Authenticate(tokenContext("s3cret"))
+	require.NoError(t, err)
+	require.Equal(t, "root", subject)
+
+	_, err = a.Authenticate(tokenContext("wrong"))
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	subject, err = a.Authenticate(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "", subject)
+}
+
+func TestJWT(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	jwks, err := json.Marshal(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{
+		Key: key.Public(), KeyID: "1", Algorithm: string(jose.RS256), Use: "sig",
+	}}})
+	require.NoError(t, err)
+	f, err := ioutil.TempFile("", "jwks-*.json")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.Write(jwks)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	a, err := NewAuthenticator(AuthenticatorConfig{
+		Method:   MethodJWT,
+		JWKSFile: f.Name(),
+		Issuer:   "https://issuer.proglog.dev",
+		Audience: "proglog",
+	})
+	require.NoError(t, err)
+
+	sign := func(key *rsa.PrivateKey, claims jwt.Claims) context.Context {
+		signer, err := jose.NewSigner(
+			jose.SigningKey{Algorithm: jose.RS256, Key: key},
+			(&jose.SignerOptions{}).WithHeader("kid", "1"),
+		)
+		require.NoError(t, err)
+		token, err := jwt.Signed(signer).Claims(claims).CompactSerialize()
+		require.NoError(t, err)
+		return tokenContext(token)
+	}
+	valid := jwt.Claims{
+		Subject:  "root",
+		Issuer:   "https://issuer.proglog.dev",
+		Audience: jwt.Audience{"proglog"},
+		Expiry:   jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	}
+
+	subject, err := a.Authenticate(sign(key, valid))
+	require.NoError(t, err)
+	require.Equal(t, "root", subject)
+
+	expired := valid
+	expired.Expiry = jwt.NewNumericDate(time.Now().Add(-time.Hour))
+	wrongIssuer := valid
+	wrongIssuer.Issuer = "https://evil.dev"
+	for _, ctx := range []context.Context{
+		sign(other, valid),
+		sign(key, expired),
+		sign(key, wrongIssuer),
+		tokenContext("not-a-jwt"),
+	} {
+		_, err = a.Authenticate(ctx)
+		require.Equal(t, codes.Unauthenticated, status.Code(err))
+	}
+}
+
+func tlsContext(cert *x509.Certificate) context.Context {
+	return peer.NewContext(context.Background(), &peer.Peer{
+		Addr: &net.TCPAddr{},
+		AuthInfo: credentials.TLSInfo{State: tls.ConnectionState{
+			VerifiedChains: [][]*x509.Certificate{{cert}},
+		}},
+	})
+}
+
+func tokenContext(token string) context.Context {
+	return metadata.NewIncomingContext(context.Background(), metadata.Pairs(
+		"authorization", "Bearer "+token,
+	))
+}
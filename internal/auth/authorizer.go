@@ -1,30 +1,197 @@
 package auth
 
 import (
+	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
 
 	"github.com/casbin/casbin"
+	"github.com/casbin/casbin/model"
+	"github.com/casbin/casbin/persist"
+	"github.com/michael-diggin/proglog/internal/config"
+	"go.uber.org/zap"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
-// Authorizer is the type to store and enforce ACL rules
+// Authorizer is the type to store and enforce ACL rules. Its policy can be
+// replaced while it's in use, by reloading the policy file or with
+// SetPolicy. Policies set with SetPolicy take precedence: once one's set,
+// the policy file's ignored, so servers that are handed the same policies
+// enforce the same one whatever their files say.
 type Authorizer struct {
+	model  string
+	policy string
+
+	mu       sync.RWMutex
 	enforcer *casbin.Enforcer
+	text     []byte
+	// set is whether the policy was set with SetPolicy
+	set bool
+
+	watcher io.Closer
 }
 
 // New returns a new Authorizer instance
 func New(model, policy string) *Authorizer {
 	enforcer := casbin.NewEnforcer(model, policy)
-	return &Authorizer{enforcer}
+	text, _ := ioutil.ReadFile(policy)
+	return &Authorizer{
+		model:    model,
+		policy:   policy,
+		enforcer: enforcer,
+		text:     text,
+	}
 }
 
 // Authorize determines if the given subject can act on an object
 func (a *Authorizer) Authorize(subject, object, action string) error {
-	if !a.enforcer.Enforce(subject, object, action) {
+	a.mu.RLock()
+	enforcer := a.enforcer
+	a.mu.RUnlock()
+	if !enforcer.Enforce(subject, object, action) {
 		msg := fmt.Sprintf("%s not permitted to %s to %s", subject, object, action)
 		st := status.New(codes.PermissionDenied, msg)
 		return st.Err()
 	}
 	return nil
 }
+
+// Policy returns the policy in effect, in the policy file's CSV format
+func (a *Authorizer) Policy() []byte {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.text
+}
+
+// SetPolicy replaces the policy with the given policy, in the policy file's
+// CSV format, in place of the policy file's from then on. Invalid policies
+// fail with codes.InvalidArgument and leave the current policy in effect.
+func (a *Authorizer) SetPolicy(policy []byte) error {
+	enforcer, err := newEnforcer(a.model, policy)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "invalid policy: %v", err)
+	}
+	a.mu.Lock()
+	a.enforcer = enforcer
+	a.text = policy
+	a.set = true
+	a.mu.Unlock()
+	return nil
+}
+
+// ErrPolicySet is returned reloading the policy file once a policy's been
+// set with SetPolicy, which takes precedence
+var ErrPolicySet = errors.New("policy file ignored, a policy was set with SetPolicy")
+
+// Reload replaces the policy with the policy file's, unless a policy's been
+// set with SetPolicy
+func (a *Authorizer) Reload() error {
+	policy, err := ioutil.ReadFile(a.policy)
+	if err != nil {
+		return err
+	}
+	enforcer, err := newEnforcer(a.model, policy)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "invalid policy: %v", err)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.set {
+		return ErrPolicySet
+	}
+	a.enforcer = enforcer
+	a.text = policy
+	return nil
+}
+
+// Watch reloads the policy whenever the policy file changes, until Close is
+// called. Policy files that fail to load are logged and ignored.
+func (a *Authorizer) Watch() (err error) {
+	a.watcher, err = config.WatchFile(a.policy, func() {
+		logger := zap.L().Named("auth")
+		if err := a.Reload(); err == ErrPolicySet {
+			logger.Warn("not reloading policy", zap.String("file", a.policy), zap.Error(err))
+			return
+		} else if err != nil {
+			logger.Error("failed to reload policy", zap.Error(err))
+			return
+		}
+		logger.Info("reloaded policy", zap.String("file", a.policy))
+	})
+	return err
+}
+
+// Close stops watching the policy file
+func (a *Authorizer) Close() error {
+	if a.watcher == nil {
+		return nil
+	}
+	return a.watcher.Close()
+}
+
+// newEnforcer returns an enforcer for the model file and policy text,
+// turning casbin's panics on bad input into errors
+func newEnforcer(model string, policy []byte) (e *casbin.Enforcer, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			e, err = nil, fmt.Errorf("%v", r)
+		}
+	}()
+	e = casbin.NewEnforcer(model)
+	e.SetAdapter(policyAdapter(policy))
+	if err := e.LoadPolicy(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// policyAdapter loads a policy from its CSV text
+type policyAdapter []byte
+
+var _ persist.Adapter = policyAdapter(nil)
+
+func (p policyAdapter) LoadPolicy(model model.Model) error {
+	scanner := bufio.NewScanner(bytes.NewReader(p))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		tokens := strings.Split(line, ",")
+		key := strings.TrimSpace(tokens[0])
+		if key == "" {
+			return fmt.Errorf("line %d: missing policy type", n)
+		}
+		ast, ok := model[key[:1]][key]
+		if !ok {
+			return fmt.Errorf("line %d: unknown policy type %q", n, key)
+		}
+		if key[:1] == "p" && len(tokens)-1 != len(ast.Tokens) {
+			return fmt.Errorf("line %d: want %d fields, got %d", n, len(ast.Tokens), len(tokens)-1)
+		}
+		persist.LoadPolicyLine(line, model)
+	}
+	return scanner.Err()
+}
+
+func (p policyAdapter) SavePolicy(model model.Model) error {
+	return fmt.Errorf("not implemented")
+}
+
+func (p policyAdapter) AddPolicy(sec string, ptype string, rule []string) error {
+	return fmt.Errorf("not implemented")
+}
+
+func (p policyAdapter) RemovePolicy(sec string, ptype string, rule []string) error {
+	return fmt.Errorf("not implemented")
+}
+
+func (p policyAdapter) RemoveFilteredPolicy(sec string, ptype string, fieldIndex int, fieldValues ...string) error {
+	return fmt.Errorf("not implemented")
+}
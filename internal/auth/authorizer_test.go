@@ -0,0 +1,63 @@
+package auth
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/michael-diggin/proglog/internal/config"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestAuthorizerSetPolicy(t *testing.T) {
+	a := New(config.ACLModelFile, config.ACLPolicyFile)
+	require.NoError(t, a.Authorize("root", "log", "produce"))
+	require.Equal(t, codes.PermissionDenied, status.Code(a.Authorize("nobody", "log", "produce")))
+
+	require.NoError(t, a.SetPolicy([]byte("# producers\np, nobody, log/*, produce\n")))
+	require.NoError(t, a.Authorize("nobody", "log/orders", "produce"))
+	require.Error(t, a.Authorize("nobody", "cluster", "produce"))
+	require.Error(t, a.Authorize("root", "log", "produce"))
+	require.Equal(t, "# producers\np, nobody, log/*, produce\n", string(a.Policy()))
+
+	for _, policy := range []string{
+		"p, nobody, log",
+		"x, nobody, log, produce",
+		", nobody",
+	} {
+		err := a.SetPolicy([]byte(policy))
+		require.Equal(t, codes.InvalidArgument, status.Code(err), policy)
+	}
+	// invalid policies leave the last one in effect
+	require.NoError(t, a.Authorize("nobody", "log/orders", "produce"))
+}
+
+func TestAuthorizerWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authorizer-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	policy := filepath.Join(dir, "policy.csv")
+	require.NoError(t, ioutil.WriteFile(policy, []byte("p, root, *, produce\n"), 0644))
+
+	a := New(config.ACLModelFile, policy)
+	require.NoError(t, a.Watch())
+	defer a.Close()
+	require.Error(t, a.Authorize("nobody", "log", "produce"))
+
+	require.NoError(t, ioutil.WriteFile(policy, []byte("p, nobody, *, produce\n"), 0644))
+	require.Eventually(t, func() bool {
+		return a.Authorize("nobody", "log", "produce") == nil
+	}, time.Second, 10*time.Millisecond)
+	require.Error(t, a.Authorize("root", "log", "produce"))
+
+	// policies set with SetPolicy take precedence over the file
+	require.NoError(t, a.SetPolicy([]byte("p, root, *, consume\n")))
+	require.NoError(t, ioutil.WriteFile(policy, []byte("p, nobody, *, consume\n"), 0644))
+	require.Equal(t, ErrPolicySet, a.Reload())
+	require.NoError(t, a.Authorize("root", "log", "consume"))
+	require.Error(t, a.Authorize("nobody", "log", "consume"))
+}
@@ -0,0 +1,47 @@
+package config
+
+import (
+	"io"
+	"path/filepath"
+
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+)
+
+// WatchFile calls onChange every time the file is written or replaced,
+// until the returned io.Closer is closed
+func WatchFile(file string, onChange func()) (io.Closer, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	// watch the directory rather than the file so the file can be replaced,
+	// as editors and config management tools do
+	if err := watcher.Add(filepath.Dir(file)); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+	go func() {
+		name := filepath.Clean(file)
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) == name &&
+					event.Op&(fsnotify.Write|fsnotify.Create) != 0 {
+					onChange()
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				zap.L().Named("config").Error(
+					"failed to watch file", zap.String("file", file), zap.Error(err),
+				)
+			}
+		}
+	}()
+	return watcher, nil
+}
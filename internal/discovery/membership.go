@@ -28,6 +28,12 @@ type Handler interface {
 	Leave(name string) error
 }
 
+// ZoneHandler is implemented by handlers that want to know the zone each
+// member, including the local one, advertises in its "zone" tag
+type ZoneHandler interface {
+	SetZone(name, zone string)
+}
+
 func New(handler Handler, config Config) (*Membership, error) {
 	c := &Membership{
 		Config:  config,
@@ -73,11 +79,16 @@ func (m *Membership) eventHandler() {
 		switch e.EventType() {
 		case serf.EventMemberJoin:
 			for _, member := range e.(serf.MemberEvent).Members {
+				m.handleZone(member)
 				if m.isLocal(member) {
 					continue
 				}
 				m.handleJoin(member)
 			}
+		case serf.EventMemberUpdate:
+			for _, member := range e.(serf.MemberEvent).Members {
+				m.handleZone(member)
+			}
 		case serf.EventMemberLeave, serf.EventMemberFailed:
 			for _, member := range e.(serf.MemberEvent).Members {
 				if m.isLocal(member) {
@@ -95,6 +106,14 @@ func (m *Membership) handleJoin(member serf.Member) {
 	}
 }
 
+func (m *Membership) handleZone(member serf.Member) {
+	if h, ok := m.handler.(ZoneHandler); ok {
+		if zone, ok := member.Tags["zone"]; ok {
+			h.SetZone(member.Name, zone)
+		}
+	}
+}
+
 func (m *Membership) handleLeave(member serf.Member) {
 	if err := m.handler.Leave(member.Name); err != nil {
 		m.logError(err, "failed to leave", member)
@@ -1,66 +1,380 @@
 package loadbalance
 
 import (
-	"strings"
+	"encoding/json"
+	"fmt"
+	"path"
 	"sync"
 	"sync/atomic"
+	"time"
 
+	"google.golang.org/grpc/attributes"
 	"google.golang.org/grpc/balancer"
 	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	_ "google.golang.org/grpc/health"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+	"google.golang.org/grpc/status"
 )
 
-var _ base.PickerBuilder = (*Picker)(nil)
+// Policy decides which servers a method's requests are routed to
+type Policy int
+
+const (
+	// LeaderOnly sends requests to the leader
+	LeaderOnly Policy = iota
+	// Any spreads requests over every ready server
+	Any
+	// FollowerPreferred spreads requests over the followers in the client's
+	// zone, falling back to followers in other zones and then to the leader
+	// when none are ready
+	FollowerPreferred
+	// Nearest sends requests to the server with the lowest observed latency.
+	// It should only be used for unary methods, as latency is measured from
+	// pick until the RPC is done.
+	Nearest
+)
+
+var (
+	policiesMu sync.RWMutex
+	// policies maps method names to their routing policy, methods not in the
+	// table are sent to the leader
+	policies = map[string]Policy{
+		"Produce":       LeaderOnly,
+		"ProduceStream": LeaderOnly,
+		"Consume":       FollowerPreferred,
+		"ConsumeStream": FollowerPreferred,
+		"GetServers":    Any,
+		"WatchServers":  Any,
+	}
+)
+
+// SetPolicy sets the routing policy for the method with the given name,
+// e.g. "Consume"
+func SetPolicy(method string, policy Policy) {
+	policiesMu.Lock()
+	defer policiesMu.Unlock()
+	policies[method] = policy
+}
+
+func policyFor(fullMethodName string) Policy {
+	policiesMu.RLock()
+	defer policiesMu.RUnlock()
+	if policy, ok := policies[path.Base(fullMethodName)]; ok {
+		return policy
+	}
+	return LeaderOnly
+}
+
+// errNoLeader is returned when servers are ready but none of them is the
+// leader, so the RPC fails fast instead of waiting for a new picker
+var errNoLeader = status.Error(codes.Unavailable, "no leader available")
+
+func init() {
+	balancer.Register(&balancerBuilder{})
+}
+
+type balancerBuilder struct{}
+
+var _ balancer.ConfigParser = (*balancerBuilder)(nil)
+
+// balancerConfig is the proglog loadBalancingConfig set by the resolver
+type balancerConfig struct {
+	serviceconfig.LoadBalancingConfig `json:"-"`
+	// Zone is the client's zone, reads prefer followers in it
+	Zone string `json:"zone,omitempty"`
+}
+
+func (*balancerBuilder) Name() string {
+	return Name
+}
+
+func (*balancerBuilder) ParseConfig(js json.RawMessage) (serviceconfig.LoadBalancingConfig, error) {
+	cfg := &balancerConfig{}
+	if err := json.Unmarshal(js, cfg); err != nil {
+		return nil, fmt.Errorf("invalid %s config: %w", Name, err)
+	}
+	return cfg, nil
+}
+
+func (*balancerBuilder) Build(cc balancer.ClientConn, opts balancer.BuildOptions) balancer.Balancer {
+	b := &leaderBalancer{
+		cc:        cc,
+		latencies: newLatencies(),
+	}
+	b.base = base.NewBalancerBuilder(Name, b, base.Config{HealthCheck: true}).Build(b, opts)
+	return b
+}
+
+// leaderBalancer wraps the base balancer, which only builds pickers when
+// SubConns become ready or stop being ready, so that pickers are also
+// rebuilt when the resolver reports a new leader, and so that losing the
+// leader triggers re-resolution
+type leaderBalancer struct {
+	cc        balancer.ClientConn
+	base      balancer.Balancer
+	latencies *latencies
+	zone      string
+
+	state     connectivity.State
+	ready     map[balancer.SubConn]base.SubConnInfo
+	hadLeader bool
+	// resolvedLeader is whether the resolver's last update had a leader
+	resolvedLeader bool
+}
+
+var _ balancer.Balancer = (*leaderBalancer)(nil)
+
+var _ base.PickerBuilder = (*leaderBalancer)(nil)
+
+func (b *leaderBalancer) UpdateClientConnState(s balancer.ClientConnState) error {
+	if cfg, ok := s.BalancerConfig.(*balancerConfig); ok {
+		b.zone = cfg.Zone
+	}
+	b.resolvedLeader = false
+	for _, addr := range s.ResolverState.Addresses {
+		if isLeader(addr) {
+			b.resolvedLeader = true
+		}
+	}
+	err := b.base.UpdateClientConnState(s)
+	if b.state != connectivity.Ready || b.ready == nil {
+		return err
+	}
+	attrs := make(map[string]*attributes.Attributes, len(s.ResolverState.Addresses))
+	for _, addr := range s.ResolverState.Addresses {
+		attrs[addr.Addr] = addr.Attributes
+	}
+	ready := make(map[balancer.SubConn]base.SubConnInfo, len(b.ready))
+	for sc, info := range b.ready {
+		a, ok := attrs[info.Address.Addr]
+		if !ok {
+			// removed by the resolver, base will shut the SubConn down
+			continue
+		}
+		info.Address.Attributes = a
+		ready[sc] = info
+	}
+	b.cc.UpdateState(balancer.State{
+		ConnectivityState: b.state,
+		Picker:            b.Build(base.PickerBuildInfo{ReadySCs: ready}),
+	})
+	return err
+}
+
+func (b *leaderBalancer) ResolverError(err error) {
+	b.base.ResolverError(err)
+}
+
+func (b *leaderBalancer) UpdateSubConnState(sc balancer.SubConn, s balancer.SubConnState) {
+	b.base.UpdateSubConnState(sc, s)
+}
+
+func (b *leaderBalancer) Close() {
+	b.base.Close()
+}
+
+// Build implements base.PickerBuilder
+func (b *leaderBalancer) Build(info base.PickerBuildInfo) balancer.Picker {
+	b.ready = info.ReadySCs
+	p := newPicker(info, b.zone, b.latencies, b.resolveNow)
+	p.leaderConnecting = b.resolvedLeader && p.leader == nil
+	if b.hadLeader && p.leader == nil {
+		b.resolveNow()
+	}
+	b.hadLeader = p.leader != nil
+	return p
+}
+
+// resolveNow asks the resolver to resolve again. It doesn't block as the
+// resolver's update is handled synchronously by the balancer.
+func (b *leaderBalancer) resolveNow() {
+	go b.cc.ResolveNow(resolver.ResolveNowOptions{})
+}
+
+// The methods below implement balancer.ClientConn so the balancer can watch
+// the pickers base sends to gRPC
+
+func (b *leaderBalancer) NewSubConn(addrs []resolver.Address, opts balancer.NewSubConnOptions) (balancer.SubConn, error) {
+	return b.cc.NewSubConn(addrs, opts)
+}
+
+func (b *leaderBalancer) RemoveSubConn(sc balancer.SubConn) {
+	b.latencies.remove(sc)
+	b.cc.RemoveSubConn(sc)
+}
+
+func (b *leaderBalancer) UpdateAddresses(sc balancer.SubConn, addrs []resolver.Address) {
+	b.cc.UpdateAddresses(sc, addrs)
+}
+
+func (b *leaderBalancer) UpdateState(s balancer.State) {
+	b.state = s.ConnectivityState
+	b.cc.UpdateState(s)
+}
+
+func (b *leaderBalancer) ResolveNow(opts resolver.ResolveNowOptions) {
+	b.cc.ResolveNow(opts)
+}
+
+func (b *leaderBalancer) Target() string {
+	return b.cc.Target()
+}
 
 var _ balancer.Picker = (*Picker)(nil)
 
+// Picker routes each RPC to the leader or a follower depending on the
+// method's Policy
 type Picker struct {
-	mu        sync.RWMutex
 	leader    balancer.SubConn
 	followers []balancer.SubConn
-	current   uint64
-}
+	// local are the followers in the client's zone
+	local   []balancer.SubConn
+	all     []balancer.SubConn
+	current uint64
 
-func init() {
-	balancer.Register(base.NewBalancerBuilder(Name, &Picker{}, base.Config{}))
-}
+	// leaderConnecting is whether the resolver knows the leader but its
+	// SubConn isn't ready yet, so RPCs wait for it rather than failing
+	leaderConnecting bool
 
-func (p *Picker) Build(buildInfo base.PickerBuildInfo) balancer.Picker {
-	p.mu.Lock()
-	defer p.mu.Unlock()
+	latencies   *latencies
+	resolveNow  func()
+	resolveOnce sync.Once
+}
 
-	var followers []balancer.SubConn
-	for sc, scInfo := range buildInfo.ReadySCs {
-		isLeader := scInfo.Address.Attributes.Value("is_leader").(bool)
-		if isLeader {
+func newPicker(info base.PickerBuildInfo, zone string, latencies *latencies, resolveNow func()) *Picker {
+	p := &Picker{
+		latencies:  latencies,
+		resolveNow: resolveNow,
+	}
+	for sc, scInfo := range info.ReadySCs {
+		p.all = append(p.all, sc)
+		if isLeader(scInfo.Address) {
 			p.leader = sc
 			continue
 		}
-		followers = append(followers, sc)
+		p.followers = append(p.followers, sc)
+		if zone != "" && zoneOf(scInfo.Address) == zone {
+			p.local = append(p.local, sc)
+		}
 	}
-	p.followers = followers
 	return p
 }
 
-func (p *Picker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
-	p.mu.RLock()
-	defer p.mu.RUnlock()
+func isLeader(addr resolver.Address) bool {
+	if addr.Attributes == nil {
+		return false
+	}
+	isLeader, _ := addr.Attributes.Value("is_leader").(bool)
+	return isLeader
+}
+
+func zoneOf(addr resolver.Address) string {
+	if addr.Attributes == nil {
+		return ""
+	}
+	zone, _ := addr.Attributes.Value("zone").(string)
+	return zone
+}
 
+func (p *Picker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
 	var result balancer.PickResult
-	if strings.Contains(info.FullMethodName, "Produce") ||
-		len(p.followers) == 0 {
+	if len(p.all) == 0 {
+		return result, balancer.ErrNoSubConnAvailable
+	}
+	switch policyFor(info.FullMethodName) {
+	case LeaderOnly:
 		result.SubConn = p.leader
-	} else if strings.Contains(info.FullMethodName, "Consume") {
-		result.SubConn = p.nextFollower()
+	case Any:
+		result.SubConn = p.next(p.all)
+	case FollowerPreferred:
+		switch {
+		case len(p.local) > 0:
+			result.SubConn = p.next(p.local)
+		case len(p.followers) > 0:
+			result.SubConn = p.next(p.followers)
+		default:
+			result.SubConn = p.leader
+		}
+	case Nearest:
+		result.SubConn = p.nearest()
+		result.Done = p.latencies.track(result.SubConn)
 	}
 	if result.SubConn == nil {
-		return result, balancer.ErrNoSubConnAvailable
+		if p.leaderConnecting {
+			return result, balancer.ErrNoSubConnAvailable
+		}
+		if p.resolveNow != nil {
+			p.resolveOnce.Do(p.resolveNow)
+		}
+		return result, errNoLeader
 	}
 	return result, nil
 }
 
-func (p *Picker) nextFollower() balancer.SubConn {
+func (p *Picker) next(subConns []balancer.SubConn) balancer.SubConn {
 	cur := atomic.AddUint64(&p.current, uint64(1))
-	len := uint64(len(p.followers))
+	len := uint64(len(subConns))
 	idx := int(cur % len)
-	return p.followers[idx]
+	return subConns[idx]
+}
+
+// nearest returns the SubConn with the lowest latency, trying SubConns
+// that haven't been measured yet first
+func (p *Picker) nearest() balancer.SubConn {
+	var best balancer.SubConn
+	var bestLatency time.Duration
+	for _, sc := range p.all {
+		latency, ok := p.latencies.get(sc)
+		if !ok {
+			return sc
+		}
+		if best == nil || latency < bestLatency {
+			best, bestLatency = sc, latency
+		}
+	}
+	return best
+}
+
+// latencies keeps a moving average of each SubConn's RPC latency
+type latencies struct {
+	mu    sync.Mutex
+	byCon map[balancer.SubConn]time.Duration
+}
+
+func newLatencies() *latencies {
+	return &latencies{byCon: make(map[balancer.SubConn]time.Duration)}
+}
+
+func (l *latencies) get(sc balancer.SubConn) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	latency, ok := l.byCon[sc]
+	return latency, ok
+}
+
+// track returns a func that records the latency of the RPC sent to sc when
+// it's done
+func (l *latencies) track(sc balancer.SubConn) func(balancer.DoneInfo) {
+	start := time.Now()
+	return func(info balancer.DoneInfo) {
+		if info.Err != nil {
+			return
+		}
+		latency := time.Since(start)
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if prev, ok := l.byCon[sc]; ok {
+			latency = (prev*4 + latency) / 5
+		}
+		l.byCon[sc] = latency
+	}
+}
+
+func (l *latencies) remove(sc balancer.SubConn) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.byCon, sc)
 }
@@ -2,12 +2,16 @@ package loadbalance
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	"google.golang.org/grpc/attributes"
 	"google.golang.org/grpc/balancer"
 	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
 	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/status"
 )
 
 func TestPickNoSubConnAvailable(t *testing.T) {
@@ -56,8 +60,7 @@ func setupTest() (*Picker, []*subConn) {
 		buildInfo.ReadySCs[sc] = base.SubConnInfo{Address: addr}
 		subConns = append(subConns, sc)
 	}
-	picker := &Picker{}
-	picker.Build(buildInfo)
+	picker := newPicker(buildInfo, "", newLatencies(), nil)
 	return picker, subConns
 }
 
@@ -70,3 +73,174 @@ func (s *subConn) Connect() {}
 func (s *subConn) UpdateAddresses(addrs []resolver.Address) {
 	s.addrs = addrs
 }
+
+func TestPickerRoutesByMethod(t *testing.T) {
+	picker, subConns := setupTest()
+
+	picked := make(map[balancer.SubConn]bool)
+	info := balancer.PickInfo{FullMethodName: "/log.vX.Log/GetServers"}
+	for i := 0; i < 3; i++ {
+		gotPick, err := picker.Pick(info)
+		require.NoError(t, err)
+		picked[gotPick.SubConn] = true
+	}
+	require.Len(t, picked, 3)
+
+	// methods without a policy go to the leader
+	info = balancer.PickInfo{FullMethodName: "/log.vX.Log/Unknown"}
+	gotPick, err := picker.Pick(info)
+	require.NoError(t, err)
+	require.Equal(t, subConns[0], gotPick.SubConn)
+}
+
+func TestPickerConsumesFromLeaderWithoutFollowers(t *testing.T) {
+	leader := &subConn{}
+	buildInfo := base.PickerBuildInfo{ReadySCs: map[balancer.SubConn]base.SubConnInfo{
+		leader: {Address: resolver.Address{Attributes: attributes.New("is_leader", true)}},
+	}}
+	picker := newPicker(buildInfo, "", newLatencies(), nil)
+	gotPick, err := picker.Pick(balancer.PickInfo{FullMethodName: "/log.vX.Log/Consume"})
+	require.NoError(t, err)
+	require.Equal(t, leader, gotPick.SubConn)
+}
+
+func TestPickerWithoutLeaderResolves(t *testing.T) {
+	follower := &subConn{}
+	buildInfo := base.PickerBuildInfo{ReadySCs: map[balancer.SubConn]base.SubConnInfo{
+		follower: {Address: resolver.Address{Attributes: attributes.New("is_leader", false)}},
+	}}
+	var resolves int
+	picker := newPicker(buildInfo, "", newLatencies(), func() { resolves++ })
+	for i := 0; i < 3; i++ {
+		_, err := picker.Pick(balancer.PickInfo{FullMethodName: "/log.vX.Log/Produce"})
+		require.Equal(t, codes.Unavailable, status.Code(err))
+	}
+	require.Equal(t, 1, resolves)
+
+	gotPick, err := picker.Pick(balancer.PickInfo{FullMethodName: "/log.vX.Log/Consume"})
+	require.NoError(t, err)
+	require.Equal(t, follower, gotPick.SubConn)
+}
+
+func TestPickerWaitsForConnectingLeader(t *testing.T) {
+	follower := &subConn{}
+	buildInfo := base.PickerBuildInfo{ReadySCs: map[balancer.SubConn]base.SubConnInfo{
+		follower: {Address: resolver.Address{Attributes: attributes.New("is_leader", false)}},
+	}}
+	var resolves int
+	picker := newPicker(buildInfo, "", newLatencies(), func() { resolves++ })
+	picker.leaderConnecting = true
+	_, err := picker.Pick(balancer.PickInfo{FullMethodName: "/log.vX.Log/Produce"})
+	require.Equal(t, balancer.ErrNoSubConnAvailable, err)
+	require.Equal(t, 0, resolves)
+}
+
+func TestPickerNearest(t *testing.T) {
+	SetPolicy("Lookup", Nearest)
+	picker, subConns := setupTest()
+	picker.latencies.byCon[subConns[0]] = 3 * time.Millisecond
+	picker.latencies.byCon[subConns[1]] = time.Millisecond
+	picker.latencies.byCon[subConns[2]] = 2 * time.Millisecond
+
+	info := balancer.PickInfo{FullMethodName: "/log.vX.Log/Lookup"}
+	gotPick, err := picker.Pick(info)
+	require.NoError(t, err)
+	require.Equal(t, subConns[1], gotPick.SubConn)
+	require.NotNil(t, gotPick.Done)
+}
+
+func TestBalancerRebuildsPickerOnLeaderChange(t *testing.T) {
+	cc := &balancerClientConn{}
+	b := (&balancerBuilder{}).Build(cc, balancer.BuildOptions{})
+
+	state := func(leader string) balancer.ClientConnState {
+		var addrs []resolver.Address
+		for _, addr := range []string{"localhost:9001", "localhost:9002"} {
+			addrs = append(addrs, resolver.Address{
+				Addr:       addr,
+				Attributes: attributes.New("is_leader", addr == leader),
+			})
+		}
+		return balancer.ClientConnState{ResolverState: resolver.State{Addresses: addrs}}
+	}
+	require.NoError(t, b.UpdateClientConnState(state("localhost:9001")))
+	for _, sc := range cc.subConns {
+		b.UpdateSubConnState(sc, balancer.SubConnState{ConnectivityState: connectivity.Ready})
+	}
+	info := balancer.PickInfo{FullMethodName: "/log.vX.Log/Produce"}
+	gotPick, err := cc.picker.Pick(info)
+	require.NoError(t, err)
+	require.Equal(t, "localhost:9001", gotPick.SubConn.(*subConn).addrs[0].Addr)
+
+	require.NoError(t, b.UpdateClientConnState(state("localhost:9002")))
+	gotPick, err = cc.picker.Pick(info)
+	require.NoError(t, err)
+	require.Equal(t, "localhost:9002", gotPick.SubConn.(*subConn).addrs[0].Addr)
+}
+
+type balancerClientConn struct {
+	balancer.ClientConn
+	subConns []*subConn
+	picker   balancer.Picker
+}
+
+func (c *balancerClientConn) NewSubConn(addrs []resolver.Address, opts balancer.NewSubConnOptions) (balancer.SubConn, error) {
+	sc := &subConn{addrs: addrs}
+	c.subConns = append(c.subConns, sc)
+	return sc, nil
+}
+
+func (c *balancerClientConn) UpdateAddresses(sc balancer.SubConn, addrs []resolver.Address) {}
+
+func (c *balancerClientConn) UpdateState(s balancer.State) {
+	c.picker = s.Picker
+}
+
+func (c *balancerClientConn) ResolveNow(resolver.ResolveNowOptions) {}
+
+func TestPickerPrefersFollowersInZone(t *testing.T) {
+	var subConns []*subConn
+	buildInfo := base.PickerBuildInfo{ReadySCs: make(map[balancer.SubConn]base.SubConnInfo)}
+	for i, zone := range []string{"a", "a", "b"} {
+		sc := &subConn{}
+		addr := resolver.Address{
+			Attributes: attributes.New("is_leader", i == 0, "zone", zone),
+		}
+		buildInfo.ReadySCs[sc] = base.SubConnInfo{Address: addr}
+		subConns = append(subConns, sc)
+	}
+	info := balancer.PickInfo{FullMethodName: "/log.vX.Log/Consume"}
+
+	picker := newPicker(buildInfo, "b", newLatencies(), nil)
+	for i := 0; i < 5; i++ {
+		gotPick, err := picker.Pick(info)
+		require.NoError(t, err)
+		require.Equal(t, subConns[2], gotPick.SubConn)
+	}
+
+	// no follower in zone c, so any follower is used
+	picker = newPicker(buildInfo, "c", newLatencies(), nil)
+	picked := make(map[balancer.SubConn]bool)
+	for i := 0; i < 4; i++ {
+		gotPick, err := picker.Pick(info)
+		require.NoError(t, err)
+		picked[gotPick.SubConn] = true
+	}
+	require.Equal(t, map[balancer.SubConn]bool{subConns[1]: true, subConns[2]: true}, picked)
+}
+
+func TestParseEndpoint(t *testing.T) {
+	addr, zone, err := parseEndpoint("127.0.0.1:8400?zone=eu-west-1a")
+	require.NoError(t, err)
+	require.Equal(t, "127.0.0.1:8400", addr)
+	require.Equal(t, "eu-west-1a", zone)
+
+	addr, zone, err = parseEndpoint("127.0.0.1:8400")
+	require.NoError(t, err)
+	require.Equal(t, "127.0.0.1:8400", addr)
+	require.Equal(t, "", zone)
+
+	cfg, err := (&balancerBuilder{}).ParseConfig([]byte(`{"zone":"a"}`))
+	require.NoError(t, err)
+	require.Equal(t, "a", cfg.(*balancerConfig).Zone)
+}
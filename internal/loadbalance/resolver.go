@@ -2,28 +2,44 @@ package loadbalance
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"net/url"
+	"strings"
 	"sync"
+	"time"
 
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/resolver"
 	"google.golang.org/grpc/serviceconfig"
+	"google.golang.org/grpc/status"
 
 	api "github.com/michael-diggin/proglog/api/v1"
 )
 
 const Name = "proglog"
 
+// watchBackoff is how long the resolver waits before re-subscribing to
+// server changes after the stream fails
+const watchBackoff = time.Second
+
 // Resolver implements the grpc resolver.Builder and
 // resolver.Resolver interfaces
 type Resolver struct {
+	// perRPCCreds, if set, authenticate the requests resolvers make for
+	// the cluster's servers
+	perRPCCreds credentials.PerRPCCredentials
+
 	mu            sync.Mutex
 	clientConn    resolver.ClientConn
 	resolverConn  *grpc.ClientConn
 	serviveConfig *serviceconfig.ParseResult
 	logger        *zap.Logger
+	cancel        context.CancelFunc
 }
 
 var _ resolver.Builder = (*Resolver)(nil)
@@ -34,25 +50,75 @@ func init() {
 	resolver.Register(&Resolver{})
 }
 
-func (r *Resolver) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (resolver.Resolver, error) {
+// WithPerRPCCredentials resolves the cluster's servers with requests
+// authenticated by creds. The client connection's own per-RPC credentials
+// aren't passed to resolvers, so clients that authenticate with them need
+// this to find the cluster's servers.
+func WithPerRPCCredentials(creds credentials.PerRPCCredentials) grpc.DialOption {
+	return grpc.WithResolvers(&Resolver{perRPCCreds: creds})
+}
+
+// Build returns a new Resolver for the target that watches the cluster's
+// servers and updates cc every time they change
+func (b *Resolver) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (resolver.Resolver, error) {
+	r := &Resolver{}
 	r.logger = zap.L().Named("resolver")
 	r.clientConn = cc
 	var dialOpts []grpc.DialOption
 	if opts.DialCreds != nil {
 		dialOpts = append(dialOpts, grpc.WithTransportCredentials(opts.DialCreds))
+	} else {
+		dialOpts = append(dialOpts, grpc.WithInsecure())
 	}
-	r.serviveConfig = r.clientConn.ParseServiceConfig(
-		fmt.Sprintf(`{"loadBalancingConfig":[{"%s":{}}]}`, Name),
-	)
-	var err error
-	r.resolverConn, err = grpc.Dial(target.Endpoint, dialOpts...)
+	if b.perRPCCreds != nil {
+		dialOpts = append(dialOpts, grpc.WithPerRPCCredentials(b.perRPCCreds))
+	}
+	endpoint, zone, err := parseEndpoint(target.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	lbConfig, err := json.Marshal(balancerConfig{Zone: zone})
+	if err != nil {
+		return nil, err
+	}
+	r.serviveConfig = r.clientConn.ParseServiceConfig(fmt.Sprintf(
+		`{"loadBalancingConfig":[{"%s":%s}],"healthCheckConfig":{"serviceName":""}}`,
+		Name, lbConfig,
+	))
+	r.resolverConn, err = grpc.Dial(endpoint, dialOpts...)
 	if err != nil {
 		return nil, err
 	}
 	r.ResolveNow(resolver.ResolveNowOptions{})
+	ctx, cancel := context.WithCancel(context.Background())
+	r.cancel = cancel
+	go r.watch(ctx)
 	return r, nil
 }
 
+// Target returns the dial target for the cluster that the server at addr
+// belongs to, preferring followers in the given zone for reads
+func Target(addr, zone string) string {
+	target := fmt.Sprintf("%s:///%s", Name, addr)
+	if zone != "" {
+		target += "?" + url.Values{"zone": {zone}}.Encode()
+	}
+	return target
+}
+
+// parseEndpoint splits the zone query parameter from the target's endpoint
+func parseEndpoint(endpoint string) (addr, zone string, err error) {
+	i := strings.Index(endpoint, "?")
+	if i == -1 {
+		return endpoint, "", nil
+	}
+	query, err := url.ParseQuery(endpoint[i+1:])
+	if err != nil {
+		return "", "", fmt.Errorf("invalid target query: %w", err)
+	}
+	return endpoint[:i], query.Get("zone"), nil
+}
+
 func (r *Resolver) Scheme() string {
 	return Name
 }
@@ -68,11 +134,49 @@ func (r *Resolver) ResolveNow(resolver.ResolveNowOptions) {
 		r.logger.Error("failed to resolve server", zap.Error(err))
 		return
 	}
+	r.updateState(res.Servers)
+}
+
+// watch subscribes to server changes, falling back to resolving only when
+// gRPC asks if the server doesn't support watching
+func (r *Resolver) watch(ctx context.Context) {
+	client := api.NewLogClient(r.resolverConn)
+	for {
+		stream, err := client.WatchServers(ctx, &api.WatchServersRequest{})
+		for err == nil {
+			var res *api.WatchServersResponse
+			if res, err = stream.Recv(); err == nil {
+				r.mu.Lock()
+				r.updateState(res.Servers)
+				r.mu.Unlock()
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if status.Code(err) == codes.Unimplemented {
+			r.logger.Debug("server doesn't support watching servers", zap.Error(err))
+			return
+		}
+		r.logger.Error("failed to watch servers", zap.Error(err))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(watchBackoff):
+		}
+	}
+}
+
+func (r *Resolver) updateState(servers []*api.Server) {
 	var addrs []resolver.Address
-	for _, server := range res.Servers {
+	for _, server := range servers {
+		attrs := attributes.New("is_leader", server.IsLeader)
+		if server.Zone != "" {
+			attrs = attrs.WithValues("zone", server.Zone)
+		}
 		addrs = append(addrs, resolver.Address{
 			Addr:       server.RpcAddr,
-			Attributes: attributes.New("is_leader", server.IsLeader),
+			Attributes: attrs,
 		})
 	}
 	r.clientConn.UpdateState(resolver.State{
@@ -82,6 +186,7 @@ func (r *Resolver) ResolveNow(resolver.ResolveNowOptions) {
 }
 
 func (r *Resolver) Close() {
+	r.cancel()
 	if err := r.resolverConn.Close(); err != nil {
 		r.logger.Error("failed to close conn", zap.Error(err))
 	}
@@ -2,7 +2,10 @@ package loadbalance
 
 import (
 	"net"
+	"reflect"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/michael-diggin/proglog/internal/config"
 	"github.com/michael-diggin/proglog/internal/server"
@@ -30,6 +33,7 @@ func TestResolver(t *testing.T) {
 
 	serverCreds := credentials.NewTLS(tlsConfig)
 	srv, err := server.NewGRPCSever(&server.Config{
+		Authorizer:  allowAll{},
 		GetServerer: &getServers{},
 	}, grpc.Creds(serverCreds))
 	require.NoError(t, err)
@@ -50,8 +54,9 @@ func TestResolver(t *testing.T) {
 		DialCreds: clientCreds,
 	}
 	r := Resolver{}
-	_, err = r.Build(resolver.Target{Endpoint: l.Addr().String()}, conn, opts)
+	res, err := r.Build(resolver.Target{Endpoint: l.Addr().String()}, conn, opts)
 	require.NoError(t, err)
+	defer res.Close()
 
 	wantState := resolver.State{
 		Addresses: []resolver.Address{{
@@ -62,7 +67,67 @@ func TestResolver(t *testing.T) {
 			Attributes: attributes.New("is_leader", false),
 		}},
 	}
-	require.Equal(t, wantState, conn.state)
+	require.Equal(t, wantState, conn.State())
+}
+
+func TestResolverWatchesServers(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	watcher := &watchServers{servers: make(chan []*api.Server, 1)}
+	watcher.servers <- []*api.Server{{
+		Id:       "leader",
+		RpcAddr:  "localhost:9001",
+		IsLeader: true,
+	}}
+	srv, err := server.NewGRPCSever(&server.Config{
+		Authorizer:    allowAll{},
+		GetServerer:   &getServers{},
+		ServerWatcher: watcher,
+	})
+	require.NoError(t, err)
+	go srv.Serve(l)
+	defer srv.Stop()
+
+	conn := &clientConn{}
+	r := Resolver{}
+	res, err := r.Build(resolver.Target{Endpoint: l.Addr().String()}, conn, resolver.BuildOptions{})
+	require.NoError(t, err)
+	defer res.Close()
+
+	require.Eventually(t, func() bool {
+		return len(conn.State().Addresses) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// the follower took over leadership
+	watcher.servers <- []*api.Server{{
+		Id:      "leader",
+		RpcAddr: "localhost:9001",
+	}, {
+		Id:       "follower",
+		RpcAddr:  "localhost:9002",
+		IsLeader: true,
+	}}
+	wantState := resolver.State{
+		Addresses: []resolver.Address{{
+			Addr:       "localhost:9001",
+			Attributes: attributes.New("is_leader", false),
+		}, {
+			Addr:       "localhost:9002",
+			Attributes: attributes.New("is_leader", true),
+		}},
+	}
+	require.Eventually(t, func() bool {
+		return reflect.DeepEqual(wantState, conn.State())
+	}, time.Second, 10*time.Millisecond)
+}
+
+type watchServers struct {
+	servers chan []*api.Server
+}
+
+func (w *watchServers) WatchServers(done <-chan struct{}) <-chan []*api.Server {
+	return w.servers
 }
 
 type getServers struct{}
@@ -80,14 +145,23 @@ func (s *getServers) GetServers() ([]*api.Server, error) {
 
 type clientConn struct {
 	resolver.ClientConn
+	mu    sync.Mutex
 	state resolver.State
 }
 
 func (c *clientConn) UpdateState(state resolver.State) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	c.state = state
 	return nil
 }
 
+func (c *clientConn) State() resolver.State {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state
+}
+
 func (c *clientConn) ReportError(err error) {}
 
 func (c *clientConn) NewAddress(addrs []resolver.Address) {}
@@ -97,3 +171,10 @@ func (c *clientConn) NewServiceConfig(config string) {}
 func (c *clientConn) ParseServiceConfig(config string) *serviceconfig.ParseResult {
 	return nil
 }
+
+// allowAll authorizes every request
+type allowAll struct{}
+
+func (allowAll) Authorize(subject, object, action string) error {
+	return nil
+}
@@ -0,0 +1,313 @@
+package log
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"time"
+
+	api "github.com/michael-diggin/proglog/api/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// Archives are portable files of a range of a log's records, to move them
+// between clusters or keep them as cold backups. They start with
+// archiveMagic and the format's version, followed by blocks of records and
+// then the archive's manifest, its length and archiveMagic again. Blocks
+// are framed like store records, with their length and codec, and hold
+// records marshaled and preceded by their length.
+var archiveMagic = []byte("PLAR")
+
+const (
+	archiveVersion = 1
+	// archiveBlockBytes is how many bytes of records are compressed together
+	archiveBlockBytes = 1 << 20
+	archiveHeader     = 8
+	archiveTrailer    = lenWidth + 4
+)
+
+// ArchiveManifest describes an archive's records
+type ArchiveManifest struct {
+	Version int `json:"version"`
+	// FromOffset is the offset of the archive's first record and
+	// NextOffset the offset after its last, as they were in the log
+	FromOffset uint64 `json:"from_offset"`
+	NextOffset uint64 `json:"next_offset"`
+	Codec      string `json:"codec"`
+	// SHA256 is the checksum of the archive's blocks
+	SHA256  string    `json:"sha256"`
+	Created time.Time `json:"created"`
+}
+
+// ArchiveWriter writes records to an archive
+type ArchiveWriter struct {
+	w        io.Writer
+	codec    Codec
+	hash     hash.Hash
+	block    []byte
+	manifest ArchiveManifest
+	started  bool
+}
+
+// NewArchiveWriter returns an ArchiveWriter of records to w, compressing
+// them with the codec
+func NewArchiveWriter(w io.Writer, codec Codec) (*ArchiveWriter, error) {
+	header := make([]byte, archiveHeader)
+	copy(header, archiveMagic)
+	enc.PutUint32(header[len(archiveMagic):], archiveVersion)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &ArchiveWriter{
+		w:     w,
+		codec: codec,
+		hash:  sha256.New(),
+		manifest: ArchiveManifest{
+			Version: archiveVersion,
+			Codec:   codec.String(),
+			Created: time.Now().UTC(),
+		},
+	}, nil
+}
+
+// Write adds the record to the archive. Records must follow on from each
+// other, so they keep their offsets when they're loaded.
+func (a *ArchiveWriter) Write(record *api.Record) error {
+	if !a.started {
+		a.manifest.FromOffset, a.manifest.NextOffset = record.Offset, record.Offset
+		a.started = true
+	}
+	if record.Offset != a.manifest.NextOffset {
+		return fmt.Errorf("record %d doesn't follow on from %d", record.Offset, a.manifest.NextOffset-1)
+	}
+	p, err := proto.Marshal(record)
+	if err != nil {
+		return err
+	}
+	size := make([]byte, lenWidth)
+	enc.PutUint64(size, uint64(len(p)))
+	a.block = append(append(a.block, size...), p...)
+	a.manifest.NextOffset++
+	if len(a.block) >= archiveBlockBytes {
+		return a.flush()
+	}
+	return nil
+}
+
+// flush writes the block of records
+func (a *ArchiveWriter) flush() error {
+	if len(a.block) == 0 {
+		return nil
+	}
+	p, codec := a.block, a.codec
+	if codec != CodecNone {
+		c, err := codec.compress(p)
+		if err != nil {
+			return err
+		}
+		// keep blocks that don't compress as they are
+		if len(c) < len(p) {
+			p = c
+		} else {
+			codec = CodecNone
+		}
+	}
+	frame := make([]byte, lenWidth, lenWidth+len(p))
+	enc.PutUint64(frame, uint64(len(p))|uint64(codec)<<codecShift)
+	frame = append(frame, p...)
+	a.hash.Write(frame)
+	if _, err := a.w.Write(frame); err != nil {
+		return err
+	}
+	a.block = a.block[:0]
+	return nil
+}
+
+// Close writes the last block and the manifest, returning the manifest
+func (a *ArchiveWriter) Close() (*ArchiveManifest, error) {
+	if err := a.flush(); err != nil {
+		return nil, err
+	}
+	a.manifest.SHA256 = hex.EncodeToString(a.hash.Sum(nil))
+	b, err := json.Marshal(a.manifest)
+	if err != nil {
+		return nil, err
+	}
+	trailer := make([]byte, lenWidth, archiveTrailer)
+	enc.PutUint64(trailer, uint64(len(b)))
+	trailer = append(trailer, archiveMagic...)
+	if _, err := a.w.Write(append(b, trailer...)); err != nil {
+		return nil, err
+	}
+	return &a.manifest, nil
+}
+
+// ArchiveReader reads the records of an archive
+type ArchiveReader struct {
+	manifest ArchiveManifest
+	blocks   *io.SectionReader
+	block    []byte
+	next     uint64
+}
+
+// OpenArchive returns an ArchiveReader of the archive of size bytes in r,
+// having checked its blocks against the manifest's checksum
+func OpenArchive(r io.ReaderAt, size int64) (*ArchiveReader, error) {
+	if size < archiveHeader+archiveTrailer {
+		return nil, errors.New("not an archive")
+	}
+	header := make([]byte, archiveHeader)
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return nil, err
+	}
+	trailer := make([]byte, archiveTrailer)
+	if _, err := r.ReadAt(trailer, size-archiveTrailer); err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(header, archiveMagic) || !bytes.Equal(trailer[lenWidth:], archiveMagic) {
+		return nil, errors.New("not an archive")
+	}
+	if v := enc.Uint32(header[len(archiveMagic):]); v != archiveVersion {
+		return nil, fmt.Errorf("unsupported archive version %d", v)
+	}
+	n := enc.Uint64(trailer)
+	end := size - archiveTrailer - int64(n)
+	if n > uint64(size) || end < archiveHeader {
+		return nil, errors.New("archive is truncated")
+	}
+	b := make([]byte, n)
+	if _, err := r.ReadAt(b, end); err != nil {
+		return nil, err
+	}
+	a := &ArchiveReader{blocks: io.NewSectionReader(r, archiveHeader, end-archiveHeader)}
+	if err := json.Unmarshal(b, &a.manifest); err != nil {
+		return nil, fmt.Errorf("invalid archive manifest: %w", err)
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, a.blocks); err != nil {
+		return nil, err
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != a.manifest.SHA256 {
+		return nil, fmt.Errorf("archive checksum is %s, the manifest has %s", sum, a.manifest.SHA256)
+	}
+	if _, err := a.blocks.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	a.next = a.manifest.FromOffset
+	return a, nil
+}
+
+// Manifest returns the archive's manifest
+func (a *ArchiveReader) Manifest() ArchiveManifest {
+	return a.manifest
+}
+
+// Next returns the next record in the archive, with the offset it had in
+// the log, or io.EOF once it's read them all
+func (a *ArchiveReader) Next() (*api.Record, error) {
+	if len(a.block) == 0 {
+		if err := a.readBlock(); err == io.EOF && a.next != a.manifest.NextOffset {
+			return nil, fmt.Errorf("archive ends at %d, the manifest has %d", a.next, a.manifest.NextOffset)
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if uint64(len(a.block)) < lenWidth || enc.Uint64(a.block) > uint64(len(a.block))-lenWidth {
+		return nil, fmt.Errorf("archive record %d is truncated", a.next)
+	}
+	size := enc.Uint64(a.block)
+	record := &api.Record{}
+	if err := proto.Unmarshal(a.block[lenWidth:lenWidth+size], record); err != nil {
+		return nil, fmt.Errorf("invalid archive record %d: %w", a.next, err)
+	}
+	if record.Offset != a.next {
+		return nil, fmt.Errorf("archive record %d has offset %d", a.next, record.Offset)
+	}
+	a.block = a.block[lenWidth+size:]
+	a.next++
+	return record, nil
+}
+
+// readBlock reads and decompresses the next block
+func (a *ArchiveReader) readBlock() error {
+	header := make([]byte, lenWidth)
+	if _, err := io.ReadFull(a.blocks, header); err != nil {
+		return err
+	}
+	// the length's checked against what's left of the archive before it's
+	// allocated, archives come from anywhere
+	pos, err := a.blocks.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	size := enc.Uint64(header) & sizeMask
+	if size > uint64(a.blocks.Size()-pos) {
+		return fmt.Errorf("archive block is %d bytes, past the end of the archive", size)
+	}
+	b := make([]byte, size)
+	if _, err := io.ReadFull(a.blocks, b); err != nil {
+		return fmt.Errorf("archive block is truncated: %w", err)
+	}
+	codec := Codec(enc.Uint64(header) >> codecShift)
+	if a.block, err = codec.decompress(b); err != nil {
+		return fmt.Errorf("failed to decompress archive block: %w", err)
+	}
+	return nil
+}
+
+// Export writes the log's records from off up to, but not including, to to
+// an archive in w, compressing it with the codec. The archive ends early
+// if the log does.
+func (l *Log) Export(w io.Writer, off, to uint64, codec Codec) (*ArchiveManifest, error) {
+	a, err := NewArchiveWriter(w, codec)
+	if err != nil {
+		return nil, err
+	}
+	it := l.NewIterator(off)
+	defer it.Close()
+	for it.Offset() < to {
+		record, err := it.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := a.Write(record); err != nil {
+			return nil, err
+		}
+	}
+	return a.Close()
+}
+
+// Load appends the archive's records to the log, which must be empty, at
+// the offsets they had in the log they were exported from
+func (l *Log) Load(a *ArchiveReader) error {
+	l.mu.RLock()
+	empty := l.segments[0].baseOffset == l.segments[len(l.segments)-1].next()
+	l.mu.RUnlock()
+	if !empty {
+		return errors.New("log isn't empty")
+	}
+	l.Config.Segment.InitialOffset = a.Manifest().FromOffset
+	if err := l.Reset(); err != nil {
+		return err
+	}
+	for {
+		record, err := a.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := l.Append(record); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package log
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	api "github.com/michael-diggin/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestArchive(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, log *Log){
+		"loads at the exported offsets": testArchiveLoad,
+		"only loads empty logs":         testArchiveLoadEmpty,
+		"rejects damaged archives":      testArchiveDamaged,
+		"writes blocks":                 testArchiveBlocks,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "archive-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			c := Config{}
+			c.Segment.MaxStoreBytes = 64
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+			defer log.Remove()
+			fn(t, log)
+		})
+	}
+}
+
+// export returns the archive of the log's records from off up to to
+func export(t *testing.T, log *Log, off, to uint64) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	_, err := log.Export(&buf, off, to, CodecGzip)
+	require.NoError(t, err)
+	return buf.Bytes()
+}
+
+func testArchiveLoad(t *testing.T, log *Log) {
+	appendRecords(t, log, 0, 10)
+	b := export(t, log, 3, 8)
+	a, err := OpenArchive(bytes.NewReader(b), int64(len(b)))
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), a.Manifest().FromOffset)
+	require.Equal(t, uint64(8), a.Manifest().NextOffset)
+	require.Equal(t, "gzip", a.Manifest().Codec)
+
+	dir, err := ioutil.TempDir("", "archive-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	loaded, err := NewLog(dir, log.Config)
+	require.NoError(t, err)
+	defer loaded.Close()
+	require.NoError(t, loaded.Load(a))
+	lowest, err := loaded.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), lowest)
+	it := loaded.NewIterator(3)
+	defer it.Close()
+	for off := uint64(3); off < 8; off++ {
+		requireNext(t, it, off)
+	}
+	off, err := loaded.Append(&api.Record{Value: []byte("record 8")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(8), off)
+
+	// archives end where the log does
+	b = export(t, log, 8, 100)
+	a, err = OpenArchive(bytes.NewReader(b), int64(len(b)))
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), a.Manifest().NextOffset)
+}
+
+func testArchiveLoadEmpty(t *testing.T, log *Log) {
+	appendRecords(t, log, 0, 2)
+	b := export(t, log, 0, 2)
+	a, err := OpenArchive(bytes.NewReader(b), int64(len(b)))
+	require.NoError(t, err)
+	require.Error(t, log.Load(a))
+}
+
+func testArchiveDamaged(t *testing.T, log *Log) {
+	appendRecords(t, log, 0, 5)
+	b := export(t, log, 0, 5)
+	for damage, archive := range map[string][]byte{
+		"truncated": b[:len(b)-1],
+		"corrupt":   append(append(append([]byte{}, b[:archiveHeader+lenWidth]...), ^b[archiveHeader+lenWidth]), b[archiveHeader+lenWidth+1:]...),
+		"empty":     nil,
+	} {
+		_, err := OpenArchive(bytes.NewReader(archive), int64(len(archive)))
+		require.Error(t, err, damage)
+	}
+
+	// a block's length is checked before it's read, even when the
+	// checksum's been made to match
+	oversized := append([]byte{}, b...)
+	enc.PutUint64(oversized[archiveHeader:], sizeMask)
+	blocks := oversized[archiveHeader : len(b)-archiveTrailer-int(enc.Uint64(b[len(b)-archiveTrailer:]))]
+	before := sha256.Sum256(b[archiveHeader : archiveHeader+len(blocks)])
+	after := sha256.Sum256(blocks)
+	oversized = bytes.Replace(oversized, []byte(hex.EncodeToString(before[:])), []byte(hex.EncodeToString(after[:])), 1)
+	a, err := OpenArchive(bytes.NewReader(oversized), int64(len(oversized)))
+	require.NoError(t, err)
+	_, err = a.Next()
+	require.Contains(t, err.Error(), "past the end of the archive")
+}
+
+func testArchiveBlocks(t *testing.T, log *Log) {
+	var buf bytes.Buffer
+	w, err := NewArchiveWriter(&buf, CodecZstd)
+	require.NoError(t, err)
+	// records are written in blocks of archiveBlockBytes
+	value := bytes.Repeat([]byte("x"), archiveBlockBytes/2)
+	for off := uint64(5); off < 10; off++ {
+		require.NoError(t, w.Write(&api.Record{Offset: off, Value: value}))
+	}
+	require.Error(t, w.Write(&api.Record{Offset: 20}))
+	_, err = w.Close()
+	require.NoError(t, err)
+
+	a, err := OpenArchive(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	require.NoError(t, err)
+	for off := uint64(5); off < 10; off++ {
+		record, err := a.Next()
+		require.NoError(t, err, fmt.Sprint(off))
+		require.Equal(t, off, record.Offset)
+		require.Equal(t, value, record.Value)
+	}
+	_, err = a.Next()
+	require.Equal(t, io.EOF, err)
+}
@@ -0,0 +1,338 @@
+package log
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb"
+)
+
+// stableKeys are the keys raft keeps in its stable store
+var stableKeys = []string{"CurrentTerm", "LastVoteTerm", "LastVoteCand"}
+
+// backupFile is a file captured for a backup. It's read up to size, so
+// what's appended to it after it's captured isn't backed up, and it's kept
+// open so it can still be read if it's removed.
+type backupFile struct {
+	// name is the file's path in the backup, relative to the data dir
+	name string
+	file *os.File
+	size int64
+	// data, if set, is backed up rather than a file
+	data []byte
+}
+
+// capture returns the files of the log's segments and its manifest, as
+// they are, named in the backup under dir. The caller must hold appendMu.
+func (l *Log) capture(dir string) (files []backupFile, err error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	defer func() {
+		if err != nil {
+			closeBackupFiles(files)
+		}
+	}()
+	add := func(name string, size int64) error {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		files = append(files, backupFile{
+			name: filepath.Join(dir, filepath.Base(name)), file: f, size: size,
+		})
+		return nil
+	}
+	for _, s := range l.segments {
+		if s.local() {
+			if err := s.store.flushTo(s.store.Size()); err != nil {
+				return nil, err
+			}
+			if err := add(s.store.Name(), int64(s.store.Size())); err != nil {
+				return nil, err
+			}
+			size := headerWidth + atomic.LoadUint64(&s.index.size)
+			if err := add(s.index.Name(), int64(size)); err != nil {
+				return nil, err
+			}
+			if s.keyFile != "" {
+				if err := add(s.keyFile, -1); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if s.remote != nil {
+			if err := add(segmentFile(l.Dir, s.baseOffset, ".remote"), -1); err != nil {
+				return nil, err
+			}
+		}
+	}
+	b, err := json.Marshal(l.manifest())
+	if err != nil {
+		return nil, err
+	}
+	files = append(files, backupFile{name: filepath.Join(dir, manifestFile), data: b})
+	return files, nil
+}
+
+func closeBackupFiles(files []backupFile) {
+	for _, f := range files {
+		if f.file != nil {
+			f.file.Close()
+		}
+	}
+}
+
+// Backup writes a tarball of the node's data dir to w: the log's segments,
+// raft's log, its stable store and its snapshots. Both logs are captured
+// while neither's appended to, so the backup's as of a point in time, and
+// then written out without holding up appends. Offloaded segments are
+// backed up as their .remote files, their objects stay in the object
+// store.
+func (l *DistributedLog) Backup(w io.Writer) error {
+	files, stable, err := l.capture()
+	if err != nil {
+		return err
+	}
+	defer closeBackupFiles(files)
+	b, err := newStableStore(stable)
+	if err != nil {
+		return err
+	}
+	files = append(files, backupFile{name: filepath.Join("raft", "stable"), data: b})
+
+	tw := tar.NewWriter(w)
+	now := time.Now()
+	dirs := make(map[string]bool)
+	for _, f := range files {
+		// the file's directories come before it, parents first
+		var parents []string
+		for dir := filepath.Dir(f.name); dir != "." && !dirs[dir]; dir = filepath.Dir(dir) {
+			dirs[dir] = true
+			parents = append([]string{dir}, parents...)
+		}
+		for _, dir := range parents {
+			if err := tw.WriteHeader(&tar.Header{
+				Typeflag: tar.TypeDir, Name: filepath.ToSlash(dir) + "/", Mode: 0755, ModTime: now,
+			}); err != nil {
+				return err
+			}
+		}
+		var r io.Reader
+		size := int64(len(f.data))
+		switch {
+		case f.data != nil:
+			r = bytes.NewReader(f.data)
+		case f.size < 0:
+			fi, err := f.file.Stat()
+			if err != nil {
+				return err
+			}
+			size = fi.Size()
+			r = io.NewSectionReader(f.file, 0, size)
+		default:
+			size = f.size
+			r = io.NewSectionReader(f.file, 0, size)
+		}
+		if err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg, Name: filepath.ToSlash(f.name), Size: size, Mode: 0644, ModTime: now,
+		}); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(tw, r, size); err != nil {
+			return fmt.Errorf("failed to back up %s: %w", f.name, err)
+		}
+	}
+	return tw.Close()
+}
+
+// capture returns the node's files and the values in its stable store as
+// of a point in time
+func (l *DistributedLog) capture() (files []backupFile, stable map[string][]byte, err error) {
+	l.log.appendMu.Lock()
+	defer l.log.appendMu.Unlock()
+	l.raftLog.appendMu.Lock()
+	defer l.raftLog.appendMu.Unlock()
+	defer func() {
+		if err != nil {
+			closeBackupFiles(files)
+		}
+	}()
+
+	if files, err = l.log.capture("log"); err != nil {
+		return nil, nil, err
+	}
+	raftFiles, err := l.raftLog.capture(filepath.Join("raft", "log"))
+	files = append(files, raftFiles...)
+	if err != nil {
+		return files, nil, err
+	}
+	stable = make(map[string][]byte)
+	for _, key := range stableKeys {
+		v, err := l.stable.Get([]byte(key))
+		if err == raftboltdb.ErrKeyNotFound {
+			continue
+		}
+		if err != nil {
+			return files, nil, err
+		}
+		stable[key] = v
+	}
+	// snapshots are written to a temporary directory and renamed once
+	// they're complete, so the complete ones are backed up
+	snapshotsDir := filepath.Join(l.dataDir, "raft", "snapshots")
+	snapshots, err := ioutil.ReadDir(snapshotsDir)
+	if err != nil && !os.IsNotExist(err) {
+		return files, nil, err
+	}
+	for _, snapshot := range snapshots {
+		if !snapshot.IsDir() || strings.HasSuffix(snapshot.Name(), ".tmp") {
+			continue
+		}
+		for _, name := range []string{"meta.json", "state.bin"} {
+			f, err := os.Open(filepath.Join(snapshotsDir, snapshot.Name(), name))
+			if err != nil {
+				return files, nil, err
+			}
+			files = append(files, backupFile{
+				name: filepath.Join("raft", "snapshots", snapshot.Name(), name), file: f, size: -1,
+			})
+		}
+	}
+	return files, stable, nil
+}
+
+// newStableStore returns the contents of a stable store with the values
+func newStableStore(values map[string][]byte) ([]byte, error) {
+	dir, err := ioutil.TempDir("", "stable")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "stable")
+	store, err := raftboltdb.NewBoltStore(name)
+	if err != nil {
+		return nil, err
+	}
+	for key, v := range values {
+		if err := store.Set([]byte(key), v); err != nil {
+			store.Close()
+			return nil, err
+		}
+	}
+	if err := store.Close(); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(name)
+}
+
+// Restore extracts the backup in r into dataDir, which must be empty, for
+// a node to be started from. The node takes the place of the one that was
+// backed up, with its name and address, unless it's recovered with
+// RecoverNode.
+func Restore(r io.Reader, dataDir string) error {
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return err
+	}
+	entries, err := ioutil.ReadDir(dataDir)
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		return fmt.Errorf("data dir %s isn't empty", dataDir)
+	}
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := filepath.FromSlash(header.Name)
+		if filepath.IsAbs(name) || strings.HasPrefix(filepath.Clean(name), "..") {
+			return fmt.Errorf("backup has a file outside the data dir: %s", header.Name)
+		}
+		name = filepath.Join(dataDir, name)
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(name, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := restoreFile(name, tr); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("backup has an unsupported file: %s", header.Name)
+		}
+	}
+}
+
+func restoreFile(name string, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// RecoverNode makes the node restored into dataDir a cluster of its own,
+// the server of the config's Raft.LocalID and Raft.BindAddr, so a cluster
+// can be rebuilt from it by starting it and joining other servers to it.
+// It snapshots the node's log as it is, with the policy in raft's log and
+// snapshots, and compacts raft's log.
+func RecoverNode(dataDir string, config Config) error {
+	l, err := NewLog(filepath.Join(dataDir, "log"), config)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	raftConfig := config
+	raftConfig.Segment.InitialOffset = 1
+	raftConfig.Tier.Store = nil
+	logStore, err := newLogStore(filepath.Join(dataDir, "raft", "log"), raftConfig)
+	if err != nil {
+		return err
+	}
+	defer logStore.Close()
+	stable, err := raftboltdb.NewBoltStore(filepath.Join(dataDir, "raft", "stable"))
+	if err != nil {
+		return err
+	}
+	defer stable.Close()
+	snapshots, err := raft.NewFileSnapshotStore(filepath.Join(dataDir, "raft"), 1, os.Stderr)
+	if err != nil {
+		return err
+	}
+	addr := raft.ServerAddress(config.Raft.BindAddr)
+	_, transport := raft.NewInmemTransport(addr)
+
+	c := raft.DefaultConfig()
+	c.LocalID = config.Raft.LocalID
+	fsm := &fsm{log: l, recovering: true}
+	return raft.RecoverCluster(c, fsm, logStore, stable, snapshots, transport, raft.Configuration{
+		Servers: []raft.Server{{ID: c.LocalID, Address: addr}},
+	})
+}
@@ -0,0 +1,146 @@
+package log
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codec is how a record is compressed in the store. Each record's codec is
+// kept in its frame, so changing the configured codec only affects new
+// records and segments can mix codecs.
+type Codec uint8
+
+const (
+	CodecNone Codec = iota
+	CodecGzip
+	CodecSnappy
+	CodecZstd
+)
+
+var codecNames = map[Codec]string{
+	CodecNone:   "none",
+	CodecGzip:   "gzip",
+	CodecSnappy: "snappy",
+	CodecZstd:   "zstd",
+}
+
+// ParseCodec returns the codec with the given name: none, gzip, snappy or
+// zstd. An empty name is none.
+func ParseCodec(name string) (Codec, error) {
+	if name == "" {
+		return CodecNone, nil
+	}
+	for codec, n := range codecNames {
+		if n == name {
+			return codec, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown codec: %q", name)
+}
+
+func (c Codec) String() string {
+	if name, ok := codecNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("Codec(%d)", uint8(c))
+}
+
+// maxDecodedBytes is the most a frame decompresses to. Records, and an
+// archive's blocks of records, bigger than it are kept uncompressed, so it
+// only stops frames made to decompress to far more, which archives from
+// elsewhere can have, from exhausting memory.
+const maxDecodedBytes = 64 << 20
+
+// gzipWriters pools gzip writers, which are expensive to allocate
+var gzipWriters = sync.Pool{
+	New: func() interface{} { return gzip.NewWriter(nil) },
+}
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+)
+
+// zstdCoders returns the shared zstd encoder and decoder, which are safe
+// for concurrent use with EncodeAll and DecodeAll
+func zstdCoders() (*zstd.Encoder, *zstd.Decoder) {
+	zstdOnce.Do(func() {
+		zstdEncoder, _ = zstd.NewWriter(nil)
+		zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxDecodedBytes))
+	})
+	return zstdEncoder, zstdDecoder
+}
+
+// compress returns p compressed, or p itself if it's too big to be
+// decompressed again
+func (c Codec) compress(p []byte) ([]byte, error) {
+	if len(p) > maxDecodedBytes {
+		return p, nil
+	}
+	switch c {
+	case CodecNone:
+		return p, nil
+	case CodecGzip:
+		var buf bytes.Buffer
+		w := gzipWriters.Get().(*gzip.Writer)
+		defer gzipWriters.Put(w)
+		w.Reset(&buf)
+		if _, err := w.Write(p); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case CodecSnappy:
+		return snappy.Encode(nil, p), nil
+	case CodecZstd:
+		encoder, _ := zstdCoders()
+		return encoder.EncodeAll(p, nil), nil
+	}
+	return nil, fmt.Errorf("unknown codec: %s", c)
+}
+
+// errDecodedSize is returned decompressing frames that decompress to more
+// than maxDecodedBytes
+var errDecodedSize = fmt.Errorf("decompresses to more than %d bytes", maxDecodedBytes)
+
+func (c Codec) decompress(p []byte) ([]byte, error) {
+	switch c {
+	case CodecNone:
+		return p, nil
+	case CodecGzip:
+		r, err := gzip.NewReader(bytes.NewReader(p))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		b, err := ioutil.ReadAll(io.LimitReader(r, maxDecodedBytes+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(b) > maxDecodedBytes {
+			return nil, errDecodedSize
+		}
+		return b, nil
+	case CodecSnappy:
+		if n, err := snappy.DecodedLen(p); err != nil {
+			return nil, err
+		} else if n > maxDecodedBytes {
+			return nil, errDecodedSize
+		}
+		return snappy.Decode(nil, p)
+	case CodecZstd:
+		_, decoder := zstdCoders()
+		return decoder.DecodeAll(p, nil)
+	}
+	return nil, fmt.Errorf("unknown codec: %s", c)
+}
@@ -0,0 +1,160 @@
+package log
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/golang/snappy"
+	api "github.com/michael-diggin/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+var codecs = []Codec{CodecNone, CodecGzip, CodecSnappy, CodecZstd}
+
+func TestCodecs(t *testing.T) {
+	for _, codec := range codecs {
+		parsed, err := ParseCodec(codec.String())
+		require.NoError(t, err)
+		require.Equal(t, codec, parsed)
+
+		p := jsonPayload(0)
+		c, err := codec.compress(p)
+		require.NoError(t, err)
+		got, err := codec.decompress(c)
+		require.NoError(t, err)
+		require.Equal(t, p, got, codec.String())
+	}
+	_, err := ParseCodec("lz4")
+	require.Error(t, err)
+}
+
+func TestCodecDecodedSize(t *testing.T) {
+	big := make([]byte, maxDecodedBytes+1)
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	_, err := w.Write(big)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	encoder, _ := zstdCoders()
+	// frames that decompress to more than the max, as ours can't
+	for codec, c := range map[Codec][]byte{
+		CodecGzip:   gz.Bytes(),
+		CodecSnappy: snappy.Encode(nil, big),
+		CodecZstd:   encoder.EncodeAll(big, nil),
+	} {
+		_, err := codec.decompress(c)
+		require.Error(t, err, codec.String())
+
+		// ours keep records that big uncompressed
+		c, err = codec.compress(big)
+		require.NoError(t, err)
+		require.Equal(t, len(big), len(c), codec.String())
+	}
+}
+
+func TestMixedCodecs(t *testing.T) {
+	keyring, err := NewKeyring("1", map[string][]byte{"1": make([]byte, 32)})
+	require.NoError(t, err)
+	// every codec writes to the same segment, encrypted or not
+	for _, k := range []*Keyring{nil, keyring} {
+		dir, err := ioutil.TempDir("", "codec-test")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+		c := Config{Keyring: k}
+		c.Segment.MaxStoreBytes = 1 << 20
+		log, err := NewLog(dir, c)
+		require.NoError(t, err)
+		for _, codec := range codecs {
+			require.NoError(t, log.Close())
+			c.Segment.Codec = codec
+			log, err = NewLog(dir, c)
+			require.NoError(t, err)
+			_, err = log.Append(&api.Record{Value: jsonPayload(0)})
+			require.NoError(t, err)
+			// too small to compress
+			_, err = log.Append(&api.Record{Value: []byte("{}")})
+			require.NoError(t, err)
+		}
+
+		for off := uint64(0); off < uint64(2*len(codecs)); off++ {
+			record, err := log.Read(off)
+			require.NoError(t, err)
+			if off%2 == 0 {
+				require.Equal(t, jsonPayload(0), record.Value)
+			} else {
+				require.Equal(t, []byte("{}"), record.Value)
+			}
+		}
+		b, err := ioutil.ReadAll(log.Reader())
+		require.NoError(t, err)
+		record := &api.Record{}
+		require.NoError(t, proto.Unmarshal(b[lenWidth:lenWidth+enc.Uint64(b)], record))
+		require.Equal(t, jsonPayload(0), record.Value)
+		require.NoError(t, log.Remove())
+	}
+}
+
+// BenchmarkCodecs compares appending and reading JSON records with each
+// codec, reporting the store bytes per record alongside the throughput
+func BenchmarkCodecs(b *testing.B) {
+	for _, codec := range codecs {
+		b.Run(codec.String()+"/append", func(b *testing.B) {
+			log, teardown := benchmarkLog(b, codec)
+			defer teardown()
+			b.ReportAllocs()
+			b.SetBytes(int64(len(jsonPayload(0))))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := log.Append(&api.Record{Value: jsonPayload(i)}); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(log.Stats().Bytes)/float64(b.N), "disk-B/record")
+		})
+		b.Run(codec.String()+"/read", func(b *testing.B) {
+			log, teardown := benchmarkLog(b, codec)
+			defer teardown()
+			const records = 1000
+			for i := 0; i < records; i++ {
+				if _, err := log.Append(&api.Record{Value: jsonPayload(i)}); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportAllocs()
+			b.SetBytes(int64(len(jsonPayload(0))))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := log.Read(uint64(i % records)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func benchmarkLog(b *testing.B, codec Codec) (*Log, func()) {
+	dir, err := ioutil.TempDir("", "codec-bench")
+	require.NoError(b, err)
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64 << 20
+	c.Segment.MaxIndexBytes = 64 << 20
+	c.Segment.Codec = codec
+	log, err := NewLog(dir, c)
+	require.NoError(b, err)
+	return log, func() { log.Remove() }
+}
+
+// jsonPayload returns a JSON event like the ones producers send
+func jsonPayload(i int) []byte {
+	return []byte(fmt.Sprintf(`{"id":%d,"type":"order.created","source":"checkout",`+
+		`"customer":{"id":"c-%05d","country":"GB","tier":"gold"},`+
+		`"items":[{"sku":"sku-1234","quantity":1,"price":1299},`+
+		`{"sku":"sku-5678","quantity":2,"price":499}],`+
+		`"total":2297,"currency":"GBP","created_at":"2021-09-01T12:00:00Z"}`, i%100000, i%100000))
+}
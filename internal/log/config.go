@@ -1,6 +1,10 @@
 package log
 
-import "github.com/hashicorp/raft"
+import (
+	"time"
+
+	"github.com/hashicorp/raft"
+)
 
 type Config struct {
 	Raft struct {
@@ -13,5 +17,43 @@ type Config struct {
 		MaxStoreBytes uint64
 		MaxIndexBytes uint64
 		InitialOffset uint64
+		// IndexIntervalBytes is how many bytes of store there are between
+		// index entries. Records between entries are found by scanning the
+		// store from the entry before them. 0 indexes every record.
+		IndexIntervalBytes uint64
+		// MaxAge is how long after its first record the active segment is
+		// rolled, so quiet logs close segments too. 0 only rolls by size.
+		MaxAge time.Duration
+		// Codec compresses new records
+		Codec Codec
+	}
+	// Tier offloads closed segments to an object store, keeping months of
+	// history without the local disk to hold it
+	Tier struct {
+		// Store, if set, is where closed segments are uploaded to
+		Store ObjectStore
+		// Prefix is prepended to the segments' object keys, so logs can
+		// share a store
+		Prefix string
+		// Retention is how long uploaded segments are kept on local disk
+		// after they were last written
+		Retention time.Duration
+		// Interval is how often closed segments are offloaded, defaults to
+		// a minute
+		Interval time.Duration
+		// CacheSegments is how many remote segments are kept on local disk
+		// to be read, defaults to 8
+		CacheSegments int
 	}
+	// MaxRecordBytes is the largest record value the distributed log
+	// accepts, 0 is unlimited. It's checked by the leader before records
+	// are committed, followers apply the records it commits whatever their
+	// max is.
+	MaxRecordBytes uint64
+	// Keyring, if set, encrypts the records of new segments. Segments
+	// created without it stay unencrypted.
+	Keyring *Keyring
+	// OnPolicy is called with every ACL policy set with SetPolicy, as it's
+	// applied from the raft log or restored from a snapshot
+	OnPolicy func(policy []byte) error
 }
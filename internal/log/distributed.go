@@ -2,40 +2,75 @@ package log
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
-	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math"
 	"net"
 	"os"
 	"path/filepath"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/hashicorp/raft"
 	raftboltdb "github.com/hashicorp/raft-boltdb"
 	api "github.com/michael-diggin/proglog/api/v1"
+	"github.com/michael-diggin/proglog/internal/tracing"
 	"google.golang.org/protobuf/proto"
 )
 
 type DistributedLog struct {
-	config Config
-	log    *Log
-	raft   *raft.Raft
+	config  Config
+	dataDir string
+	log     *Log
+	raftLog *logStore
+	stable  *raftboltdb.BoltStore
+	raft    *raft.Raft
+	// transport records the followers' progress while the server leads
+	transport *replicationTransport
+
+	observer *raft.Observer
+	changes  chan struct{}
+	closed   chan struct{}
+
+	watchMu  sync.Mutex
+	watchers map[chan []*api.Server]struct{}
+	servers  []*api.Server
+
+	zonesMu sync.RWMutex
+	zones   map[string]string
 }
 
 var _ raft.FSM = (*fsm)(nil)
 
 type RequestType uint8
 
-const AppendRequestType RequestType = 0
+const (
+	AppendRequestType RequestType = 0
+	PolicyRequestType RequestType = 1
+)
 
 type fsm struct {
 	log *Log
+	// policy is the last ACL policy applied, kept to be snapshotted
+	policy   []byte
+	onPolicy func([]byte) error
+	// recovering fsms only apply and restore policies, as RecoverNode
+	// replays the raft log onto a log that has its records already
+	recovering bool
 }
 
 func NewDistributedLog(dataDir string, config Config) (*DistributedLog, error) {
 	l := &DistributedLog{
-		config: config,
+		config:   config,
+		dataDir:  dataDir,
+		changes:  make(chan struct{}, 1),
+		closed:   make(chan struct{}),
+		watchers: make(map[chan []*api.Server]struct{}),
+		zones:    make(map[string]string),
 	}
 	if err := l.setupLog(dataDir); err != nil {
 		return nil, err
@@ -56,17 +91,25 @@ func (l *DistributedLog) setupLog(dataDir string) (err error) {
 }
 
 func (l *DistributedLog) setupRaft(dataDir string) error {
-	fsm := &fsm{log: l.log}
+	fsm := &fsm{
+		log:      l.log,
+		onPolicy: l.config.OnPolicy,
+	}
 	logDir := filepath.Join(dataDir, "raft", "log")
 	if err := os.MkdirAll(logDir, 0755); err != nil {
 		return err
 	}
 	logConfig := l.config
 	logConfig.Segment.InitialOffset = 1
+	// only the commit log is tiered, raft's log is compacted by snapshots
+	logConfig.Tier.Store = nil
 	logStore, err := newLogStore(logDir, logConfig)
 	if err != nil {
 		return fmt.Errorf("failed to set up raft log store: %w", err)
 	}
+	// followers learn about configuration changes through the raft log
+	logStore.onConfiguration = l.serversChanged
+	l.raftLog = logStore
 
 	stableStore, err := raftboltdb.NewBoltStore(
 		filepath.Join(dataDir, "raft", "stable"),
@@ -74,6 +117,7 @@ func (l *DistributedLog) setupRaft(dataDir string) error {
 	if err != nil {
 		return fmt.Errorf("failed to set up raft stable store: %w", err)
 	}
+	l.stable = stableStore
 	retain := 1
 	snapshotStore, err := raft.NewFileSnapshotStore(
 		filepath.Join(dataDir, "raft"),
@@ -86,12 +130,12 @@ func (l *DistributedLog) setupRaft(dataDir string) error {
 
 	maxPool := 5
 	timeout := 10 * time.Second
-	transport := raft.NewNetworkTransport(
+	l.transport = newReplicationTransport(raft.NewNetworkTransport(
 		l.config.Raft.StreamLayer,
 		maxPool,
 		timeout,
 		os.Stderr,
-	)
+	))
 
 	config := raft.DefaultConfig()
 	config.LocalID = l.config.Raft.LocalID
@@ -114,11 +158,22 @@ func (l *DistributedLog) setupRaft(dataDir string) error {
 		logStore,
 		stableStore,
 		snapshotStore,
-		transport,
+		l.transport,
 	)
 	if err != nil {
 		return fmt.Errorf("failed to start new raft: %w", err)
 	}
+	observations := make(chan raft.Observation, 16)
+	l.observer = raft.NewObserver(observations, false, func(o *raft.Observation) bool {
+		switch o.Data.(type) {
+		case raft.LeaderObservation, raft.PeerObservation:
+			return true
+		}
+		return false
+	})
+	l.raft.RegisterObserver(l.observer)
+	go l.watchServers(observations)
+
 	hasState, err := raft.HasExistingState(logStore, stableStore, snapshotStore)
 	if err != nil {
 		return fmt.Errorf("failed to check exisiting state: %w", err)
@@ -138,7 +193,15 @@ func (l *DistributedLog) setupRaft(dataDir string) error {
 	return err
 }
 
-func (l *DistributedLog) Append(record *api.Record) (uint64, error) {
+func (l *DistributedLog) Append(record *api.Record) (_ uint64, err error) {
+	_, span := startSpan(tracing.Extract(context.Background(), record), "raft.Apply")
+	defer func() { endSpan(span, err) }()
+
+	// records are checked here, before they're committed, rather than as
+	// they're applied, so servers with different maxes can't diverge
+	if err := api.CheckRecordSize(record, l.config.MaxRecordBytes); err != nil {
+		return 0, err
+	}
 	res, err := l.apply(
 		AppendRequestType,
 		&api.ProduceRequest{Record: record},
@@ -149,6 +212,16 @@ func (l *DistributedLog) Append(record *api.Record) (uint64, error) {
 	return res.(*api.ProduceResponse).Offset, nil
 }
 
+// SetPolicy replicates the ACL policy to every server through the raft log,
+// where it's handed to Config.OnPolicy
+func (l *DistributedLog) SetPolicy(policy []byte) error {
+	_, err := l.apply(
+		PolicyRequestType,
+		&api.SetPolicyRequest{Policy: string(policy)},
+	)
+	return err
+}
+
 func (l *DistributedLog) apply(reqType RequestType, req proto.Message) (interface{}, error) {
 	var buf bytes.Buffer
 	_, err := buf.Write([]byte{byte(reqType)})
@@ -165,8 +238,15 @@ func (l *DistributedLog) apply(reqType RequestType, req proto.Message) (interfac
 	}
 	timeout := 10 * time.Second
 	future := l.raft.Apply(buf.Bytes(), timeout)
-	if future.Error() != nil {
-		return nil, future.Error()
+	// raft's leadership errors are turned into gRPC errors clients retry
+	switch err := future.Error(); err {
+	case nil:
+	case raft.ErrNotLeader:
+		return nil, api.ErrNotLeader{Leader: string(l.raft.Leader())}
+	case raft.ErrLeadershipLost:
+		return nil, api.ErrLeadershipLost{Leader: string(l.raft.Leader())}
+	default:
+		return nil, err
 	}
 	res := future.Response()
 	if err, ok := res.(error); ok {
@@ -179,7 +259,25 @@ func (l *DistributedLog) Read(offset uint64) (*api.Record, error) {
 	return l.log.Read(offset)
 }
 
+// Fetch returns the chunk of records from offset, up to maxBytes of them as
+// they're stored
+func (l *DistributedLog) Fetch(offset, maxBytes uint64) (*Chunk, error) {
+	return l.log.Fetch(offset, maxBytes)
+}
+
+// NewIterator returns an iterator of the records from offset
+func (l *DistributedLog) NewIterator(offset uint64) *Iterator {
+	return l.log.NewIterator(offset)
+}
+
+// ReadContext reads the record at offset as part of the trace in ctx
+func (l *DistributedLog) ReadContext(ctx context.Context, offset uint64) (*api.Record, error) {
+	return l.log.ReadContext(ctx, offset)
+}
+
 func (l *DistributedLog) Join(id, addr string) error {
+	// membership calls Join on serf events, let watchers know
+	defer l.serversChanged()
 	configFuture := l.raft.GetConfiguration()
 	if err := configFuture.Error(); err != nil {
 		return err
@@ -207,6 +305,7 @@ func (l *DistributedLog) Join(id, addr string) error {
 }
 
 func (l *DistributedLog) Leave(id string) error {
+	defer l.serversChanged()
 	removeFuture := l.raft.RemoveServer(raft.ServerID(id), 0, 0)
 	return removeFuture.Error()
 }
@@ -228,10 +327,18 @@ func (l *DistributedLog) WaitForLeader(timeout time.Duration) error {
 }
 
 func (l *DistributedLog) Close() error {
+	l.raft.DeregisterObserver(l.observer)
+	close(l.closed)
 	f := l.raft.Shutdown()
 	if err := f.Error(); err != nil {
 		return err
 	}
+	if err := l.raftLog.Close(); err != nil {
+		return err
+	}
+	if err := l.stable.Close(); err != nil {
+		return err
+	}
 	return l.log.Close()
 }
 
@@ -240,23 +347,181 @@ func (l *DistributedLog) GetServers() ([]*api.Server, error) {
 	if err := future.Error(); err != nil {
 		return nil, err
 	}
+	l.zonesMu.RLock()
+	defer l.zonesMu.RUnlock()
 	var servers []*api.Server
 	for _, server := range future.Configuration().Servers {
 		servers = append(servers, &api.Server{
 			Id:       string(server.ID),
 			RpcAddr:  string(server.Address),
 			IsLeader: l.raft.Leader() == server.Address,
+			Zone:     l.zones[string(server.ID)],
 		})
 	}
 	return servers, nil
 }
 
+// LogStats returns the Stats of the commit log and of the Raft log
+func (l *DistributedLog) LogStats() map[string]Stats {
+	return map[string]Stats{
+		"commit": l.log.Stats(),
+		"raft":   l.raftLog.Stats(),
+	}
+}
+
+// RaftStats describes the local Raft server
+type RaftStats struct {
+	State        raft.RaftState
+	Term         uint64
+	LastIndex    uint64
+	CommitIndex  uint64
+	AppliedIndex uint64
+	// LastContact is when a follower last heard from the leader
+	LastContact time.Time
+	// Followers holds the progress of each of the other servers by ID,
+	// only while the server's the leader. Servers the leader hasn't heard
+	// from yet are left out.
+	Followers map[string]FollowerStats
+}
+
+// RaftStats returns the local Raft server's state, term and indexes
+func (l *DistributedLog) RaftStats() RaftStats {
+	stats := l.raft.Stats()
+	parse := func(key string) uint64 {
+		v, _ := strconv.ParseUint(stats[key], 10, 64)
+		return v
+	}
+	return RaftStats{
+		State:        l.raft.State(),
+		Term:         parse("term"),
+		LastIndex:    parse("last_log_index"),
+		CommitIndex:  parse("commit_index"),
+		AppliedIndex: parse("applied_index"),
+		LastContact:  l.raft.LastContact(),
+		Followers:    l.followers(),
+	}
+}
+
+// followers returns the stats of the servers in the cluster the leader's
+// heard from, or nil if the server isn't the leader
+func (l *DistributedLog) followers() map[string]FollowerStats {
+	if l.raft.State() != raft.Leader {
+		return nil
+	}
+	future := l.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return nil
+	}
+	followers := make(map[string]FollowerStats)
+	for _, server := range future.Configuration().Servers {
+		if server.ID == l.config.Raft.LocalID {
+			continue
+		}
+		if stats, ok := l.transport.follower(server.ID); ok {
+			followers[string(server.ID)] = stats
+		}
+	}
+	return followers
+}
+
+// SetZone records the zone the server with the given id runs in
+func (l *DistributedLog) SetZone(id, zone string) {
+	l.zonesMu.Lock()
+	changed := l.zones[id] != zone
+	l.zones[id] = zone
+	l.zonesMu.Unlock()
+	if changed {
+		l.serversChanged()
+	}
+}
+
+// WatchServers returns a channel that receives the cluster's servers now and
+// every time they change, until done is closed. Slow receivers only see the
+// latest set of servers.
+func (l *DistributedLog) WatchServers(done <-chan struct{}) <-chan []*api.Server {
+	ch := make(chan []*api.Server, 1)
+	l.watchMu.Lock()
+	l.watchers[ch] = struct{}{}
+	if l.servers != nil {
+		ch <- l.servers
+	} else {
+		l.serversChanged()
+	}
+	l.watchMu.Unlock()
+	go func() {
+		select {
+		case <-done:
+		case <-l.closed:
+		}
+		l.watchMu.Lock()
+		delete(l.watchers, ch)
+		l.watchMu.Unlock()
+	}()
+	return ch
+}
+
+// serversChanged signals that the servers may have changed without blocking
+// the caller, which may be raft itself
+func (l *DistributedLog) serversChanged() {
+	select {
+	case l.changes <- struct{}{}:
+	default:
+	}
+}
+
+// watchServers publishes the servers to the watchers on leader and peer
+// changes observed by raft and on membership changes
+func (l *DistributedLog) watchServers(observations <-chan raft.Observation) {
+	for {
+		select {
+		case <-l.closed:
+			return
+		case <-observations:
+		case <-l.changes:
+		}
+		servers, err := l.GetServers()
+		if err != nil {
+			continue
+		}
+		l.watchMu.Lock()
+		if !serversEqual(l.servers, servers) {
+			l.servers = servers
+			for ch := range l.watchers {
+				// replace any value the watcher hasn't received yet
+				select {
+				case <-ch:
+				default:
+				}
+				ch <- servers
+			}
+		}
+		l.watchMu.Unlock()
+	}
+}
+
+func serversEqual(a, b []*api.Server) bool {
+	if a == nil || len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !proto.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
 func (f *fsm) Apply(record *raft.Log) interface{} {
 	buf := record.Data
 	reqType := RequestType(buf[0])
 	switch reqType {
 	case AppendRequestType:
+		if f.recovering {
+			return nil
+		}
 		return f.applyAppend(buf[1:])
+	case PolicyRequestType:
+		return f.applyPolicy(buf[1:])
 	}
 	return nil
 }
@@ -267,13 +532,41 @@ func (f *fsm) applyAppend(buf []byte) interface{} {
 	if err != nil {
 		return err
 	}
-	offset, err := f.log.Append(req.Record)
+	ctx, span := startSpan(tracing.Extract(context.Background(), req.Record), "fsm.applyAppend")
+	offset, err := f.log.append(ctx, req.Record)
+	endSpan(span, err)
 	if err != nil {
 		return err
 	}
 	return &api.ProduceResponse{Offset: offset}
 }
 
+func (f *fsm) applyPolicy(buf []byte) interface{} {
+	var req api.SetPolicyRequest
+	if err := proto.Unmarshal(buf, &req); err != nil {
+		return err
+	}
+	if err := f.setPolicy([]byte(req.Policy)); err != nil {
+		return err
+	}
+	return &api.SetPolicyResponse{}
+}
+
+func (f *fsm) setPolicy(policy []byte) error {
+	if f.onPolicy != nil {
+		if err := f.onPolicy(policy); err != nil {
+			return err
+		}
+	}
+	f.policy = policy
+	return nil
+}
+
+// snapshotPolicy starts snapshots that carry an ACL policy, followed by the
+// policy's length and the policy. It can't be mistaken for the length of
+// the first record.
+const snapshotPolicy = math.MaxUint64
+
 func (f *fsm) Restore(r io.ReadCloser) error {
 	b := make([]byte, lenWidth)
 	var buf bytes.Buffer
@@ -284,12 +577,25 @@ func (f *fsm) Restore(r io.ReadCloser) error {
 		} else if err != nil {
 			return err
 		}
+		if i == 0 && enc.Uint64(b) == snapshotPolicy {
+			if err := f.restorePolicy(r); err != nil {
+				return err
+			}
+			i--
+			continue
+		}
 		size := int64(enc.Uint64(b))
+		if f.recovering {
+			if _, err := io.CopyN(ioutil.Discard, r, size); err != nil {
+				return err
+			}
+			continue
+		}
 		if _, err := io.CopyN(&buf, r, size); err != nil {
 			return err
 		}
 		record := &api.Record{}
-		if err := json.Unmarshal(buf.Bytes(), record); err != nil {
+		if err := proto.Unmarshal(buf.Bytes(), record); err != nil {
 			return err
 		}
 		if i == 0 {
@@ -298,14 +604,30 @@ func (f *fsm) Restore(r io.ReadCloser) error {
 				return err
 			}
 		}
-		if _, err := f.log.Append(record); err != nil {
-			return err
+		// the records of the offloaded segments Reset kept are in the log
+		// already
+		if record.Offset >= f.log.nextOffset() {
+			if _, err := f.log.Append(record); err != nil {
+				return err
+			}
 		}
 		buf.Reset()
 	}
 	return nil
 }
 
+func (f *fsm) restorePolicy(r io.Reader) error {
+	b := make([]byte, lenWidth)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return err
+	}
+	policy := make([]byte, enc.Uint64(b))
+	if _, err := io.ReadFull(r, policy); err != nil {
+		return err
+	}
+	return f.setPolicy(policy)
+}
+
 type snapshot struct {
 	reader io.Reader
 }
@@ -313,7 +635,15 @@ type snapshot struct {
 var _ raft.FSMSnapshot = (*snapshot)(nil)
 
 func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
-	return &snapshot{reader: f.log.Reader()}, nil
+	reader := f.log.Reader()
+	if f.policy != nil {
+		header := make([]byte, 2*lenWidth, 2*lenWidth+len(f.policy))
+		enc.PutUint64(header, snapshotPolicy)
+		enc.PutUint64(header[lenWidth:], uint64(len(f.policy)))
+		header = append(header, f.policy...)
+		reader = io.MultiReader(bytes.NewReader(header), reader)
+	}
+	return &snapshot{reader: reader}, nil
 }
 
 func (s *snapshot) Release() {}
@@ -330,6 +660,7 @@ var _ raft.LogStore = (*logStore)(nil)
 
 type logStore struct {
 	*Log
+	onConfiguration func()
 }
 
 func newLogStore(dir string, c Config) (*logStore, error) {
@@ -337,15 +668,35 @@ func newLogStore(dir string, c Config) (*logStore, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &logStore{log}, nil
+	return &logStore{Log: log}, nil
 }
 
+// FirstIndex and LastIndex are 0 when the log's empty, as it is before
+// anything's stored or once it's compacted up to a recovered snapshot
 func (l *logStore) FirstIndex() (uint64, error) {
-	return l.LowestOffset()
+	lowest, highest, err := l.indexes()
+	if err != nil || lowest > highest {
+		return 0, err
+	}
+	return lowest, nil
 }
 
 func (l *logStore) LastIndex() (uint64, error) {
-	return l.HighestOffset()
+	lowest, highest, err := l.indexes()
+	if err != nil || lowest > highest {
+		return 0, err
+	}
+	return highest, nil
+}
+
+func (l *logStore) indexes() (lowest, highest uint64, err error) {
+	if lowest, err = l.LowestOffset(); err != nil {
+		return 0, 0, err
+	}
+	if highest, err = l.HighestOffset(); err != nil {
+		return 0, 0, err
+	}
+	return lowest, highest, nil
 }
 
 func (l *logStore) GetLog(index uint64, out *raft.Log) error {
@@ -373,6 +724,9 @@ func (l *logStore) StoreLogs(records []*raft.Log) error {
 		}); err != nil {
 			return err
 		}
+		if record.Type == raft.LogConfiguration && l.onConfiguration != nil {
+			l.onConfiguration()
+		}
 	}
 	return nil
 }
@@ -1,6 +1,7 @@
 package log
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"net"
@@ -17,6 +18,7 @@ import (
 func TestMultipleNodes(t *testing.T) {
 	var logs []*DistributedLog
 	nodeCount := 3
+	policies := make([]chan []byte, nodeCount)
 	ports := []int{getFreePort(), getFreePort(), getFreePort()}
 
 	for i := 0; i < nodeCount; i++ {
@@ -36,9 +38,19 @@ func TestMultipleNodes(t *testing.T) {
 		config.Raft.ElectionTimeout = 50 * time.Millisecond
 		config.Raft.LeaderLeaseTimeout = 50 * time.Millisecond
 		config.Raft.CommitTimeout = 5 * time.Millisecond
+		policy := make(chan []byte, 1)
+		policies[i] = policy
+		config.OnPolicy = func(p []byte) error {
+			policy <- p
+			return nil
+		}
 
 		if i == 0 {
 			config.Raft.Bootstrap = true
+		} else {
+			// the max record size is checked by the leader, followers
+			// apply what it's committed whatever theirs is
+			config.MaxRecordBytes = 8
 		}
 		l, err := NewDistributedLog(dataDir, config)
 		require.NoError(t, err)
@@ -55,6 +67,7 @@ func TestMultipleNodes(t *testing.T) {
 	records := []*api.Record{
 		{Value: []byte("first")},
 		{Value: []byte("second")},
+		{Value: []byte("bigger than the followers' max")},
 	}
 	for _, record := range records {
 		off, err := logs[0].Append(record)
@@ -74,6 +87,31 @@ func TestMultipleNodes(t *testing.T) {
 		}, 500*time.Millisecond, 50*time.Millisecond)
 	}
 
+	require.NoError(t, logs[0].SetPolicy([]byte("p, root, *, produce")))
+	for _, policy := range policies {
+		select {
+		case p := <-policy:
+			require.Equal(t, "p, root, *, produce", string(p))
+		case <-time.After(time.Second):
+			t.Fatal("server didn't apply policy")
+		}
+	}
+
+	// the leader learns how far behind each follower is from its heartbeats
+	require.Eventually(t, func() bool {
+		stats := logs[0].RaftStats()
+		if len(stats.Followers) != nodeCount-1 {
+			return false
+		}
+		for _, follower := range stats.Followers {
+			if follower.LastIndex < stats.CommitIndex {
+				return false
+			}
+		}
+		return true
+	}, time.Second, 50*time.Millisecond)
+	require.Nil(t, logs[1].RaftStats().Followers)
+
 	servers, err := logs[0].GetServers()
 	require.NoError(t, err)
 	require.Len(t, servers, 3)
@@ -81,10 +119,22 @@ func TestMultipleNodes(t *testing.T) {
 	require.False(t, servers[1].IsLeader)
 	require.False(t, servers[2].IsLeader)
 
+	done := make(chan struct{})
+	defer close(done)
+	watch := logs[2].WatchServers(done)
+	require.Len(t, <-watch, 3)
+
 	err = logs[0].Leave("1")
 	require.NoError(t, err)
 	time.Sleep(50 * time.Millisecond)
 
+	select {
+	case servers := <-watch:
+		require.Len(t, servers, 2)
+	case <-time.After(time.Second):
+		t.Fatal("follower didn't see server leave")
+	}
+
 	servers, err = logs[0].GetServers()
 	require.NoError(t, err)
 	require.Len(t, servers, 2)
@@ -104,6 +154,38 @@ func TestMultipleNodes(t *testing.T) {
 	require.Equal(t, off, record.Offset)
 }
 
+func TestSnapshotRestoresPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	l, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+
+	f := &fsm{log: l}
+	require.NoError(t, f.setPolicy([]byte("p, root, *, admin")))
+	snap, err := f.Snapshot()
+	require.NoError(t, err)
+	sink := &snapshotSink{}
+	require.NoError(t, snap.Persist(sink))
+
+	var restored []byte
+	f = &fsm{log: l, onPolicy: func(p []byte) error {
+		restored = p
+		return nil
+	}}
+	require.NoError(t, f.Restore(ioutil.NopCloser(&sink.Buffer)))
+	require.Equal(t, "p, root, *, admin", string(restored))
+	require.Equal(t, restored, f.policy)
+}
+
+type snapshotSink struct {
+	bytes.Buffer
+}
+
+func (s *snapshotSink) ID() string    { return "test" }
+func (s *snapshotSink) Cancel() error { return nil }
+func (s *snapshotSink) Close() error  { return nil }
+
 func getFreePort() int {
 	addr, err := net.ResolveTCPAddr("tcp", "localhost:0")
 	if err != nil {
@@ -0,0 +1,182 @@
+package log
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os"
+	"sort"
+
+	api "github.com/michael-diggin/proglog/api/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// Chunk is a run of consecutive records as they're stored, for catching up
+// in bulk without decoding each record. Each record is a frame of an 8 byte
+// big-endian header, holding the record's codec in its top byte and its
+// length in the rest, followed by the record compressed with the codec.
+// Chunks of encrypted segments are decrypted, and so aren't zero-copy.
+type Chunk struct {
+	// BaseOffset is the offset of the chunk's first record
+	BaseOffset uint64
+	// NextOffset is the offset after the chunk's last record
+	NextOffset uint64
+	// Size is the chunk's length in bytes, or -1 if it's being decrypted
+	Size int64
+
+	r       io.Reader
+	closers []func() error
+}
+
+// Read reads the chunk's frames
+func (c *Chunk) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// WriteTo copies the chunk to w. Writers that read from files with
+// sendfile, such as TCP connections and HTTP responses over them, copy
+// unencrypted chunks without them passing through user space.
+func (c *Chunk) WriteTo(w io.Writer) (int64, error) {
+	return io.Copy(w, c.r)
+}
+
+// Close releases the chunk's store
+func (c *Chunk) Close() error {
+	var err error
+	for _, close := range c.closers {
+		if cerr := close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// Fetch returns the chunk of records from off, made up of as many whole
+// records as fit in maxBytes of store, and at least the record at off.
+// The chunk must be closed.
+func (l *Log) Fetch(off, maxBytes uint64) (*Chunk, error) {
+	l.mu.RLock()
+	s := l.segmentFor(off)
+	if s == nil {
+		defer l.mu.RUnlock()
+		return nil, l.outOfRange(off)
+	}
+	if s.local() {
+		defer l.mu.RUnlock()
+		return s.fetch(off, maxBytes)
+	}
+	l.mu.RUnlock()
+
+	cached, release, err := l.cache.acquire(context.Background(), s)
+	if err != nil {
+		return nil, err
+	}
+	c, err := cached.fetch(off, maxBytes)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	c.closers = append(c.closers, func() error {
+		release()
+		return nil
+	})
+	return c, nil
+}
+
+// fetch returns the chunk of the segment's records from off. Unencrypted
+// chunks read from their own handle on the store file, so they can be
+// sent after the log's moved on.
+func (s *segment) fetch(off, maxBytes uint64) (*Chunk, error) {
+	pos, end, next, err := s.frames(off, maxBytes)
+	if err != nil {
+		return nil, err
+	}
+	c := &Chunk{BaseOffset: off, NextOffset: next}
+	if s.store.aead != nil {
+		c.Size = -1
+		c.r = &recordReader{store: s.store, pos: pos, end: end}
+		return c, nil
+	}
+	// the file's read from its own handle, so the frames are flushed first
+	if err := s.store.flushTo(end); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(s.store.Name())
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(int64(pos), io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	c.Size = int64(end - pos)
+	// a LimitedReader of a file is what sendfile is used for
+	c.r = &io.LimitedReader{R: f, N: c.Size}
+	c.closers = append(c.closers, f.Close)
+	return c, nil
+}
+
+// frames returns the store position of the record at off, the end of the
+// last whole frame within maxBytes of it and the offset after that frame
+func (s *segment) frames(off, maxBytes uint64) (pos, end, next uint64, err error) {
+	if pos, err = s.position(off); err != nil {
+		return 0, 0, 0, err
+	}
+	first := off - s.baseOffset
+	records := s.next() - s.baseOffset
+	// the frames up to the last index entry within maxBytes all fit, those
+	// after it are scanned to find the last that does
+	n := sort.Search(int(s.index.entries()), func(i int) bool {
+		entry, p, _ := s.index.Read(int64(i))
+		return entry > first && (entry >= records || p-pos > maxBytes)
+	})
+	rel, end := first, pos
+	if n > 0 {
+		if entry, p, err := s.index.Read(int64(n - 1)); err == nil && entry > first {
+			rel, end = entry, p
+		}
+	}
+	for ; rel < records; rel++ {
+		frameEnd, err := s.store.frameEnd(end)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		if frameEnd-pos > maxBytes && rel > first {
+			break
+		}
+		end = frameEnd
+	}
+	return pos, end, s.baseOffset + rel, nil
+}
+
+// FrameReader decodes the records in a chunk's frames
+type FrameReader struct {
+	r      *bufio.Reader
+	header [lenWidth]byte
+}
+
+// NewFrameReader returns a FrameReader reading frames from r
+func NewFrameReader(r io.Reader) *FrameReader {
+	return &FrameReader{r: bufio.NewReader(r)}
+}
+
+// Next returns the next record, or io.EOF after the last
+func (f *FrameReader) Next() (*api.Record, error) {
+	if _, err := io.ReadFull(f.r, f.header[:]); err != nil {
+		return nil, err
+	}
+	header := enc.Uint64(f.header[:])
+	p := make([]byte, header&sizeMask)
+	if _, err := io.ReadFull(f.r, p); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	p, err := Codec(header >> codecShift).decompress(p)
+	if err != nil {
+		return nil, err
+	}
+	record := &api.Record{}
+	if err := proto.Unmarshal(p, record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
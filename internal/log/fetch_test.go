@@ -0,0 +1,142 @@
+package log
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+
+	api "github.com/michael-diggin/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestFetch(t *testing.T) {
+	keyring, err := NewKeyring("1", map[string][]byte{"1": make([]byte, 32)})
+	require.NoError(t, err)
+	for _, k := range []*Keyring{nil, keyring} {
+		for _, codec := range codecs {
+			// dense and sparse indexes
+			for _, interval := range []uint64{0, 300} {
+				testFetch(t, k, codec, interval)
+			}
+		}
+	}
+}
+
+func testFetch(t *testing.T, k *Keyring, codec Codec, interval uint64) {
+	dir, err := ioutil.TempDir("", "fetch-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{Keyring: k}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.Codec = codec
+	c.Segment.IndexIntervalBytes = interval
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	const records = 10
+	for i := 0; i < records; i++ {
+		_, err := log.Append(&api.Record{Value: jsonPayload(i)})
+		require.NoError(t, err)
+	}
+
+	// fetching chunk by chunk returns every record once, in order
+	var off uint64
+	for off < records {
+		chunk, err := log.Fetch(off, 500)
+		require.NoError(t, err)
+		require.Equal(t, off, chunk.BaseOffset)
+		require.True(t, chunk.NextOffset > off)
+		require.True(t, chunk.Size <= 500 || chunk.NextOffset == off+1)
+		frames := NewFrameReader(chunk)
+		for ; off < chunk.NextOffset; off++ {
+			record, err := frames.Next()
+			require.NoError(t, err)
+			require.Equal(t, off, record.Offset)
+			require.Equal(t, jsonPayload(int(off)), record.Value)
+		}
+		_, err = frames.Next()
+		require.Equal(t, io.EOF, err)
+		require.NoError(t, chunk.Close())
+	}
+	_, err = log.Fetch(records, 500)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: records, Next: records}, err)
+	require.NoError(t, log.Remove())
+}
+
+// BenchmarkConsume serves records the way Consume does, reading and
+// decoding each record and encoding it again for the response
+func BenchmarkConsume(b *testing.B) {
+	log, conn, teardown := benchmarkFetchLog(b)
+	defer teardown()
+	b.ReportAllocs()
+	b.SetBytes(int64(len(jsonPayload(0))))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		record, err := log.Read(uint64(i % fetchBenchRecords))
+		if err != nil {
+			b.Fatal(err)
+		}
+		p, err := proto.Marshal(&api.ConsumeResponse{Record: record})
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := conn.Write(p); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkFetch serves the same records in chunks as they're stored,
+// sent over TCP with sendfile
+func BenchmarkFetch(b *testing.B) {
+	log, conn, teardown := benchmarkFetchLog(b)
+	defer teardown()
+	b.ReportAllocs()
+	b.SetBytes(int64(len(jsonPayload(0))))
+	b.ResetTimer()
+	var off uint64
+	for i := 0; i < b.N; {
+		chunk, err := log.Fetch(off, 1<<20)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := chunk.WriteTo(conn); err != nil {
+			b.Fatal(err)
+		}
+		chunk.Close()
+		i += int(chunk.NextOffset - off)
+		off = chunk.NextOffset % fetchBenchRecords
+	}
+}
+
+const fetchBenchRecords = 10000
+
+// benchmarkFetchLog returns a log of JSON records and a TCP connection to
+// a server discarding what it's sent
+func benchmarkFetchLog(b *testing.B) (*Log, net.Conn, func()) {
+	log, teardown := benchmarkLog(b, CodecNone)
+	for i := 0; i < fetchBenchRecords; i++ {
+		if _, err := log.Append(&api.Record{Value: jsonPayload(i)}); err != nil {
+			b.Fatal(err)
+		}
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(b, err)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(ioutil.Discard, conn)
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(b, err)
+	return log, conn, func() {
+		conn.Close()
+		ln.Close()
+		teardown()
+	}
+}
@@ -1,25 +1,56 @@
 package log
 
 import (
+	"bytes"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"time"
 
 	"github.com/tysontate/gommap"
 )
 
 var (
-	offWidth uint64 = 4
+	offWidth uint64 = 8
 	posWidth uint64 = 8
 	entWidth        = offWidth + posWidth
 )
 
+// Index files start with a header of indexMagic, the format's version and
+// when the segment's first record was appended, in Unix nanoseconds or 0
+// if it hasn't been. Version 1 indexes had no header and 4 byte offsets,
+// version 2 had no append time, and both are migrated to the current
+// version as they're opened.
+var indexMagic = []byte("PLIX")
+
+const (
+	indexVersion uint32 = 3
+	headerWidth  uint64 = 16
+	// createdAt is where the append time is in the header
+	createdAt = 8
+)
+
 type index struct {
-	file *os.File
-	mmap gommap.MMap
+	// size is the bytes of entries after the header. It's read atomically,
+	// so entries are only read once they've been written, and comes first
+	// to be 64-bit aligned.
 	size uint64
+	// ctime is the append time in the header, read atomically alongside
+	// appends
+	ctime int64
+	file  *os.File
+	mmap  gommap.MMap
 }
 
 func newIndex(f *os.File, c Config) (*index, error) {
+	f, err := migrateIndex(f)
+	if err != nil {
+		return nil, err
+	}
 	idx := &index{
 		file: f,
 	}
@@ -27,7 +58,13 @@ func newIndex(f *os.File, c Config) (*index, error) {
 	if err != nil {
 		return nil, err
 	}
-	idx.size = uint64(fi.Size())
+	if fi.Size() == 0 {
+		if _, err := f.WriteAt(newIndexHeader(), 0); err != nil {
+			return nil, err
+		}
+	} else {
+		idx.size = uint64(fi.Size()) - headerWidth
+	}
 	if err := os.Truncate(
 		f.Name(), int64(c.Segment.MaxIndexBytes),
 	); err != nil {
@@ -41,39 +78,187 @@ func newIndex(f *os.File, c Config) (*index, error) {
 	); err != nil {
 		return nil, err
 	}
+	idx.ctime = int64(enc.Uint64(idx.mmap[createdAt:headerWidth]))
 	return idx, nil
 }
 
-// Read takes in an offset and returns the associated position
-func (i *index) Read(in int64) (out uint32, pos uint64, err error) {
-	if i.size == 0 {
+// newIndexHeader returns the header of an index with no entries
+func newIndexHeader() []byte {
+	header := make([]byte, headerWidth)
+	copy(header, indexMagic)
+	enc.PutUint32(header[len(indexMagic):], indexVersion)
+	return header
+}
+
+// migrateIndex rewrites an index from an earlier version in the current
+// format, returning the rewritten file in place of f. Indexes in the
+// current format, or empty, are returned as they are. Migrated indexes
+// don't know when their first record was appended.
+func migrateIndex(f *os.File) (*os.File, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.Size() == 0 {
+		return f, nil
+	}
+	header := make([]byte, headerWidth)
+	if _, err := f.ReadAt(header, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+	if bytes.HasPrefix(header, indexMagic) && enc.Uint32(header[len(indexMagic):]) == indexVersion {
+		return f, nil
+	}
+	old := make([]byte, fi.Size())
+	if _, err := f.ReadAt(old, 0); err != nil {
+		return nil, err
+	}
+	b, err := decodeIndex(old)
+	if err != nil {
+		return nil, fmt.Errorf("index %s: %w", f.Name(), err)
+	}
+	// the migrated index replaces the old one once it's all on disk
+	if err := replaceFile(f.Name(), b); err != nil {
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(f.Name(), os.O_RDWR|os.O_CREATE, 0644)
+}
+
+// decodeIndex returns the header and entries of the index file's contents
+// in the current format, converting them from an earlier version
+func decodeIndex(old []byte) ([]byte, error) {
+	// version 1 indexes start with the entry of offset 0, never the magic
+	oldHeader, oldOffWidth := uint64(0), uint64(4)
+	if bytes.HasPrefix(old, indexMagic) && uint64(len(old)) >= headerWidth/2 {
+		switch v := enc.Uint32(old[len(indexMagic):]); v {
+		case indexVersion:
+			if uint64(len(old)) < headerWidth {
+				return nil, fmt.Errorf("truncated header")
+			}
+			n := (uint64(len(old)) - headerWidth) / entWidth
+			return old[:headerWidth+n*entWidth], nil
+		case 2:
+			oldHeader, oldOffWidth = 8, 8
+		default:
+			return nil, fmt.Errorf("unsupported version %d", v)
+		}
+	}
+	old = old[oldHeader:]
+	oldEntWidth := oldOffWidth + posWidth
+	b := newIndexHeader()
+	entry := make([]byte, entWidth)
+	for i := uint64(0); i+oldEntWidth <= uint64(len(old)); i += oldEntWidth {
+		if oldOffWidth == 4 {
+			enc.PutUint64(entry, uint64(enc.Uint32(old[i:])))
+		} else {
+			enc.PutUint64(entry, enc.Uint64(old[i:]))
+		}
+		copy(entry[offWidth:], old[i+oldOffWidth:i+oldEntWidth])
+		b = append(b, entry...)
+	}
+	return b, nil
+}
+
+// replaceFile atomically replaces the file with one holding b
+func replaceFile(name string, b []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(name), filepath.Base(name)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
+
+// Read takes in an entry's number, or -1 for the last entry, and returns
+// the offset relative to the segment's base and position it holds
+func (i *index) Read(in int64) (out uint64, pos uint64, err error) {
+	size := atomic.LoadUint64(&i.size)
+	if size == 0 {
 		return 0, 0, io.EOF
 	}
+	n := uint64(in)
 	if in == -1 {
-		out = uint32((i.size / entWidth) - 1)
-	} else {
-		out = uint32(in)
+		n = size/entWidth - 1
 	}
-	pos = uint64(out) * entWidth
-	if i.size < pos+entWidth {
+	if n >= size/entWidth {
 		return 0, 0, io.EOF
 	}
-	out = enc.Uint32(i.mmap[pos : pos+offWidth])
+	pos = headerWidth + n*entWidth
+	out = enc.Uint64(i.mmap[pos : pos+offWidth])
 	pos = enc.Uint64(i.mmap[pos+offWidth : pos+entWidth])
 	return out, pos, nil
 }
 
+// Find returns the entry of the record at off or, in a sparse index, the
+// last entry before it, and io.EOF if there isn't one
+func (i *index) Find(off uint64) (out uint64, pos uint64, err error) {
+	// a dense index has the entry of every record at its offset
+	if out, pos, err = i.Read(int64(off)); err == nil && out == off {
+		return out, pos, nil
+	}
+	n := sort.Search(int(i.entries()), func(j int) bool {
+		out, _, _ := i.Read(int64(j))
+		return out > off
+	})
+	if n == 0 {
+		return 0, 0, io.EOF
+	}
+	return i.Read(int64(n - 1))
+}
+
+// entries returns the number of entries in the index
+func (i *index) entries() uint64 {
+	return atomic.LoadUint64(&i.size) / entWidth
+}
+
 // Write appends the given offset and position to the index
-func (i *index) Write(off uint32, pos uint64) error {
-	if uint64(len(i.mmap)) < i.size+entWidth {
+func (i *index) Write(off uint64, pos uint64) error {
+	at := headerWidth + i.size
+	if uint64(len(i.mmap)) < at+entWidth {
 		return io.EOF
 	}
-	enc.PutUint32(i.mmap[i.size:i.size+offWidth], off)
-	enc.PutUint64(i.mmap[i.size+offWidth:i.size+entWidth], pos)
-	i.size += uint64(entWidth)
+	enc.PutUint64(i.mmap[at:at+offWidth], off)
+	enc.PutUint64(i.mmap[at+offWidth:at+entWidth], pos)
+	atomic.StoreUint64(&i.size, i.size+entWidth)
 	return nil
 }
 
+// created returns when the segment's first record was appended, or the zero
+// time if it hasn't been or isn't known
+func (i *index) created() time.Time {
+	nsec := atomic.LoadInt64(&i.ctime)
+	if nsec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nsec)
+}
+
+// setCreated records when the segment's first record was appended
+func (i *index) setCreated(t time.Time) {
+	enc.PutUint64(i.mmap[createdAt:headerWidth], uint64(t.UnixNano()))
+	atomic.StoreInt64(&i.ctime, t.UnixNano())
+}
+
+// bytes returns the header and entries of the index, without the padding
+// after them
+func (i *index) bytes() []byte {
+	return i.mmap[:headerWidth+atomic.LoadUint64(&i.size)]
+}
+
 // Name returns the underlying file name
 func (i *index) Name() string {
 	return i.file.Name()
@@ -87,7 +272,7 @@ func (i *index) Close() error {
 	if err := i.file.Sync(); err != nil {
 		return err
 	}
-	if err := i.file.Truncate(int64(i.size)); err != nil {
+	if err := i.file.Truncate(int64(headerWidth + i.size)); err != nil {
 		return err
 	}
 	return i.file.Close()
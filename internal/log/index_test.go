@@ -3,6 +3,7 @@ package log
 import (
 	"io"
 	"io/ioutil"
+	"math"
 	"os"
 	"testing"
 
@@ -23,7 +24,7 @@ func TestIndex(t *testing.T) {
 	require.Equal(t, f.Name(), idx.Name())
 
 	entries := []struct {
-		Off uint32
+		Off uint64
 		Pos uint64
 	}{
 		{Off: 0, Pos: 0},
@@ -49,6 +50,141 @@ func TestIndex(t *testing.T) {
 	require.NoError(t, err)
 	off, pos, err := idx.Read(-1)
 	require.NoError(t, err)
-	require.Equal(t, uint32(1), off)
+	require.Equal(t, uint64(1), off)
 	require.Equal(t, entries[1].Pos, pos)
 }
+
+func TestIndexFind(t *testing.T) {
+	f, err := ioutil.TempFile(os.TempDir(), "index_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = 1024
+	idx, err := newIndex(f, c)
+	require.NoError(t, err)
+	defer idx.Close()
+	_, _, err = idx.Find(0)
+	require.Equal(t, io.EOF, err)
+
+	// a sparse index finds the entry at or before the offset
+	for _, off := range []uint64{0, 4, 8} {
+		require.NoError(t, idx.Write(off, off*10))
+	}
+	for off, want := range []uint64{0, 0, 0, 0, 4, 4, 4, 4, 8, 8} {
+		out, pos, err := idx.Find(uint64(off))
+		require.NoError(t, err)
+		require.Equal(t, want, out)
+		require.Equal(t, want*10, pos)
+	}
+}
+
+func TestIndexLargeOffsets(t *testing.T) {
+	f, err := ioutil.TempFile(os.TempDir(), "index_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = 1024
+	idx, err := newIndex(f, c)
+	require.NoError(t, err)
+
+	// relative offsets past the 32-bit limit round trip
+	offsets := []uint64{0, math.MaxUint32, math.MaxUint32 + 1, math.MaxUint64 - 1}
+	for i, off := range offsets {
+		require.NoError(t, idx.Write(off, uint64(i)))
+	}
+	for i, want := range offsets {
+		off, pos, err := idx.Read(int64(i))
+		require.NoError(t, err)
+		require.Equal(t, want, off)
+		require.Equal(t, uint64(i), pos)
+
+		off, pos, err = idx.Find(want)
+		require.NoError(t, err)
+		require.Equal(t, want, off)
+		require.Equal(t, uint64(i), pos)
+	}
+	off, _, err := idx.Find(math.MaxUint32 + 10)
+	require.NoError(t, err)
+	require.Equal(t, uint64(math.MaxUint32+1), off)
+	for _, in := range []int64{-2, int64(len(offsets)), math.MaxInt64} {
+		_, _, err = idx.Read(in)
+		require.Equal(t, io.EOF, err)
+	}
+
+	// the index is full once there's no room for another whole entry
+	for err = nil; err == nil; {
+		err = idx.Write(math.MaxUint64, 0)
+	}
+	require.Equal(t, io.EOF, err)
+	require.Equal(t, (c.Segment.MaxIndexBytes-headerWidth)/entWidth, idx.entries())
+	require.NoError(t, idx.Close())
+}
+
+func TestIndexMigrate(t *testing.T) {
+	for version, old := range map[string][]byte{
+		// 4 byte offsets and no header
+		"1": func() []byte {
+			b := make([]byte, 3*12)
+			for i := uint64(0); i < 3; i++ {
+				enc.PutUint32(b[i*12:], uint32(i))
+				enc.PutUint64(b[i*12+4:], i*100)
+			}
+			return b
+		}(),
+		// 8 byte offsets and a header without the append time
+		"2": func() []byte {
+			b := append([]byte("PLIX"), 0, 0, 0, 2)
+			entry := make([]byte, 16)
+			for i := uint64(0); i < 3; i++ {
+				enc.PutUint64(entry, i)
+				enc.PutUint64(entry[8:], i*100)
+				b = append(b, entry...)
+			}
+			return b
+		}(),
+	} {
+		t.Run("version "+version, func(t *testing.T) {
+			testIndexMigrate(t, old)
+		})
+	}
+}
+
+func testIndexMigrate(t *testing.T, old []byte) {
+	f, err := ioutil.TempFile(os.TempDir(), "index_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.Write(old)
+	require.NoError(t, err)
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = 1024
+	idx, err := newIndex(f, c)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), idx.entries())
+	for i := uint64(0); i < 3; i++ {
+		off, pos, err := idx.Read(int64(i))
+		require.NoError(t, err)
+		require.Equal(t, i, off)
+		require.Equal(t, i*100, pos)
+	}
+	require.True(t, idx.created().IsZero())
+	require.NoError(t, idx.Write(3, 300))
+	require.NoError(t, idx.Close())
+
+	b, err := ioutil.ReadFile(f.Name())
+	require.NoError(t, err)
+	require.Equal(t, []byte("PLIX"), b[:4])
+	require.Equal(t, indexVersion, enc.Uint32(b[4:]))
+	require.Equal(t, headerWidth+4*entWidth, uint64(len(b)))
+
+	// indexes from a later version aren't opened
+	enc.PutUint32(b[4:], indexVersion+1)
+	require.NoError(t, ioutil.WriteFile(f.Name(), b, 0644))
+	f, err = os.OpenFile(f.Name(), os.O_RDWR, 0644)
+	require.NoError(t, err)
+	_, err = newIndex(f, c)
+	require.Error(t, err)
+	f.Close()
+}
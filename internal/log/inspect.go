@@ -0,0 +1,500 @@
+package log
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	api "github.com/michael-diggin/proglog/api/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// segmentMissing segments are listed in the manifest without any files
+const segmentMissing segmentState = "missing"
+
+// Inspector reads the segments in a log's directory without opening the
+// log, so the files of a node that's stopped, or won't start, can be looked
+// into. Only Repair writes to the directory, and no logs should have it
+// open while it does.
+type Inspector struct {
+	dir    string
+	config Config
+}
+
+// NewInspector returns an Inspector of the log in dir. The config's keyring
+// decrypts encrypted segments, and its index interval is kept by indexes
+// Repair rebuilds.
+func NewInspector(dir string, c Config) *Inspector {
+	return &Inspector{dir: dir, config: c}
+}
+
+// SegmentInfo describes a segment in a log's directory
+type SegmentInfo struct {
+	BaseOffset uint64 `json:"base_offset"`
+	State      string `json:"state"`
+	// NextOffset is the offset after the segment's last whole record
+	NextOffset   uint64 `json:"next_offset"`
+	StoreBytes   uint64 `json:"store_bytes"`
+	IndexEntries uint64 `json:"index_entries"`
+	// Key is the ID of the key the store's encrypted with, if it is
+	Key     string    `json:"key,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+// Problem is something wrong with a log's files
+type Problem struct {
+	// Segment is the base offset of the segment the problem's in
+	Segment uint64 `json:"segment"`
+	// File is the extension of the segment's file the problem's in, or the
+	// manifest's name
+	File string `json:"file"`
+	// Offset is the record the problem's at
+	Offset  uint64 `json:"offset"`
+	Message string `json:"message"`
+}
+
+func (p Problem) String() string {
+	if p.File == manifestFile {
+		return fmt.Sprintf("%s: %s", p.File, p.Message)
+	}
+	return fmt.Sprintf("%d%s: offset %d: %s", p.Segment, p.File, p.Offset, p.Message)
+}
+
+// Report is what Verify finds in a log's directory
+type Report struct {
+	Segments []SegmentInfo `json:"segments"`
+	// NextOffset is the offset after the last record that's read back
+	// whole and in order, from the first segment, which Repair truncates
+	// the log to
+	NextOffset uint64    `json:"next_offset"`
+	Problems   []Problem `json:"problems"`
+}
+
+// inspected is a segment's files as Verify finds them
+type inspected struct {
+	info   SegmentInfo
+	remote bool
+	// positions are the store positions of the records read back whole
+	// and in order, which end at end
+	positions []uint64
+	end       uint64
+	// storeOK is false if there's more in the store after the records
+	// read back, and indexOK if the index doesn't agree with them
+	storeOK bool
+	indexOK bool
+	// created is when the first record was appended, from the index
+	created time.Time
+}
+
+// manifest returns the log's manifest, recovered from the directory if it
+// can't be read, and the problem with it if there is one
+func (in *Inspector) manifest() (*manifest, *Problem, error) {
+	m, err := readManifest(in.dir)
+	if m != nil {
+		return m, nil, nil
+	}
+	problem := &Problem{File: manifestFile, Message: "missing"}
+	if err != nil {
+		problem.Message = err.Error()
+	}
+	if m, err = scanSegments(in.dir); err != nil {
+		return nil, nil, err
+	}
+	return m, problem, nil
+}
+
+// Segments returns the log's segments as the manifest lists them
+func (in *Inspector) Segments() ([]SegmentInfo, error) {
+	m, _, err := in.manifest()
+	if err != nil {
+		return nil, err
+	}
+	var infos []SegmentInfo
+	for _, ms := range m.Segments {
+		info, err := in.info(ms)
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// info describes the segment from its files, counting its whole records
+// without reading them
+func (in *Inspector) info(ms manifestSegment) (SegmentInfo, error) {
+	info := SegmentInfo{BaseOffset: ms.BaseOffset, State: string(ms.State)}
+	s, err := in.openStore(ms.BaseOffset)
+	if os.IsNotExist(err) {
+		return in.remoteInfo(info)
+	}
+	if err != nil {
+		return info, err
+	}
+	defer s.Close()
+	info.StoreBytes = s.Size()
+	info.Key = in.key(ms.BaseOffset)
+	info.NextOffset = ms.BaseOffset
+	for pos := uint64(0); pos < s.Size(); info.NextOffset++ {
+		if pos, err = s.frameEnd(pos); err != nil || pos > s.Size() {
+			break
+		}
+	}
+	if b, err := ioutil.ReadFile(segmentFile(in.dir, ms.BaseOffset, ".index")); err == nil {
+		if b, err = decodeIndex(b); err == nil {
+			info.IndexEntries = (uint64(len(b)) - headerWidth) / entWidth
+			info.Created = indexCreated(b)
+		}
+	}
+	return info, nil
+}
+
+// remoteInfo describes the segment from its .remote file, if it has one
+func (in *Inspector) remoteInfo(info SegmentInfo) (SegmentInfo, error) {
+	remote, err := readRemoteSegment(in.dir, info.BaseOffset)
+	if err != nil {
+		return info, err
+	}
+	if remote == nil {
+		info.State = string(segmentMissing)
+		return info, nil
+	}
+	info.State = string(segmentRemote)
+	info.NextOffset = remote.NextOffset
+	info.StoreBytes = remote.Bytes
+	info.Key = remote.Key
+	info.Created = remote.Created
+	return info, nil
+}
+
+// openStore opens the segment's store for reading, decrypting it with the
+// key it records
+func (in *Inspector) openStore(baseOffset uint64) (*store, error) {
+	f, err := os.Open(segmentFile(in.dir, baseOffset, ".store"))
+	if err != nil {
+		return nil, err
+	}
+	s, err := newStore(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if id := in.key(baseOffset); id != "" {
+		if in.config.Keyring == nil {
+			s.Close()
+			return nil, fmt.Errorf("segment %d is encrypted but there's no keyring", baseOffset)
+		}
+		if s.aead, err = in.config.Keyring.aead(id); err != nil {
+			s.Close()
+			return nil, fmt.Errorf("segment %d: %w", baseOffset, err)
+		}
+	}
+	return s, nil
+}
+
+// key returns the ID of the key the segment's encrypted with, if it is
+func (in *Inspector) key(baseOffset uint64) string {
+	id, err := ioutil.ReadFile(segmentFile(in.dir, baseOffset, ".key"))
+	if err != nil {
+		return ""
+	}
+	return string(id)
+}
+
+// indexCreated returns the append time in the index's header
+func indexCreated(b []byte) time.Time {
+	nsec := int64(enc.Uint64(b[createdAt:headerWidth]))
+	if nsec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nsec)
+}
+
+// Dump calls fn with each of the log's records from off, in order, until
+// it returns an error. Records that can't be read back end the dump with
+// an error, and offloaded segments are skipped as they're only in the
+// object store.
+//
+// Dump reads the stores itself rather than with an Iterator, which needs
+// the log open: opening it writes the manifest, creates an active segment
+// and fails on the damaged files Dump is for looking into. The records are
+// read with the same store reads an Iterator's are.
+func (in *Inspector) Dump(off uint64, fn func(*api.Record) error) error {
+	m, _, err := in.manifest()
+	if err != nil {
+		return err
+	}
+	for _, ms := range m.Segments {
+		s, err := in.openStore(ms.BaseOffset)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		err = dumpStore(s, off, fn)
+		s.Close()
+		if err != nil {
+			return fmt.Errorf("segment %d: %w", ms.BaseOffset, err)
+		}
+	}
+	return nil
+}
+
+func dumpStore(s *store, off uint64, fn func(*api.Record) error) error {
+	for pos := uint64(0); pos < s.Size(); {
+		p, next, err := s.readNext(pos)
+		if err != nil {
+			return err
+		}
+		record := &api.Record{}
+		if err := proto.Unmarshal(p, record); err != nil {
+			return fmt.Errorf("invalid record at %d: %w", pos, err)
+		}
+		if record.Offset >= off {
+			if err := fn(record); err != nil {
+				return err
+			}
+		}
+		pos = next
+	}
+	return nil
+}
+
+// Verify reads back every record of the log's local segments, checking
+// they're whole and in order and that the indexes agree with the stores,
+// and that the segments follow on from each other. Offloaded segments are
+// taken as their .remote files describe them.
+func (in *Inspector) Verify() (*Report, error) {
+	report, _, _, err := in.verify()
+	return report, err
+}
+
+// verify returns the report, the segments as they were found and how many
+// of them are kept, the rest being after the last record read back
+func (in *Inspector) verify() (*Report, []*inspected, int, error) {
+	m, problem, err := in.manifest()
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	report := &Report{}
+	if problem != nil {
+		report.Problems = append(report.Problems, *problem)
+	}
+	var segments []*inspected
+	keep := len(m.Segments)
+	// cut is set once a segment's records don't follow on from the last
+	cut := false
+	for i, ms := range m.Segments {
+		info, err := in.info(ms)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		report.Segments = append(report.Segments, info)
+		seg := &inspected{info: info, remote: info.State == string(segmentRemote)}
+		segments = append(segments, seg)
+		problem := func(file string, off uint64, format string, args ...interface{}) {
+			report.Problems = append(report.Problems, Problem{
+				Segment: ms.BaseOffset, File: file, Offset: off, Message: fmt.Sprintf(format, args...),
+			})
+		}
+		if i == 0 {
+			report.NextOffset = ms.BaseOffset
+		}
+		if !cut && ms.BaseOffset != report.NextOffset {
+			problem(".store", report.NextOffset, "segment starts at %d", ms.BaseOffset)
+			cut, keep = true, i
+		}
+		switch {
+		case info.State == string(segmentMissing):
+			problem(".store", ms.BaseOffset, "segment's files are missing")
+			if !cut {
+				cut, keep = true, i
+			}
+			continue
+		case seg.remote:
+			if !cut {
+				report.NextOffset = info.NextOffset
+			}
+			continue
+		}
+		if err := in.check(seg, problem); err != nil {
+			return nil, nil, 0, err
+		}
+		if !cut {
+			report.NextOffset = ms.BaseOffset + uint64(len(seg.positions))
+			if !seg.storeOK {
+				cut, keep = true, i+1
+			}
+		}
+	}
+	return report, segments, keep, nil
+}
+
+// check reads back the segment's records and index entries, reporting the
+// first problem with each
+func (in *Inspector) check(seg *inspected, problem func(file string, off uint64, format string, args ...interface{})) error {
+	base := seg.info.BaseOffset
+	s, err := in.openStore(base)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	fi, err := s.Stat()
+	if err != nil {
+		return err
+	}
+	seg.created = fi.ModTime()
+
+	seg.storeOK = true
+	for pos := uint64(0); pos < s.Size(); {
+		off := base + uint64(len(seg.positions))
+		end, err := s.frameEnd(pos)
+		if err != nil || end > s.Size() {
+			problem(".store", off, "record at %d was only partly written", pos)
+			seg.storeOK = false
+			break
+		}
+		p, next, err := s.readNext(pos)
+		if err != nil {
+			problem(".store", off, "%s", err)
+			seg.storeOK = false
+			break
+		}
+		record := &api.Record{}
+		if err := proto.Unmarshal(p, record); err != nil {
+			problem(".store", off, "invalid record at %d: %s", pos, err)
+			seg.storeOK = false
+			break
+		}
+		if record.Offset != off {
+			problem(".store", off, "record at %d has offset %d", pos, record.Offset)
+			seg.storeOK = false
+			break
+		}
+		seg.positions = append(seg.positions, pos)
+		pos = next
+		seg.end = pos
+	}
+
+	b, err := ioutil.ReadFile(segmentFile(in.dir, base, ".index"))
+	if err != nil {
+		problem(".index", base, "%s", err)
+		return nil
+	}
+	if b, err = decodeIndex(b); err != nil {
+		problem(".index", base, "%s", err)
+		return nil
+	}
+	if created := indexCreated(b); !created.IsZero() {
+		seg.created = created
+	}
+	seg.indexOK = true
+	entries := (uint64(len(b)) - headerWidth) / entWidth
+	if entries == 0 && len(seg.positions) > 0 {
+		problem(".index", base, "index has no entries")
+		seg.indexOK = false
+	}
+	for n := uint64(0); n < entries; n++ {
+		at := headerWidth + n*entWidth
+		rel, pos := enc.Uint64(b[at:at+offWidth]), enc.Uint64(b[at+offWidth:at+entWidth])
+		switch {
+		case n == 0 && rel != 0:
+			problem(".index", base, "index has no entry for the first record")
+		case n > 0 && rel <= enc.Uint64(b[at-entWidth:]):
+			problem(".index", base+rel, "entry %d is out of order", n)
+		case rel >= uint64(len(seg.positions)):
+			problem(".index", base+rel, "entry %d is past the last record", n)
+		case seg.positions[rel] != pos:
+			problem(".index", base+rel, "entry %d has position %d, the record's at %d", n, pos, seg.positions[rel])
+		default:
+			continue
+		}
+		seg.indexOK = false
+		break
+	}
+	return nil
+}
+
+// Repair truncates the log to the last record that's read back whole and
+// in order, removing the segments after it and rebuilding the indexes that
+// don't agree with their stores, and rewrites the manifest. It returns the
+// report of what it found. Offloaded segments after the last record have
+// their .remote files removed, but not their objects in the object store.
+func (in *Inspector) Repair() (*Report, error) {
+	report, segments, keep, err := in.verify()
+	if err != nil {
+		return nil, err
+	}
+	if len(report.Problems) == 0 {
+		return report, nil
+	}
+	m := &manifest{Version: manifestVersion, HighWaterMark: report.NextOffset}
+	for i, seg := range segments {
+		base := seg.info.BaseOffset
+		if i >= keep {
+			if err := in.remove(base); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		state := segmentClosed
+		if seg.remote {
+			state = segmentRemote
+		} else if err := in.truncate(seg, report.NextOffset); err != nil {
+			return nil, err
+		}
+		m.Segments = append(m.Segments, manifestSegment{BaseOffset: base, State: state})
+	}
+	if n := len(m.Segments); n > 0 && m.Segments[n-1].State == segmentClosed {
+		m.Segments[n-1].State = segmentActive
+	}
+	return report, m.write(in.dir)
+}
+
+// truncate truncates the segment's store after the record before off,
+// rebuilding its index if it no longer agrees
+func (in *Inspector) truncate(seg *inspected, off uint64) error {
+	base := seg.info.BaseOffset
+	if n := off - base; n < uint64(len(seg.positions)) {
+		seg.end = seg.positions[n]
+		seg.positions = seg.positions[:n]
+		seg.storeOK, seg.indexOK = false, false
+	}
+	if seg.storeOK && seg.indexOK {
+		return nil
+	}
+	if err := os.Truncate(segmentFile(in.dir, base, ".store"), int64(seg.end)); err != nil {
+		return err
+	}
+	// the index has an entry for the first record and then one every
+	// index interval, as it does when the records are appended
+	b := newIndexHeader()
+	if len(seg.positions) > 0 {
+		enc.PutUint64(b[createdAt:headerWidth], uint64(seg.created.UnixNano()))
+	}
+	entry := make([]byte, entWidth)
+	var indexAt uint64
+	for rel, pos := range seg.positions {
+		if rel > 0 && pos < indexAt {
+			continue
+		}
+		enc.PutUint64(entry, uint64(rel))
+		enc.PutUint64(entry[offWidth:], pos)
+		b = append(b, entry...)
+		indexAt = pos + in.config.Segment.IndexIntervalBytes
+	}
+	return replaceFile(segmentFile(in.dir, base, ".index"), b)
+}
+
+// remove removes the segment's files
+func (in *Inspector) remove(baseOffset uint64) error {
+	for _, ext := range []string{".store", ".index", ".key", ".remote"} {
+		err := os.Remove(segmentFile(in.dir, baseOffset, ext))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
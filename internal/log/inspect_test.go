@@ -0,0 +1,133 @@
+package log
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	api "github.com/michael-diggin/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInspector(t *testing.T) {
+	for scenario, tc := range map[string]struct {
+		damage func(t *testing.T, dir string)
+		// file is where the first problem's found, and next the offset the
+		// log's repaired to
+		file string
+		next uint64
+	}{
+		"nothing wrong": {
+			damage: func(t *testing.T, dir string) {},
+			next:   6,
+		},
+		"partly written record": {
+			damage: func(t *testing.T, dir string) {
+				f, err := os.OpenFile(filepath.Join(dir, "4.store"), os.O_WRONLY|os.O_APPEND, 0644)
+				require.NoError(t, err)
+				_, err = f.Write([]byte{0, 0, 0})
+				require.NoError(t, err)
+				require.NoError(t, f.Close())
+			},
+			file: ".store",
+			next: 6,
+		},
+		"records out of order": {
+			damage: func(t *testing.T, dir string) {
+				b, err := ioutil.ReadFile(filepath.Join(dir, "0.store"))
+				require.NoError(t, err)
+				require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "2.store"), b, 0644))
+			},
+			file: ".store",
+			next: 2,
+		},
+		"index past the store": {
+			damage: func(t *testing.T, dir string) {
+				f, err := os.OpenFile(filepath.Join(dir, "2.index"), os.O_WRONLY|os.O_APPEND, 0644)
+				require.NoError(t, err)
+				_, err = f.Write(make([]byte, entWidth*2))
+				require.NoError(t, err)
+				require.NoError(t, f.Close())
+			},
+			file: ".index",
+			next: 6,
+		},
+		"missing segment": {
+			damage: func(t *testing.T, dir string) {
+				require.NoError(t, os.Remove(filepath.Join(dir, "2.store")))
+				require.NoError(t, os.Remove(filepath.Join(dir, "2.index")))
+			},
+			file: ".store",
+			next: 2,
+		},
+		"missing manifest": {
+			damage: func(t *testing.T, dir string) {
+				require.NoError(t, os.Remove(filepath.Join(dir, manifestFile)))
+			},
+			file: manifestFile,
+			next: 6,
+		},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "inspector-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			c := Config{}
+			c.Segment.MaxStoreBytes = 32
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+			// segments hold two records
+			for i := 0; i < 6; i++ {
+				_, err := log.Append(&api.Record{Value: []byte("hello world"), Term: 2})
+				require.NoError(t, err)
+			}
+			require.NoError(t, log.Close())
+			tc.damage(t, dir)
+
+			in := NewInspector(dir, c)
+			report, err := in.Verify()
+			require.NoError(t, err)
+			require.Equal(t, tc.next, report.NextOffset)
+			if tc.file == "" {
+				require.Empty(t, report.Problems)
+			} else {
+				require.NotEmpty(t, report.Problems)
+				require.Equal(t, tc.file, report.Problems[0].File)
+			}
+
+			// the records are dumped as they're stored, which is only in
+			// order if the stores are whole
+			var dumped []uint64
+			err = in.Dump(1, func(record *api.Record) error {
+				require.Equal(t, uint64(2), record.Term)
+				dumped = append(dumped, record.Offset)
+				return nil
+			})
+			if tc.file != ".store" {
+				require.NoError(t, err)
+				require.Equal(t, []uint64{1, 2, 3, 4, 5}, dumped)
+			}
+
+			// the repaired log has every record up to the first problem, and
+			// appends after them
+			_, err = in.Repair()
+			require.NoError(t, err)
+			report, err = in.Verify()
+			require.NoError(t, err)
+			require.Empty(t, report.Problems)
+			require.Equal(t, tc.next, report.NextOffset)
+			log, err = NewLog(dir, c)
+			require.NoError(t, err)
+			defer log.Close()
+			for off := uint64(0); off < tc.next; off++ {
+				_, err := log.Read(off)
+				require.NoError(t, err)
+			}
+			off, err := log.Append(&api.Record{Value: []byte("hello world")})
+			require.NoError(t, err)
+			require.Equal(t, tc.next, off)
+		})
+	}
+}
@@ -0,0 +1,205 @@
+package log
+
+import (
+	"context"
+	"io"
+	"time"
+
+	api "github.com/michael-diggin/proglog/api/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// Iterator reads a log's records in order. It reads each segment from one
+// record to the next without going through the index, moving on to the
+// next segment as the log rolls and finding its place again when segments
+// are truncated or offloaded. Iterators aren't safe for concurrent use.
+type Iterator struct {
+	log *Log
+	off uint64
+	// segment is the log's segment holding off, read is the segment it's
+	// read from, the same but for the cached copies of remote segments
+	segment *segment
+	read    *segment
+	pos     uint64
+	release func()
+}
+
+// NewIterator returns an iterator of the log's records from off
+func (l *Log) NewIterator(off uint64) *Iterator {
+	return &Iterator{log: l, off: off}
+}
+
+// Offset returns the offset of the record Next returns next
+func (it *Iterator) Offset() uint64 {
+	return it.off
+}
+
+// Next returns the next record. It returns io.EOF once it's read the last
+// record, until more are appended, and api.ErrOffsetOutOfRange if the next
+// record's been truncated.
+func (it *Iterator) Next() (*api.Record, error) {
+	p, err := it.next()
+	if err != nil {
+		return nil, err
+	}
+	record := &api.Record{}
+	if err := proto.Unmarshal(p, record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// next returns the next record as it's marshaled
+func (it *Iterator) next() ([]byte, error) {
+	l := it.log
+	l.mu.RLock()
+	if !it.positioned() {
+		it.unposition()
+		s := l.segmentFor(it.off)
+		if s == nil {
+			err := it.outOfRange()
+			l.mu.RUnlock()
+			return nil, err
+		}
+		read := s
+		if !s.local() {
+			// remote segments are downloaded without holding up appends
+			l.mu.RUnlock()
+			cached, release, err := l.cache.acquire(context.Background(), s)
+			if err != nil {
+				return nil, err
+			}
+			l.mu.RLock()
+			if s.removed {
+				// truncated while it was downloading
+				l.mu.RUnlock()
+				release()
+				return it.next()
+			}
+			read, it.release = cached, release
+		}
+		pos, err := read.position(it.off)
+		if err != nil {
+			l.mu.RUnlock()
+			it.unposition()
+			return nil, err
+		}
+		it.segment, it.read, it.pos = s, read, pos
+	}
+	p, next, err := it.read.store.readNext(it.pos)
+	l.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	it.off++
+	it.pos = next
+	return p, nil
+}
+
+// positioned returns whether the iterator's position in the segment it's
+// reading still holds the record at off. The caller must hold the lock.
+func (it *Iterator) positioned() bool {
+	s := it.segment
+	if s == nil || s.removed || it.off < s.baseOffset || it.off >= s.next() {
+		return false
+	}
+	// segments offloaded since are read from the cache instead
+	return s.local() == (it.read == s)
+}
+
+// unposition releases the segment the iterator's reading
+func (it *Iterator) unposition() {
+	if it.release != nil {
+		it.release()
+	}
+	it.segment, it.read, it.release = nil, nil, nil
+}
+
+// outOfRange returns the error for an offset that isn't in any segment.
+// The caller must hold the lock.
+func (it *Iterator) outOfRange() error {
+	segments := it.log.segments
+	if len(segments) > 0 && it.off >= segments[len(segments)-1].next() {
+		return io.EOF
+	}
+	return it.log.outOfRange(it.off)
+}
+
+// Seek moves the iterator to the record at off
+func (it *Iterator) Seek(off uint64) {
+	if off != it.off {
+		it.unposition()
+		it.off = off
+	}
+}
+
+// SeekTime moves the iterator to the start of a segment, not to a record:
+// the first record of the last segment created at or before t. Records
+// aren't timestamped, only segments are, so that's as close as it gets
+// without skipping records appended at or after t. The records from there
+// up to t, as many as a segment holds, are returned too, and callers that
+// need to start at t exactly have to skip them by their contents.
+func (it *Iterator) SeekTime(t time.Time) {
+	l := it.log
+	l.mu.RLock()
+	var off uint64
+	for i, s := range l.segments {
+		if i == 0 {
+			off = s.baseOffset
+		}
+		if s.next() == s.baseOffset {
+			continue
+		}
+		// segments created at an unknown time can't be skipped
+		if created := s.created(); !created.IsZero() && created.After(t) {
+			break
+		}
+		off = s.baseOffset
+	}
+	l.mu.RUnlock()
+	it.Seek(off)
+}
+
+// Close releases the segment the iterator's reading
+func (it *Iterator) Close() error {
+	it.unposition()
+	return nil
+}
+
+// Reader returns an io.Reader of the log's records from the lowest offset
+// up to the highest as of when it's called, each preceded by its length
+func (l *Log) Reader() io.Reader {
+	l.mu.RLock()
+	var lowest, end uint64
+	if n := len(l.segments); n > 0 {
+		lowest, end = l.segments[0].baseOffset, l.segments[n-1].next()
+	}
+	l.mu.RUnlock()
+	return &iteratorReader{it: l.NewIterator(lowest), end: end}
+}
+
+type iteratorReader struct {
+	it  *Iterator
+	end uint64
+	buf []byte
+}
+
+func (r *iteratorReader) Read(p []byte) (int, error) {
+	if len(r.buf) == 0 {
+		if r.it.Offset() >= r.end {
+			r.it.Close()
+			return 0, io.EOF
+		}
+		b, err := r.it.next()
+		if err != nil {
+			r.it.Close()
+			return 0, err
+		}
+		r.buf = make([]byte, lenWidth, lenWidth+len(b))
+		enc.PutUint64(r.buf, uint64(len(b)))
+		r.buf = append(r.buf, b...)
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
@@ -0,0 +1,189 @@
+package log
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	api "github.com/michael-diggin/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIterator(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T, log *Log){
+		"reads across rolls":      testIteratorRolls,
+		"seeks":                   testIteratorSeek,
+		"survives truncation":     testIteratorTruncate,
+		"survives offloading":     testIteratorOffload,
+		"seeks by time":           testIteratorSeekTime,
+		"reads sparse segments":   testIteratorSparse,
+		"reader stops at the end": testIteratorReader,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "iterator-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+			c := Config{}
+			c.Segment.MaxStoreBytes = 64
+			c.Tier.Store = newMemStore()
+			c.Tier.Interval = time.Hour
+			c.Tier.CacheSegments = 1
+			if scenario == "reads sparse segments" {
+				c.Segment.MaxStoreBytes = 1024
+				c.Segment.IndexIntervalBytes = 100
+			}
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+			defer log.Remove()
+			fn(t, log)
+		})
+	}
+}
+
+func appendRecords(t *testing.T, log *Log, from, to int) {
+	t.Helper()
+	for i := from; i < to; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+}
+
+func requireNext(t *testing.T, it *Iterator, off uint64) {
+	t.Helper()
+	record, err := it.Next()
+	require.NoError(t, err)
+	require.Equal(t, off, record.Offset)
+	require.Equal(t, fmt.Sprintf("record %d", off), string(record.Value))
+}
+
+func testIteratorRolls(t *testing.T, log *Log) {
+	appendRecords(t, log, 0, 5)
+	segments := log.Stats().Segments
+	it := log.NewIterator(0)
+	defer it.Close()
+	for off := uint64(0); off < 5; off++ {
+		requireNext(t, it, off)
+	}
+	_, err := it.Next()
+	require.Equal(t, io.EOF, err)
+
+	// records appended since, in segments rolled since, are read next
+	appendRecords(t, log, 5, 10)
+	require.True(t, log.Stats().Segments > segments)
+	for off := uint64(5); off < 10; off++ {
+		requireNext(t, it, off)
+	}
+	_, err = it.Next()
+	require.Equal(t, io.EOF, err)
+	require.Equal(t, uint64(10), it.Offset())
+}
+
+func testIteratorSeek(t *testing.T, log *Log) {
+	appendRecords(t, log, 0, 10)
+	it := log.NewIterator(7)
+	defer it.Close()
+	requireNext(t, it, 7)
+	it.Seek(2)
+	requireNext(t, it, 2)
+	requireNext(t, it, 3)
+	it.Seek(20)
+	_, err := it.Next()
+	require.Equal(t, io.EOF, err)
+}
+
+func testIteratorTruncate(t *testing.T, log *Log) {
+	appendRecords(t, log, 0, 10)
+	it := log.NewIterator(0)
+	defer it.Close()
+	requireNext(t, it, 0)
+
+	// the segment being read is removed, so the iterator's out of range
+	// until it's moved on
+	require.NoError(t, log.Truncate(5))
+	lowest, err := log.LowestOffset()
+	require.NoError(t, err)
+	_, err = it.Next()
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 1, Lowest: lowest, Next: 10}, err)
+	it.Seek(lowest)
+	requireNext(t, it, lowest)
+}
+
+func testIteratorOffload(t *testing.T, log *Log) {
+	appendRecords(t, log, 0, 10)
+	it := log.NewIterator(0)
+	defer it.Close()
+	requireNext(t, it, 0)
+
+	// the segments are read from the object store once they're offloaded
+	require.NoError(t, log.Offload(context.Background()))
+	require.True(t, log.Stats().RemoteSegments > 1)
+	for off := uint64(1); off < 10; off++ {
+		requireNext(t, it, off)
+	}
+
+	// iterators hold on to the cached segment they're reading
+	other := log.NewIterator(0)
+	defer other.Close()
+	requireNext(t, other, 0)
+	it.Seek(5)
+	requireNext(t, it, 5)
+	requireNext(t, other, 1)
+}
+
+func testIteratorSeekTime(t *testing.T, log *Log) {
+	appendRecords(t, log, 0, 10)
+	// the segments were created an hour apart
+	start := time.Now().Add(-24 * time.Hour)
+	log.mu.RLock()
+	var bases []uint64
+	for i, s := range log.segments {
+		if s.next() > s.baseOffset {
+			s.index.setCreated(start.Add(time.Duration(i) * time.Hour))
+			bases = append(bases, s.baseOffset)
+		}
+	}
+	log.mu.RUnlock()
+	require.True(t, len(bases) > 2)
+
+	it := log.NewIterator(0)
+	defer it.Close()
+	for when, want := range map[time.Duration]uint64{
+		-time.Hour:       bases[0],
+		90 * time.Minute: bases[1],
+		2 * time.Hour:    bases[2],
+		48 * time.Hour:   bases[len(bases)-1],
+	} {
+		it.SeekTime(start.Add(when))
+		requireNext(t, it, want)
+	}
+}
+
+func testIteratorSparse(t *testing.T, log *Log) {
+	appendRecords(t, log, 0, 30)
+	for _, from := range []uint64{0, 7, 29} {
+		it := log.NewIterator(from)
+		for off := from; off < 30; off++ {
+			requireNext(t, it, off)
+		}
+		require.NoError(t, it.Close())
+	}
+}
+
+func testIteratorReader(t *testing.T, log *Log) {
+	appendRecords(t, log, 0, 4)
+	r := log.Reader()
+	// records appended after the reader's returned aren't read
+	appendRecords(t, log, 4, 8)
+	b, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	var records int
+	for len(b) > 0 {
+		b = b[lenWidth+enc.Uint64(b):]
+		records++
+	}
+	require.Equal(t, 4, records)
+}
@@ -0,0 +1,86 @@
+package log
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Keyring holds the keys segments are encrypted with by their IDs. New
+// segments are encrypted with the active key and record its ID, so keys can
+// be rotated by adding a new active key and dropping old keys once the
+// segments encrypted with them have been removed.
+type Keyring struct {
+	active string
+	keys   map[string][]byte
+}
+
+// NewKeyring returns a Keyring of the AES-128, AES-192 or AES-256 keys by
+// their IDs, encrypting new segments with the active key
+func NewKeyring(active string, keys map[string][]byte) (*Keyring, error) {
+	if _, ok := keys[active]; !ok {
+		return nil, fmt.Errorf("active key %q not in keyring", active)
+	}
+	for id, key := range keys {
+		if id == "" || strings.ContainsAny(id, " \t\n") {
+			return nil, fmt.Errorf("invalid key ID %q", id)
+		}
+		if _, err := aes.NewCipher(key); err != nil {
+			return nil, fmt.Errorf("invalid key %q: %w", id, err)
+		}
+	}
+	return &Keyring{active: active, keys: keys}, nil
+}
+
+// LoadKeyring reads a Keyring from a file of "<id> <base64 key>" lines. The
+// last key in the file is the active key.
+func LoadKeyring(file string) (*Keyring, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open keyfile: %w", err)
+	}
+	defer f.Close()
+	var active string
+	keys := make(map[string][]byte)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("keyfile line %d: want <id> <base64 key>", n)
+		}
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("keyfile line %d: %w", n, err)
+		}
+		active = fields[0]
+		keys[active] = key
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read keyfile: %w", err)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no keys in keyfile: %s", file)
+	}
+	return NewKeyring(active, keys)
+}
+
+// aead returns the AES-GCM cipher for the key with the given ID
+func (k *Keyring) aead(id string) (cipher.AEAD, error) {
+	key, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("key %q not in keyring", id)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -1,24 +1,32 @@
 package log
 
 import (
-	"io"
-	"io/ioutil"
+	"context"
 	"os"
 	"path"
-	"sort"
-	"strconv"
-	"strings"
 	"sync"
+	"time"
 
 	api "github.com/michael-diggin/proglog/api/v1"
+	"github.com/michael-diggin/proglog/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.uber.org/zap"
 )
 
 type Log struct {
+	// mu guards the segments, it's only held for writing to change them.
+	// appendMu serializes appends.
 	mu            sync.RWMutex
+	appendMu      sync.Mutex
 	Dir           string
 	Config        Config
 	activeSegment *segment
 	segments      []*segment
+	// cache holds remote segments being read when the log's tiered
+	cache          *segmentCache
+	offloadMu      sync.Mutex
+	stopOffloading func()
+	stopRolling    func()
 }
 
 // NewLog returns a new Log instance
@@ -34,35 +42,89 @@ func NewLog(dir string, c Config) (*Log, error) {
 }
 
 func (l *Log) setup() error {
-	files, err := ioutil.ReadDir(l.Dir)
+	m, err := readManifest(l.Dir)
 	if err != nil {
-		return err
+		zap.L().Named("log").Warn(
+			"recovering segments from the directory", zap.String("dir", l.Dir), zap.Error(err),
+		)
 	}
-	baseOffsets := make([]uint64, 0, len(files))
-	for _, file := range files {
-		offstr := strings.TrimSuffix(file.Name(), path.Ext(file.Name()))
-		off, _ := strconv.ParseUint(offstr, 10, 0)
-		baseOffsets = append(baseOffsets, off)
-	}
-	sort.Slice(baseOffsets, func(i, j int) bool {
-		return baseOffsets[i] < baseOffsets[j]
-	})
-	for i := 0; i < len(baseOffsets); i++ {
-		if err := l.newSegment(baseOffsets[i]); err != nil {
+	if m == nil {
+		if m, err = scanSegments(l.Dir); err != nil {
 			return err
 		}
-		// baseOffsets contains duplicate for store and index file, skip
-		i++
+	}
+	for _, ms := range m.Segments {
+		// segments offloaded after the manifest was last written only have
+		// their .remote file
+		remote := ms.State == segmentRemote
+		if !remote {
+			_, err := os.Stat(segmentFile(l.Dir, ms.BaseOffset, ".store"))
+			if os.IsNotExist(err) {
+				_, err = os.Stat(segmentFile(l.Dir, ms.BaseOffset, ".remote"))
+				remote = err == nil
+			}
+		}
+		if !remote {
+			if err := l.openSegment(ms.BaseOffset); err != nil {
+				return err
+			}
+			continue
+		}
+		s, err := openRemoteSegment(l.Dir, ms.BaseOffset, l.Config)
+		if err != nil {
+			return err
+		}
+		l.segments = append(l.segments, s)
 	}
 	if l.segments == nil {
 		if err := l.newSegment(l.Config.Segment.InitialOffset); err != nil {
 			return err
 		}
+	} else if last := l.segments[len(l.segments)-1]; !last.local() {
+		if err := l.newSegment(last.next()); err != nil {
+			return err
+		}
+	} else if err := l.manifest().write(l.Dir); err != nil {
+		return err
+	}
+	if next := l.segments[len(l.segments)-1].next(); next < m.HighWaterMark {
+		zap.L().Named("log").Warn(
+			"log is missing records it had when it was closed",
+			zap.String("dir", l.Dir),
+			zap.Uint64("high_water_mark", m.HighWaterMark),
+			zap.Uint64("next_offset", next),
+		)
+	}
+	if l.Config.Tier.Store != nil {
+		if l.cache, err = newSegmentCache(path.Join(l.Dir, cacheDir), l.Config); err != nil {
+			return err
+		}
+		l.startOffloading()
+	}
+	if l.Config.Segment.MaxAge > 0 {
+		l.startRolling()
 	}
 	return nil
 }
 
+// newSegment rolls the log onto a new active segment from off. The
+// manifest lists the segment before its files are created, which are
+// created empty when the log's opened if they never were.
 func (l *Log) newSegment(off uint64) error {
+	m := l.manifest()
+	if n := len(m.Segments); n > 0 && m.Segments[n-1].State == segmentActive {
+		m.Segments[n-1].State = segmentClosed
+	}
+	m.Segments = append(m.Segments, manifestSegment{BaseOffset: off, State: segmentActive})
+	m.HighWaterMark = off
+	if err := m.write(l.Dir); err != nil {
+		return err
+	}
+	return l.openSegment(off)
+}
+
+// openSegment opens the segment from off as the active segment
+func (l *Log) openSegment(off uint64) error {
 	s, err := newSegment(l.Dir, off, l.Config)
 	if err != nil {
 		return err
@@ -74,39 +136,156 @@ func (l *Log) newSegment(off uint64) error {
 
 // Append adds a record to the Log
 func (l *Log) Append(record *api.Record) (uint64, error) {
-	l.mu.Lock()
-	defer l.mu.Unlock()
+	return l.append(tracing.Extract(context.Background(), record), record)
+}
+
+func (l *Log) append(ctx context.Context, record *api.Record) (off uint64, err error) {
+	_, span := startSpan(ctx, "segment.Append")
+	defer func() { endSpan(span, err) }()
 
-	off, err := l.activeSegment.Append(record)
+	// appends only hold the lock for writing to roll the active segment,
+	// so reads carry on while records are appended
+	l.appendMu.Lock()
+	defer l.appendMu.Unlock()
+
+	l.mu.RLock()
+	s := l.activeSegment
+	// a record bigger than a segment gets a segment of its own, rather than
+	// growing the active one to many times its max, and records aren't
+	// added to segments past their max age
+	if !s.fits(record) || s.expired() {
+		l.mu.RUnlock()
+		if err = l.roll(s, s.next()); err != nil {
+			return 0, err
+		}
+		l.mu.RLock()
+		s = l.activeSegment
+	}
+	off, err = s.Append(record)
+	// a truncate can close s as soon as the lock's released
+	maxed := err == nil && s.IsMaxed()
+	l.mu.RUnlock()
 	if err != nil {
 		return 0, err
 	}
-	if l.activeSegment.IsMaxed() {
-		err = l.newSegment(off + 1)
+	span.SetAttributes(attribute.Int64("offset", int64(off)))
+	if maxed {
+		err = l.roll(s, off+1)
 	}
 	return off, err
 }
 
+// roll replaces the active segment s with a new segment from off, unless
+// it's been replaced already by truncating the log
+func (l *Log) roll(s *segment, off uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.activeSegment != s {
+		return nil
+	}
+	// closed segments are read from their files, by offloads and backups
+	if err := s.store.flush(); err != nil {
+		return err
+	}
+	return l.newSegment(off)
+}
+
+// rollExpired rolls the active segment if it's past its max age
+func (l *Log) rollExpired() error {
+	l.appendMu.Lock()
+	defer l.appendMu.Unlock()
+
+	l.mu.RLock()
+	s := l.activeSegment
+	l.mu.RUnlock()
+	if s == nil || !s.expired() {
+		return nil
+	}
+	return l.roll(s, s.next())
+}
+
+// startRolling rolls the active segment once it's past its max age, even
+// if nothing's appended to it, until Close
+func (l *Log) startRolling() {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	l.stopRolling = func() {
+		cancel()
+		<-done
+	}
+	go func() {
+		defer close(done)
+		// segments are rolled within a tenth of their max age of expiring
+		interval := l.Config.Segment.MaxAge / 10
+		if interval == 0 {
+			interval = l.Config.Segment.MaxAge
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if err := l.rollExpired(); err != nil {
+				zap.L().Named("log").Error(
+					"failed to roll segment", zap.String("dir", l.Dir), zap.Error(err),
+				)
+			}
+		}
+	}()
+}
+
 // Read returns the record at the given offset
 func (l *Log) Read(off uint64) (*api.Record, error) {
+	return l.ReadContext(context.Background(), off)
+}
+
+// ReadContext returns the record at the given offset, tracing the read as
+// part of the trace in ctx
+func (l *Log) ReadContext(ctx context.Context, off uint64) (_ *api.Record, err error) {
+	_, span := startSpan(ctx, "segment.Read")
+	span.SetAttributes(attribute.Int64("offset", int64(off)))
+	defer func() { endSpan(span, err) }()
+
 	l.mu.RLock()
+	s := l.segmentFor(off)
+	if s == nil {
+		defer l.mu.RUnlock()
+		return nil, l.outOfRange(off)
+	}
+	if !s.local() {
+		// remote segments are downloaded without holding up appends
+		l.mu.RUnlock()
+		return l.readRemote(ctx, s, off)
+	}
 	defer l.mu.RUnlock()
-	var s *segment
+	return s.Read(off)
+}
 
+// segmentFor returns the segment holding the record at off, or nil. The
+// caller must hold the lock.
+func (l *Log) segmentFor(off uint64) *segment {
 	for _, segment := range l.segments {
-		if segment.baseOffset <= off && off < segment.nextOffset {
-			s = segment
-			break
+		if segment.baseOffset <= off && off < segment.next() {
+			return segment
 		}
 	}
-	if s == nil || s.nextOffset <= off {
-		return nil, api.ErrOffsetOutOfRange{Offset: off}
-	}
-	return s.Read(off)
+	return nil
 }
 
 // Close will close the Log
 func (l *Log) Close() error {
+	if l.stopOffloading != nil {
+		l.stopOffloading()
+		l.stopOffloading = nil
+	}
+	if l.stopRolling != nil {
+		l.stopRolling()
+		l.stopRolling = nil
+	}
+
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
@@ -115,25 +294,91 @@ func (l *Log) Close() error {
 			return err
 		}
 	}
-	return nil
+	if err := l.cache.close(); err != nil {
+		return err
+	}
+	// the manifest's high-water mark is brought up to date
+	if l.segments == nil {
+		return nil
+	}
+	return l.manifest().write(l.Dir)
 }
 
-// Remove will close the Log and remove any files
+// Remove will close the Log and remove any files, including the files of
+// segments offloaded to the object store
 func (l *Log) Remove() error {
 	if err := l.Close(); err != nil {
 		return err
 	}
+	for _, s := range l.segments {
+		if s.remote == nil {
+			continue
+		}
+		if err := l.deleteRemote(context.Background(), s); err != nil {
+			return err
+		}
+	}
+	l.segments, l.activeSegment = nil, nil
 	return os.RemoveAll(l.Dir)
 }
 
-// Reset will clear the Log
+// Reset will clear the Log to start again from Config.Segment.InitialOffset.
+// Only its local state is dropped: the offloaded segments that run on from
+// the initial offset are kept, for the log to carry on from the end of them
+// rather than writing their records locally again, and only the offloaded
+// segments it doesn't keep are removed from the object store.
 func (l *Log) Reset() error {
-	if err := l.Remove(); err != nil {
+	if err := l.Close(); err != nil {
 		return err
 	}
+	var kept []*segment
+	for _, s := range l.segments {
+		switch {
+		case s.remote == nil:
+			continue
+		case len(kept) == 0 && s.baseOffset <= l.Config.Segment.InitialOffset &&
+			s.next() > l.Config.Segment.InitialOffset:
+		case len(kept) > 0 && s.baseOffset == kept[len(kept)-1].next():
+		default:
+			if err := l.deleteRemote(context.Background(), s); err != nil {
+				return err
+			}
+			continue
+		}
+		kept = append(kept, s)
+	}
+	l.segments, l.activeSegment = nil, nil
+	if err := os.RemoveAll(l.Dir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(l.Dir, 0755); err != nil {
+		return err
+	}
+	for _, s := range kept {
+		if err := writeRemoteSegment(l.Dir, s.baseOffset, s.remote); err != nil {
+			return err
+		}
+	}
 	return l.setup()
 }
 
+// nextOffset returns the offset the next record is appended at
+func (l *Log) nextOffset() uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.segments[len(l.segments)-1].next()
+}
+
+// outOfRange returns the error for an offset that isn't in any segment,
+// with the log's range. The caller must hold the lock.
+func (l *Log) outOfRange(off uint64) error {
+	return api.ErrOffsetOutOfRange{
+		Offset: off,
+		Lowest: l.segments[0].baseOffset,
+		Next:   l.segments[len(l.segments)-1].next(),
+	}
+}
+
 // LowestOffset will return the lowest offset of the Log
 func (l *Log) LowestOffset() (uint64, error) {
 	l.mu.RLock()
@@ -147,53 +392,82 @@ func (l *Log) HighestOffset() (uint64, error) {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
 
-	off := l.segments[len(l.segments)-1].nextOffset
+	off := l.segments[len(l.segments)-1].next()
 	if off == 0 {
 		return 0, nil
 	}
 	return uint64(off - 1), nil
 }
 
+// Stats describes the size and offsets of a Log. Bytes are the bytes on
+// local disk, RemoteBytes those of segments only in the object store.
+type Stats struct {
+	Segments       int
+	Bytes          uint64
+	RemoteSegments int
+	RemoteBytes    uint64
+	LowestOffset   uint64
+	HighestOffset  uint64
+}
+
+// Stats returns the number of segments and store bytes in the Log along
+// with its lowest and highest offsets
+func (l *Log) Stats() Stats {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	stats := Stats{
+		Segments:     len(l.segments),
+		LowestOffset: l.segments[0].baseOffset,
+	}
+	for _, s := range l.segments {
+		if !s.local() {
+			stats.RemoteSegments++
+			stats.RemoteBytes += s.remote.Bytes
+			continue
+		}
+		stats.Bytes += s.store.Size()
+	}
+	if off := l.segments[len(l.segments)-1].next(); off > 0 {
+		stats.HighestOffset = off - 1
+	}
+	return stats
+}
+
 // Truncate removes all segments from the log whose highest offset is lower
 // than `lowest`
 func (l *Log) Truncate(lowest uint64) error {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
+	var removed []*segment
 	segments := make([]*segment, 0, len(l.segments))
 	for _, s := range l.segments {
-		if s.nextOffset <= lowest+1 {
-			if err := s.Remove(); err != nil {
-				return err
-			}
+		if s.next() <= lowest+1 {
+			removed = append(removed, s)
 			continue
 		}
 		segments = append(segments, s)
 	}
+	// the segments are left out of the manifest before they're removed, so
+	// a crash only leaves files behind
 	l.segments = segments
-	return nil
-}
-
-// Reader returns an io.Reader to read the entire Log
-func (l *Log) Reader() io.Reader {
-	l.mu.RLock()
-	defer l.mu.RUnlock()
-
-	readers := make([]io.Reader, len(l.segments))
-	for i, segment := range l.segments {
-		readers[i] = &originReader{segment.store, 0}
+	if err := l.manifest().write(l.Dir); err != nil {
+		return err
 	}
-	return io.MultiReader(readers...)
-}
-
-type originReader struct {
-	*store
-	off int64
-}
-
-// Read implements the io.Reader interface
-func (o *originReader) Read(p []byte) (n int, err error) {
-	n, err = o.ReadAt(p, o.off)
-	o.off += int64(n)
-	return n, err
+	for _, s := range removed {
+		if s.remote != nil {
+			if err := l.deleteRemote(context.Background(), s); err != nil {
+				return err
+			}
+		}
+		if err := s.Remove(); err != nil {
+			return err
+		}
+	}
+	// a log truncated past its last record carries on from where it was
+	if len(l.segments) == 0 {
+		return l.newSegment(removed[len(removed)-1].next())
+	}
+	return nil
 }
@@ -1,12 +1,23 @@
 package log
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
 	api "github.com/michael-diggin/proglog/api/v1"
+	"github.com/michael-diggin/proglog/internal/tracing"
 	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 	"google.golang.org/protobuf/proto"
 )
 
@@ -19,6 +30,10 @@ func TestLog(t *testing.T) {
 		"init with existing segments": testInitExisting,
 		"reader":                      testReader,
 		"truncate":                    testTruncate,
+		"stats":                       testStats,
+		"traces records":              testTraces,
+		"large record rolls segment":  testLargeRecord,
+		"concurrent reads":            testConcurrentReads,
 	} {
 		t.Run(scenario, func(t *testing.T) {
 			dir, err := ioutil.TempDir("", "store-test")
@@ -116,3 +131,263 @@ func testTruncate(t *testing.T, log *Log) {
 	_, err = log.Read(0)
 	require.Error(t, err)
 }
+
+func testStats(t *testing.T, log *Log) {
+	require.Equal(t, Stats{Segments: 1}, log.Stats())
+
+	append := &api.Record{
+		Value: []byte("hello world"),
+	}
+	var bytes uint64
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(append)
+		require.NoError(t, err)
+		// the record's offset is set by Append
+		bytes += uint64(proto.Size(append)) + lenWidth
+	}
+
+	stats := log.Stats()
+	require.Equal(t, 2, stats.Segments)
+	require.Equal(t, bytes, stats.Bytes)
+	require.Equal(t, uint64(0), stats.LowestOffset)
+	require.Equal(t, uint64(2), stats.HighestOffset)
+}
+
+func testLargeRecord(t *testing.T, log *Log) {
+	_, err := log.Append(&api.Record{Value: []byte("small")})
+	require.NoError(t, err)
+	large := &api.Record{Value: bytes.Repeat([]byte("a"), 100)}
+	off, err := log.Append(large)
+	require.NoError(t, err)
+	_, err = log.Append(&api.Record{Value: []byte("small")})
+	require.NoError(t, err)
+
+	// the large record has a segment to itself
+	require.Equal(t, 3, log.Stats().Segments)
+	require.Equal(t, off, log.segments[1].baseOffset)
+	require.Equal(t, off+1, log.segments[1].nextOffset)
+	record, err := log.Read(off)
+	require.NoError(t, err)
+	require.Equal(t, large.Value, record.Value)
+}
+
+func testConcurrentReads(t *testing.T, log *Log) {
+	const records = 50
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// readers see each record whole as soon as it's appended
+			var off uint64
+			for off < records {
+				record, err := log.Read(off)
+				if _, ok := err.(api.ErrOffsetOutOfRange); ok {
+					continue
+				}
+				require.NoError(t, err)
+				require.Equal(t, off, record.Offset)
+				require.Equal(t, []byte(fmt.Sprintf("record %d", off)), record.Value)
+				off++
+			}
+		}()
+	}
+	for i := 0; i < records; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	wg.Wait()
+	require.True(t, log.Stats().Segments > 1)
+}
+
+func testTraces(t *testing.T, log *Log) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	// records without a trace aren't traced
+	off, err := log.Append(&api.Record{Value: []byte("untraced")})
+	require.NoError(t, err)
+	_, err = log.Read(off)
+	require.NoError(t, err)
+	require.Empty(t, recorder.Ended())
+
+	ctx, span := otel.Tracer("test").Start(context.Background(), "produce")
+	record := &api.Record{Value: []byte("traced")}
+	tracing.Inject(ctx, record)
+	off, err = log.Append(record)
+	require.NoError(t, err)
+	_, err = log.ReadContext(ctx, off)
+	require.NoError(t, err)
+	span.End()
+
+	var names []string
+	for _, s := range recorder.Ended() {
+		require.Equal(t, span.SpanContext().TraceID(), s.SpanContext().TraceID())
+		names = append(names, s.Name())
+	}
+	require.Equal(t, []string{"segment.Append", "segment.Read", "produce"}, names)
+}
+
+func TestEncryptedLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "encrypted-log-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// records are written unencrypted until a keyring is configured
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	_, err = log.Append(&api.Record{Value: []byte("plaintext")})
+	require.NoError(t, err)
+	require.NoError(t, log.Close())
+
+	keyfile := filepath.Join(dir, "keys")
+	key := base64.StdEncoding.EncodeToString(make([]byte, 32))
+	require.NoError(t, ioutil.WriteFile(keyfile, []byte("1 "+key+"\n"), 0600))
+	c.Keyring, err = LoadKeyring(keyfile)
+	require.NoError(t, err)
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	_, err = log.Append(&api.Record{Value: []byte("secret")})
+	require.NoError(t, err)
+	require.NoError(t, log.Close())
+
+	// rotate to key 2, segments encrypted with key 1 stay readable
+	rotated := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	require.NoError(t, ioutil.WriteFile(keyfile, []byte(
+		"# retired\n1 "+key+"\n2 "+rotated+"\n",
+	), 0600))
+	c.Keyring, err = LoadKeyring(keyfile)
+	require.NoError(t, err)
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	_, err = log.Append(&api.Record{Value: []byte("rotated")})
+	require.NoError(t, err)
+
+	for off, want := range []string{"plaintext", "secret", "rotated"} {
+		record, err := log.Read(uint64(off))
+		require.NoError(t, err)
+		require.Equal(t, want, string(record.Value))
+	}
+	for base, id := range map[int]string{1: "1", 2: "2"} {
+		b, err := ioutil.ReadFile(filepath.Join(dir, fmt.Sprintf("%d.key", base)))
+		require.NoError(t, err)
+		require.Equal(t, id, string(b))
+	}
+	stores, err := filepath.Glob(filepath.Join(dir, "*.store"))
+	require.NoError(t, err)
+	for _, store := range stores {
+		b, err := ioutil.ReadFile(store)
+		require.NoError(t, err)
+		require.NotContains(t, string(b), "secret")
+		require.NotContains(t, string(b), "rotated")
+	}
+
+	// snapshots read records decrypted
+	b, err := ioutil.ReadAll(log.Reader())
+	require.NoError(t, err)
+	var values []string
+	for len(b) > 0 {
+		size := enc.Uint64(b)
+		record := &api.Record{}
+		require.NoError(t, proto.Unmarshal(b[lenWidth:lenWidth+size], record))
+		values = append(values, string(record.Value))
+		b = b[lenWidth+size:]
+	}
+	require.Equal(t, []string{"plaintext", "secret", "rotated"}, values)
+	require.NoError(t, log.Close())
+
+	c.Keyring = nil
+	_, err = NewLog(dir, c)
+	require.Error(t, err)
+}
+
+// BenchmarkParallelRead reads records from closed segments on every core
+// while records are appended
+func BenchmarkParallelRead(b *testing.B) {
+	dir, err := ioutil.TempDir("", "read-bench")
+	require.NoError(b, err)
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1 << 20
+	c.Segment.MaxIndexBytes = 1 << 20
+	log, err := NewLog(dir, c)
+	require.NoError(b, err)
+	const records = 10000
+	for i := 0; i < records; i++ {
+		_, err := log.Append(&api.Record{Value: jsonPayload(i)})
+		require.NoError(b, err)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if _, err := log.Append(&api.Record{Value: jsonPayload(0)}); err != nil {
+				return
+			}
+		}
+	}()
+	b.ReportAllocs()
+	b.SetBytes(int64(len(jsonPayload(0))))
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		var i uint64
+		for pb.Next() {
+			if _, err := log.Read(i % records); err != nil {
+				b.Fatal(err)
+			}
+			i += 7
+		}
+	})
+}
+
+func TestLogMaxAge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "max-age-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// quiet logs roll their active segment in the background
+	c := Config{}
+	c.Segment.MaxAge = 50 * time.Millisecond
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	require.Never(t, func() bool {
+		return log.Stats().Segments > 1
+	}, 100*time.Millisecond, 10*time.Millisecond)
+	_, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return log.Stats().Segments == 2
+	}, time.Second, 10*time.Millisecond)
+	require.NoError(t, log.Remove())
+	require.NoError(t, os.MkdirAll(dir, 0755))
+
+	// the first append time is kept in the segment, and appends roll
+	// segments past their max age before adding to them
+	c.Segment.MaxAge = time.Hour
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	_, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	created := log.activeSegment.index.created()
+	require.WithinDuration(t, time.Now(), created, time.Minute)
+	log.activeSegment.index.setCreated(created.Add(-2 * time.Hour))
+	require.NoError(t, log.Close())
+
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Remove()
+	require.True(t, log.activeSegment.expired())
+	off, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+	require.Equal(t, 2, log.Stats().Segments)
+	require.False(t, log.activeSegment.expired())
+}
@@ -0,0 +1,157 @@
+package log
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// manifestFile lists the log's segments, so they're opened without
+	// going by the names of the files in the log's directory
+	manifestFile    = "manifest.json"
+	manifestVersion = 1
+)
+
+type segmentState string
+
+const (
+	segmentActive segmentState = "active"
+	segmentClosed segmentState = "closed"
+	// segmentRemote segments only have their .remote file on local disk
+	segmentRemote segmentState = "remote"
+)
+
+// manifest is the log's record of its segments, in order of base offset.
+// It's rewritten whenever segments are added, removed or offloaded, and as
+// the log's closed.
+type manifest struct {
+	Version int `json:"version"`
+	// HighWaterMark is the offset after the log's last record as of when
+	// the manifest was written
+	HighWaterMark uint64            `json:"high_water_mark"`
+	Segments      []manifestSegment `json:"segments"`
+}
+
+type manifestSegment struct {
+	BaseOffset uint64       `json:"base_offset"`
+	State      segmentState `json:"state"`
+}
+
+// readManifest returns the manifest in dir, or nil if there isn't one
+func readManifest(dir string) (*manifest, error) {
+	b, err := ioutil.ReadFile(path.Join(dir, manifestFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	m := &manifest{}
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %w", err)
+	}
+	if m.Version != manifestVersion {
+		return nil, fmt.Errorf("unsupported manifest version %d", m.Version)
+	}
+	return m, nil
+}
+
+// scanSegments recovers the manifest of the segments in dir from the
+// names of their files. Every segment has a store file, alongside its
+// index and key files, unless it's been offloaded and only has a remote
+// file.
+func scanSegments(dir string) (*manifest, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	states := make(map[uint64]segmentState)
+	for _, file := range files {
+		ext := path.Ext(file.Name())
+		if ext != ".store" && ext != ".remote" {
+			continue
+		}
+		off, err := strconv.ParseUint(strings.TrimSuffix(file.Name(), ext), 10, 64)
+		if err != nil {
+			zap.L().Named("log").Warn(
+				"ignoring file that isn't a segment's",
+				zap.String("dir", dir), zap.String("file", file.Name()),
+			)
+			continue
+		}
+		if ext == ".store" {
+			states[off] = segmentClosed
+		} else if states[off] == "" {
+			states[off] = segmentRemote
+		}
+	}
+	m := &manifest{Version: manifestVersion}
+	for off, state := range states {
+		m.Segments = append(m.Segments, manifestSegment{BaseOffset: off, State: state})
+	}
+	sort.Slice(m.Segments, func(i, j int) bool {
+		return m.Segments[i].BaseOffset < m.Segments[j].BaseOffset
+	})
+	return m, nil
+}
+
+// manifest returns the manifest of the log's segments, the last of which
+// is the active one if it's local
+func (l *Log) manifest() *manifest {
+	m := &manifest{Version: manifestVersion}
+	for i, s := range l.segments {
+		state := segmentClosed
+		switch {
+		case !s.local():
+			state = segmentRemote
+		case i == len(l.segments)-1:
+			state = segmentActive
+		}
+		m.Segments = append(m.Segments, manifestSegment{BaseOffset: s.baseOffset, State: state})
+		m.HighWaterMark = s.next()
+	}
+	return m
+}
+
+// write replaces the manifest in dir, atomically so a crash leaves either
+// the old manifest or the new one
+func (m *manifest) write(dir string) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, manifestFile+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), path.Join(dir, manifestFile)); err != nil {
+		return err
+	}
+	// the rename is only durable once the directory's synced
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,120 @@
+package log
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	api "github.com/michael-diggin/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "manifest-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 32
+	c.Tier.Store = newMemStore()
+	c.Tier.Interval = time.Hour
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	// segments hold two records
+	for i := 0; i < 4; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+
+	// the manifest lists segments as they're rolled and offloaded
+	m, err := readManifest(dir)
+	require.NoError(t, err)
+	require.Equal(t, []manifestSegment{
+		{BaseOffset: 0, State: segmentClosed},
+		{BaseOffset: 2, State: segmentClosed},
+		{BaseOffset: 4, State: segmentActive},
+	}, m.Segments)
+	require.NoError(t, log.Offload(context.Background()))
+	m, err = readManifest(dir)
+	require.NoError(t, err)
+	require.Equal(t, []manifestSegment{
+		{BaseOffset: 0, State: segmentRemote},
+		{BaseOffset: 2, State: segmentRemote},
+		{BaseOffset: 4, State: segmentActive},
+	}, m.Segments)
+
+	require.NoError(t, log.Truncate(1))
+	m, err = readManifest(dir)
+	require.NoError(t, err)
+	require.Len(t, m.Segments, 2)
+	require.Equal(t, uint64(2), m.Segments[0].BaseOffset)
+
+	// files that aren't in the manifest aren't opened
+	require.NoError(t, log.Close())
+	m, err = readManifest(dir)
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), m.HighWaterMark)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "100.store"), nil, 0644))
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	require.Equal(t, 2, log.Stats().Segments)
+	off, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), off)
+	require.NoError(t, log.Close())
+}
+
+func TestManifestRecovery(t *testing.T) {
+	for scenario, damage := range map[string]func(t *testing.T, dir string){
+		"missing": func(t *testing.T, dir string) {
+			require.NoError(t, os.Remove(filepath.Join(dir, manifestFile)))
+		},
+		"corrupt": func(t *testing.T, dir string) {
+			require.NoError(t, ioutil.WriteFile(filepath.Join(dir, manifestFile), []byte("{"), 0644))
+		},
+		"unsupported version": func(t *testing.T, dir string) {
+			require.NoError(t, ioutil.WriteFile(
+				filepath.Join(dir, manifestFile), []byte(`{"version":99}`), 0644,
+			))
+		},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "manifest-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			c := Config{}
+			c.Segment.MaxStoreBytes = 32
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+			for i := 0; i < 3; i++ {
+				_, err := log.Append(&api.Record{Value: []byte("hello world")})
+				require.NoError(t, err)
+			}
+			require.NoError(t, log.Close())
+
+			// the segments are found from the directory, skipping files
+			// that aren't named for a base offset, and the manifest's
+			// rewritten
+			damage(t, dir)
+			require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "notes.store"), nil, 0644))
+			log, err = NewLog(dir, c)
+			require.NoError(t, err)
+			defer log.Close()
+			require.Equal(t, 2, log.Stats().Segments)
+			for off := uint64(0); off < 3; off++ {
+				_, err := log.Read(off)
+				require.NoError(t, err)
+			}
+			m, err := readManifest(dir)
+			require.NoError(t, err)
+			require.Equal(t, []manifestSegment{
+				{BaseOffset: 0, State: segmentClosed},
+				{BaseOffset: 2, State: segmentActive},
+			}, m.Segments)
+		})
+	}
+}
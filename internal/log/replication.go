@@ -0,0 +1,59 @@
+package log
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// FollowerStats describes how far a follower is behind the leader, as the
+// leader last heard from it
+type FollowerStats struct {
+	// LastIndex is the index of the last entry in the follower's raft log
+	LastIndex uint64
+	// LastContact is when the follower last answered the leader
+	LastContact time.Time
+}
+
+// replicationTransport records the followers' answers to the leader's
+// appends. Heartbeats go through AppendEntries every tenth of the heartbeat
+// timeout even while entries are pipelined, so the pipeline's answers
+// aren't needed to keep the stats fresh.
+type replicationTransport struct {
+	*raft.NetworkTransport
+
+	mu        sync.Mutex
+	followers map[raft.ServerID]FollowerStats
+}
+
+func newReplicationTransport(t *raft.NetworkTransport) *replicationTransport {
+	return &replicationTransport{
+		NetworkTransport: t,
+		followers:        make(map[raft.ServerID]FollowerStats),
+	}
+}
+
+// AppendEntries sends the append and records the follower's answer
+func (t *replicationTransport) AppendEntries(
+	id raft.ServerID,
+	target raft.ServerAddress,
+	args *raft.AppendEntriesRequest,
+	resp *raft.AppendEntriesResponse,
+) error {
+	if err := t.NetworkTransport.AppendEntries(id, target, args, resp); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	t.followers[id] = FollowerStats{LastIndex: resp.LastLog, LastContact: time.Now()}
+	t.mu.Unlock()
+	return nil
+}
+
+// follower returns the stats recorded for the follower
+func (t *replicationTransport) follower(id raft.ServerID) (FollowerStats, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	stats, ok := t.followers[id]
+	return stats, ok
+}
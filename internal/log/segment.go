@@ -2,29 +2,49 @@ package log
 
 import (
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"path"
+	"sync/atomic"
+	"time"
 
 	api "github.com/michael-diggin/proglog/api/v1"
 	"google.golang.org/protobuf/proto"
 )
 
 type segment struct {
+	// nextOffset is stored atomically once a record's in the store and
+	// index, so readers only see whole records without holding the log's
+	// lock for writing. It comes first to be 64-bit aligned.
+	nextOffset uint64
+	dir        string
 	store      *store
 	index      *index
 	baseOffset uint64
-	nextOffset uint64
 	config     Config
+	// indexAt is the store position from which the next record appended
+	// gets an index entry
+	indexAt uint64
+	// keyFile records the ID of the key encrypting the store, if it is
+	keyFile string
+	// remote is set once the segment's been uploaded to the tier's object
+	// store. The store and index are nil once the local files are removed.
+	remote *remoteSegment
+	// removed is set once the segment's removed, with the log's lock held,
+	// so iterators reading it know to move on
+	removed bool
 }
 
 func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 	s := &segment{
+		dir:        dir,
 		baseOffset: baseOffset,
 		config:     c,
 	}
 
 	storeFile, err := os.OpenFile(
-		path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".store")),
+		segmentFile(dir, baseOffset, ".store"),
 		os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644,
 	)
 	if err != nil {
@@ -33,9 +53,13 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 	if s.store, err = newStore(storeFile); err != nil {
 		return nil, err
 	}
+	s.store.codec = c.Segment.Codec
+	if err = s.setupEncryption(dir); err != nil {
+		return nil, err
+	}
 
 	indexFile, err := os.OpenFile(
-		path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".index")),
+		segmentFile(dir, baseOffset, ".index"),
 		os.O_RDWR|os.O_CREATE, 0644,
 	)
 	if err != nil {
@@ -45,14 +69,87 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 		return nil, err
 	}
 
-	if off, _, err := s.index.Read(-1); err != nil {
+	if off, pos, err := s.index.Read(-1); err != nil {
 		s.nextOffset = s.baseOffset
 	} else {
-		s.nextOffset = baseOffset + uint64(off) + 1
+		// a sparse index doesn't have entries for the records after its
+		// last one, which are counted from the store, leaving out a record
+		// that was only partly written
+		s.nextOffset = baseOffset + off
+		s.indexAt = pos + c.Segment.IndexIntervalBytes
+		for pos < s.store.Size() {
+			end, err := s.store.frameEnd(pos)
+			if err == io.EOF || end > s.store.Size() {
+				// a partly written record is left out, and the next
+				// record gets an entry so scans never reach it
+				s.indexAt = 0
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			pos = end
+			s.nextOffset++
+		}
+	}
+	// indexes migrated from before append times were recorded go by when
+	// the store was last written
+	if s.index.created().IsZero() && s.index.size > 0 {
+		fi, err := s.store.Stat()
+		if err != nil {
+			return nil, err
+		}
+		s.index.setCreated(fi.ModTime())
+	}
+	if s.remote, err = readRemoteSegment(dir, baseOffset); err != nil {
+		return nil, err
 	}
 	return s, nil
 }
 
+// segmentFile returns the path of the segment's file with the extension
+func segmentFile(dir string, baseOffset uint64, ext string) string {
+	return path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ext))
+}
+
+// local returns whether the segment's files are on local disk
+func (s *segment) local() bool {
+	return s.store != nil
+}
+
+// setupEncryption encrypts the store with the key recorded for the segment.
+// Segments without records are given the keyring's active key, existing
+// segments without a key are left unencrypted.
+func (s *segment) setupEncryption(dir string) error {
+	keyFile := segmentFile(dir, s.baseOffset, ".key")
+	id, err := ioutil.ReadFile(keyFile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	switch {
+	case s.store.Size() == 0 && s.config.Keyring == nil:
+		if err == nil {
+			return os.Remove(keyFile)
+		}
+		return nil
+	case s.store.Size() == 0:
+		id = []byte(s.config.Keyring.active)
+		if err := ioutil.WriteFile(keyFile, id, 0644); err != nil {
+			return err
+		}
+	case os.IsNotExist(err):
+		return nil
+	case s.config.Keyring == nil:
+		return fmt.Errorf("segment %d is encrypted but there's no keyring", s.baseOffset)
+	}
+	s.store.aead, err = s.config.Keyring.aead(string(id))
+	if err != nil {
+		return fmt.Errorf("segment %d: %w", s.baseOffset, err)
+	}
+	s.keyFile = keyFile
+	return nil
+}
+
 // Append writes the record to the segment and returns the offset
 func (s *segment) Append(record *api.Record) (offset uint64, err error) {
 	cur := s.nextOffset
@@ -65,22 +162,33 @@ func (s *segment) Append(record *api.Record) (offset uint64, err error) {
 	if err != nil {
 		return 0, err
 	}
-	if err = s.index.Write(
-		// index offsets are relative to the base offset
-		uint32(s.nextOffset-uint64(s.baseOffset)),
-		pos,
-	); err != nil {
-		return 0, err
+	if s.index.size == 0 {
+		s.index.setCreated(time.Now())
+	}
+	if s.index.size == 0 || pos >= s.indexAt {
+		if err = s.index.Write(
+			// index offsets are relative to the base offset
+			cur-s.baseOffset,
+			pos,
+		); err != nil {
+			return 0, err
+		}
+		s.indexAt = pos + s.config.Segment.IndexIntervalBytes
 	}
-	s.nextOffset++
+	atomic.StoreUint64(&s.nextOffset, cur+1)
 	return cur, nil
 }
 
+// next returns the offset after the segment's last record
+func (s *segment) next() uint64 {
+	return atomic.LoadUint64(&s.nextOffset)
+}
+
 // Read returns the record at a given offset
 func (s *segment) Read(off uint64) (*api.Record, error) {
-	_, pos, err := s.index.Read(int64(off - s.baseOffset))
+	pos, err := s.position(off)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read from index: %w", err)
+		return nil, err
 	}
 	p, err := s.store.Read(pos)
 	if err != nil {
@@ -91,14 +199,77 @@ func (s *segment) Read(off uint64) (*api.Record, error) {
 	return record, err
 }
 
-// IsMaxed returns whether the segement has reached its max size
+// position returns the store position of the record at off, scanning the
+// store from the index entry before it if it doesn't have one
+func (s *segment) position(off uint64) (uint64, error) {
+	rel := off - s.baseOffset
+	entry, pos, err := s.index.Find(rel)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read from index: %w", err)
+	}
+	for ; entry < rel; entry++ {
+		if pos, err = s.store.frameEnd(pos); err != nil {
+			return 0, fmt.Errorf("failed to read from store:%w", err)
+		}
+	}
+	return pos, nil
+}
+
+// fits returns false if the segment has records and the record, going by
+// its uncompressed size, is bigger than a whole store. Records that are
+// only bigger than the room left still fit, the segment rolls after them.
+func (s *segment) fits(record *api.Record) bool {
+	if s.store.Size() == 0 {
+		return true
+	}
+	return lenWidth+uint64(proto.Size(record)) <= s.config.Segment.MaxStoreBytes
+}
+
+// created returns when the segment's first record was appended, or the
+// zero time if it's empty or that isn't known
+func (s *segment) created() time.Time {
+	if !s.local() {
+		return s.remote.Created
+	}
+	return s.index.created()
+}
+
+// expired returns whether the segment's first record was appended longer
+// ago than the segment's max age
+func (s *segment) expired() bool {
+	if s.config.Segment.MaxAge == 0 || !s.local() {
+		return false
+	}
+	created := s.index.created()
+	return !created.IsZero() && time.Since(created) >= s.config.Segment.MaxAge
+}
+
+// IsMaxed returns whether the segement has reached its max size, or its
+// index has no room for another entry
 func (s *segment) IsMaxed() bool {
-	return s.store.size >= s.config.Segment.MaxStoreBytes ||
-		s.index.size >= s.config.Segment.MaxIndexBytes
+	return s.store.Size() >= s.config.Segment.MaxStoreBytes ||
+		headerWidth+s.index.size+entWidth > s.config.Segment.MaxIndexBytes
 }
 
-// Remove closes the segment and removes the store and index files
+// Remove closes the segment and removes its files, including the record
+// of it being offloaded but not the offloaded files themselves
 func (s *segment) Remove() error {
+	s.removed = true
+	if err := s.removeLocal(); err != nil {
+		return err
+	}
+	if s.remote != nil {
+		return os.Remove(segmentFile(s.dir, s.baseOffset, ".remote"))
+	}
+	return nil
+}
+
+// removeLocal closes the segment and removes the store, index and key
+// files, leaving an offloaded segment to be read from the object store
+func (s *segment) removeLocal() error {
+	if !s.local() {
+		return nil
+	}
 	if err := s.Close(); err != nil {
 		return err
 	}
@@ -108,11 +279,20 @@ func (s *segment) Remove() error {
 	if err := os.Remove(s.store.Name()); err != nil {
 		return err
 	}
+	if s.keyFile != "" {
+		if err := os.Remove(s.keyFile); err != nil {
+			return err
+		}
+	}
+	s.store, s.index, s.keyFile = nil, nil, ""
 	return nil
 }
 
 // Close will close the segment
 func (s *segment) Close() error {
+	if !s.local() {
+		return nil
+	}
 	if err := s.index.Close(); err != nil {
 		return err
 	}
@@ -18,7 +18,7 @@ func TestSegment(t *testing.T) {
 
 	c := Config{}
 	c.Segment.MaxStoreBytes = 1024
-	c.Segment.MaxIndexBytes = entWidth * 3
+	c.Segment.MaxIndexBytes = headerWidth + entWidth*3
 
 	s, err := newSegment(dir, 16, c)
 	require.NoError(t, err)
@@ -56,3 +56,47 @@ func TestSegment(t *testing.T) {
 	require.False(t, s.IsMaxed())
 
 }
+
+func TestSegmentSparseIndex(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "segment-test")
+	defer os.RemoveAll(dir)
+
+	want := &api.Record{Value: []byte("hello world")}
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+	c.Segment.IndexIntervalBytes = 64
+
+	s, err := newSegment(dir, 16, c)
+	require.NoError(t, err)
+	for i := uint64(0); i < 20; i++ {
+		off, err := s.Append(want)
+		require.NoError(t, err)
+		require.Equal(t, 16+i, off)
+	}
+	// an entry every 64 bytes of records taking up 23 bytes each
+	require.Equal(t, uint64(7), s.index.entries())
+
+	for off := uint64(16); off < 36; off++ {
+		got, err := s.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, got.Offset)
+		require.Equal(t, want.Value, got.Value)
+	}
+
+	// records after the last entry are counted from the store when the
+	// segment's reopened, dense or not
+	require.NoError(t, s.Close())
+	c.Segment.IndexIntervalBytes = 0
+	s, err = newSegment(dir, 16, c)
+	require.NoError(t, err)
+	require.Equal(t, uint64(36), s.nextOffset)
+	off, err := s.Append(want)
+	require.NoError(t, err)
+	require.Equal(t, uint64(36), off)
+	require.Equal(t, uint64(8), s.index.entries())
+	got, err := s.Read(35)
+	require.NoError(t, err)
+	require.Equal(t, uint64(35), got.Offset)
+}
@@ -2,22 +2,45 @@ package log
 
 import (
 	"bufio"
+	"crypto/cipher"
+	"crypto/rand"
 	"encoding/binary"
+	"fmt"
+	"io"
 	"os"
 	"sync"
+	"sync/atomic"
 )
 
 var enc = binary.BigEndian
 
 const (
 	lenWidth = 8
+	// codecShift puts a record's codec in the top byte of its frame's
+	// length, which lengths never reach
+	codecShift = 56
+	sizeMask   = 1<<codecShift - 1
 )
 
+// store appends records through a write buffer and reads them with pread,
+// so reads don't wait on appends or each other. Reads of bytes still in the
+// buffer flush it first, so appends are only written out as they're read
+// or as the buffer fills.
 type store struct {
+	// size is the bytes appended and flushed those in the file, both read
+	// atomically so they come first to be 64-bit aligned
+	size    uint64
+	flushed uint64
 	*os.File
-	mu   sync.Mutex
-	buf  *bufio.Writer
-	size uint64
+	// mu serializes appends and flushes of the buffer
+	mu  sync.Mutex
+	buf *bufio.Writer
+	// aead, if set, encrypts each record. Encrypted records are stored as
+	// the nonce followed by the sealed record, authenticated with their
+	// position so they can't be moved around the file.
+	aead cipher.AEAD
+	// codec compresses new records
+	codec Codec
 }
 
 func newStore(f *os.File) (*store, error) {
@@ -27,19 +50,40 @@ func newStore(f *os.File) (*store, error) {
 	}
 	size := uint64(fi.Size())
 	return &store{
-		File: f,
-		size: size,
-		buf:  bufio.NewWriter(f),
+		File:    f,
+		size:    size,
+		flushed: size,
+		buf:     bufio.NewWriter(f),
 	}, nil
 }
 
 // Append persist the bytes `p` to the store
 func (s *store) Append(p []byte) (n, pos uint64, err error) {
+	codec := s.codec
+	if codec != CodecNone {
+		c, err := codec.compress(p)
+		if err != nil {
+			return 0, 0, err
+		}
+		// keep records that don't compress as they are
+		if len(c) < len(p) {
+			p = c
+		} else {
+			codec = CodecNone
+		}
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	pos = s.size
-	if err := binary.Write(s.buf, enc, uint64(len(p))); err != nil {
+	pos = atomic.LoadUint64(&s.size)
+	if s.aead != nil {
+		if p, err = s.seal(p, pos, codec); err != nil {
+			return 0, 0, err
+		}
+	}
+	header := uint64(len(p)) | uint64(codec)<<codecShift
+	if err := binary.Write(s.buf, enc, header); err != nil {
 		return 0, 0, err
 	}
 	w, err := s.buf.Write(p)
@@ -47,46 +91,182 @@ func (s *store) Append(p []byte) (n, pos uint64, err error) {
 		return 0, 0, err
 	}
 	w += lenWidth
-	s.size += uint64(w)
+	size := atomic.AddUint64(&s.size, uint64(w))
+	// the buffer writes to the file as it fills, which readers can use
+	atomic.StoreUint64(&s.flushed, size-uint64(s.buf.Buffered()))
 	return uint64(w), pos, nil
 }
 
 // Read returns the record stored at a given position
 func (s *store) Read(pos uint64) ([]byte, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	b, _, err := s.readNext(pos)
+	return b, err
+}
 
-	if err := s.buf.Flush(); err != nil {
-		return nil, err
+// readNext returns the record stored at pos and the position of the record
+// after it
+func (s *store) readNext(pos uint64) ([]byte, uint64, error) {
+	b, codec, err := s.readFrame(pos)
+	if err != nil {
+		return nil, 0, err
+	}
+	next := pos + lenWidth + uint64(len(b))
+	if s.aead != nil {
+		if b, err = s.open(b, pos, codec); err != nil {
+			return nil, 0, err
+		}
 	}
+	if codec != CodecNone {
+		if b, err = codec.decompress(b); err != nil {
+			return nil, 0, fmt.Errorf("failed to decompress record at %d: %w", pos, err)
+		}
+	}
+	return b, next, nil
+}
+
+// readFrame returns the stored bytes of the record at pos and its codec
+func (s *store) readFrame(pos uint64) ([]byte, Codec, error) {
 	size := make([]byte, lenWidth)
-	if _, err := s.File.ReadAt(size, int64(pos)); err != nil {
-		return nil, err
+	if _, err := s.ReadAt(size, int64(pos)); err != nil {
+		return nil, 0, err
+	}
+	header := enc.Uint64(size)
+	if err := s.checkFrame(pos, header&sizeMask); err != nil {
+		return nil, 0, err
 	}
-	b := make([]byte, enc.Uint64(size))
-	if _, err := s.File.ReadAt(b, int64(pos+lenWidth)); err != nil {
+	b := make([]byte, header&sizeMask)
+	if _, err := s.ReadAt(b, int64(pos+lenWidth)); err != nil {
+		return nil, 0, err
+	}
+	return b, Codec(header >> codecShift), nil
+}
+
+func (s *store) seal(p []byte, pos uint64, codec Codec) ([]byte, error) {
+	nonce := make([]byte, s.aead.NonceSize(), s.aead.NonceSize()+len(p)+s.aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
 		return nil, err
 	}
-	return b, nil
+	return s.aead.Seal(nonce, nonce, p, additionalData(pos, codec)), nil
+}
+
+func (s *store) open(b []byte, pos uint64, codec Codec) ([]byte, error) {
+	if len(b) < s.aead.NonceSize() {
+		return nil, fmt.Errorf("encrypted record at %d is too short", pos)
+	}
+	nonce, sealed := b[:s.aead.NonceSize()], b[s.aead.NonceSize():]
+	p, err := s.aead.Open(sealed[:0], nonce, sealed, additionalData(pos, codec))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt record at %d: %w", pos, err)
+	}
+	return p, nil
+}
+
+// additionalData authenticates a record's position and, if it's
+// compressed, its codec
+func additionalData(pos uint64, codec Codec) []byte {
+	b := make([]byte, lenWidth, lenWidth+1)
+	enc.PutUint64(b, pos)
+	if codec != CodecNone {
+		b = append(b, byte(codec))
+	}
+	return b
 }
 
-// ReadAt reads len(p) bytes beginning at `off`
+// ReadAt reads len(p) bytes beginning at `off`, flushing the buffer if
+// they're in it, and returns io.EOF if they haven't all been appended
 func (s *store) ReadAt(p []byte, off int64) (int, error) {
+	end := uint64(off) + uint64(len(p))
+	if end > atomic.LoadUint64(&s.size) {
+		return 0, io.EOF
+	}
+	if err := s.flushTo(end); err != nil {
+		return 0, err
+	}
+	return s.File.ReadAt(p, off)
+}
+
+// flushTo flushes the buffer if the bytes up to end are still in it
+func (s *store) flushTo(end uint64) error {
+	if end <= atomic.LoadUint64(&s.flushed) {
+		return nil
+	}
+	return s.flush()
+}
+
+// checkFrame returns an error if the frame at pos, with a record of size
+// bytes, runs past the end of the store, as frames with corrupt lengths do
+func (s *store) checkFrame(pos, size uint64) error {
+	if end := atomic.LoadUint64(&s.size); size > end || pos+lenWidth > end-size {
+		return fmt.Errorf("record at %d is %d bytes, past the end of the store", pos, size)
+	}
+	return nil
+}
+
+// frameEnd returns the position after the frame at pos
+func (s *store) frameEnd(pos uint64) (uint64, error) {
+	header := make([]byte, lenWidth)
+	if _, err := s.ReadAt(header, int64(pos)); err != nil {
+		return 0, err
+	}
+	size := enc.Uint64(header) & sizeMask
+	if err := s.checkFrame(pos, size); err != nil {
+		return 0, err
+	}
+	return pos + lenWidth + size, nil
+}
+
+// flush writes the buffered records to the file
+func (s *store) flush() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-
 	if err := s.buf.Flush(); err != nil {
-		return 0, err
+		return err
 	}
-	return s.File.ReadAt(p, off)
+	atomic.StoreUint64(&s.flushed, atomic.LoadUint64(&s.size))
+	return nil
+}
+
+// Size returns the number of bytes in the store, including buffered writes
+func (s *store) Size() uint64 {
+	return atomic.LoadUint64(&s.size)
+}
+
+// recordReader reads the store's records from pos, decrypted and
+// decompressed, each preceded by its length
+type recordReader struct {
+	store *store
+	pos   uint64
+	// end, if set, is where the reader stops rather than the store's end
+	end uint64
+	buf []byte
+}
+
+func (d *recordReader) Read(p []byte) (int, error) {
+	if len(d.buf) == 0 {
+		if d.pos >= atomic.LoadUint64(&d.store.size) || (d.end > 0 && d.pos >= d.end) {
+			return 0, io.EOF
+		}
+		size := make([]byte, lenWidth)
+		if _, err := d.store.ReadAt(size, int64(d.pos)); err != nil {
+			return 0, err
+		}
+		record, err := d.store.Read(d.pos)
+		if err != nil {
+			return 0, err
+		}
+		d.pos += lenWidth + enc.Uint64(size)&sizeMask
+		d.buf = make([]byte, lenWidth, lenWidth+len(record))
+		enc.PutUint64(d.buf, uint64(len(record)))
+		d.buf = append(d.buf, record...)
+	}
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
 }
 
 // Close persists any buffered data before closing the file
 func (s *store) Close() error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	err := s.buf.Flush()
-	if err != nil {
+	if err := s.flush(); err != nil {
 		return err
 	}
 	return s.File.Close()
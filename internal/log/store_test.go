@@ -1,8 +1,12 @@
 package log
 
 import (
+	"bytes"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -88,6 +92,81 @@ func TestStoreClose(t *testing.T) {
 	require.True(t, afterSize > beforeSize)
 }
 
+func TestStoreConcurrentReads(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_concurrent_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := newStore(f)
+	require.NoError(t, err)
+	positions := make(chan uint64, 100)
+	errs := make(chan error, 4)
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for pos := range positions {
+				read, err := s.Read(pos)
+				if err == nil && !bytes.Equal(write, read) {
+					err = fmt.Errorf("read %q at %d, want %q", read, pos, write)
+				}
+				if err != nil {
+					errs <- err
+					// drain the positions so the appends aren't blocked
+					for range positions {
+					}
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 1000; i++ {
+		_, pos, err := s.Append(write)
+		require.NoError(t, err)
+		positions <- pos
+	}
+	close(positions)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	// reads of buffered records flush them, past the end there's nothing
+	_, pos, err := s.Append(write)
+	require.NoError(t, err)
+	require.Equal(t, width, uint64(s.buf.Buffered()))
+	read, err := s.Read(pos)
+	require.NoError(t, err)
+	require.Equal(t, write, read)
+	require.Equal(t, 0, s.buf.Buffered())
+	_, err = s.Read(pos + width)
+	require.Equal(t, io.EOF, err)
+}
+
+func TestStoreCorruptLength(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_corrupt_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := newStore(f)
+	require.NoError(t, err)
+	_, _, err = s.Append(write)
+	require.NoError(t, err)
+	require.NoError(t, s.flush())
+
+	// a length far bigger than the store fails before it's allocated
+	header := make([]byte, lenWidth)
+	enc.PutUint64(header, sizeMask)
+	_, err = s.File.WriteAt(header, 0)
+	require.NoError(t, err)
+	_, err = s.Read(0)
+	require.Error(t, err)
+	_, err = s.frameEnd(0)
+	require.Error(t, err)
+}
+
 func openFile(name string) (file *os.File, size int64, err error) {
 	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
 	if err != nil {
@@ -99,3 +178,41 @@ func openFile(name string) (file *os.File, size int64, err error) {
 	}
 	return f, fi.Size(), nil
 }
+
+func TestStoreEncrypted(t *testing.T) {
+	f, err := ioutil.TempFile("", "store_encrypted_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	keyring, err := NewKeyring("1", map[string][]byte{"1": make([]byte, 16)})
+	require.NoError(t, err)
+	s, err := newStore(f)
+	require.NoError(t, err)
+	s.aead, err = keyring.aead("1")
+	require.NoError(t, err)
+
+	var positions []uint64
+	for i := 0; i < 3; i++ {
+		_, pos, err := s.Append(write)
+		require.NoError(t, err)
+		positions = append(positions, pos)
+	}
+	require.NoError(t, s.flush())
+	for _, pos := range positions {
+		read, err := s.Read(pos)
+		require.NoError(t, err)
+		require.Equal(t, write, read)
+	}
+
+	raw := make([]byte, s.Size())
+	_, err = s.ReadAt(raw, 0)
+	require.NoError(t, err)
+	require.NotContains(t, string(raw), string(write))
+
+	// records are bound to their position
+	frame := raw[positions[1]:positions[2]]
+	_, err = s.File.WriteAt(frame, int64(positions[0]))
+	require.NoError(t, err)
+	_, err = s.Read(positions[0])
+	require.Error(t, err)
+}
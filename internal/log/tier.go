@@ -0,0 +1,527 @@
+package log
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	api "github.com/michael-diggin/proglog/api/v1"
+	"go.uber.org/zap"
+)
+
+// ObjectStore is where tiered storage offloads closed segments to. Get
+// returns an error for keys that don't exist, Delete doesn't.
+type ObjectStore interface {
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+}
+
+const (
+	defaultOffloadInterval = time.Minute
+	defaultCacheSegments   = 8
+	// cacheDir is the directory in the log's where remote segments are
+	// downloaded to be read
+	cacheDir = "cache"
+)
+
+// remoteSegment is kept in a segment's .remote file once the segment's
+// been uploaded to the object store. Segments with a .remote file and no
+// store file are read from the object store.
+type remoteSegment struct {
+	NextOffset uint64 `json:"next_offset"`
+	Bytes      uint64 `json:"bytes"`
+	// Key is the ID of the key the store is encrypted with, if it is
+	Key string `json:"key,omitempty"`
+	// Created is when the segment's first record was appended
+	Created time.Time `json:"created"`
+}
+
+// readRemoteSegment returns the segment's .remote file, or nil if it
+// hasn't been uploaded
+func readRemoteSegment(dir string, baseOffset uint64) (*remoteSegment, error) {
+	b, err := ioutil.ReadFile(segmentFile(dir, baseOffset, ".remote"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	remote := &remoteSegment{}
+	if err := json.Unmarshal(b, remote); err != nil {
+		return nil, fmt.Errorf("segment %d: invalid .remote file: %w", baseOffset, err)
+	}
+	return remote, nil
+}
+
+// writeRemoteSegment writes the segment's .remote file
+func writeRemoteSegment(dir string, baseOffset uint64, remote *remoteSegment) error {
+	b, err := json.Marshal(remote)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(segmentFile(dir, baseOffset, ".remote"), b, 0644)
+}
+
+// openRemoteSegment returns the segment whose files have been offloaded
+func openRemoteSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
+	remote, err := readRemoteSegment(dir, baseOffset)
+	if err != nil {
+		return nil, err
+	}
+	if c.Tier.Store == nil {
+		return nil, fmt.Errorf("segment %d is offloaded but there's no object store", baseOffset)
+	}
+	return &segment{
+		dir:        dir,
+		baseOffset: baseOffset,
+		nextOffset: remote.NextOffset,
+		config:     c,
+		remote:     remote,
+	}, nil
+}
+
+// Offload uploads the closed segments to the tier's object store, then
+// removes the local files of those last written longer ago than the
+// retention. Logs with an object store call it every Tier.Interval.
+func (l *Log) Offload(ctx context.Context) error {
+	if l.Config.Tier.Store == nil {
+		return nil
+	}
+	l.offloadMu.Lock()
+	defer l.offloadMu.Unlock()
+
+	closed, err := l.closedSegments()
+	if err != nil {
+		return err
+	}
+	defer closeOffloads(closed)
+	for _, o := range closed {
+		if o.store != nil {
+			if err := l.upload(ctx, o); err != nil {
+				return fmt.Errorf("failed to upload segment %d: %w", o.segment.baseOffset, err)
+			}
+		}
+		if time.Since(o.modified) < l.Config.Tier.Retention {
+			continue
+		}
+		if err := l.evict(o.segment); err != nil {
+			return fmt.Errorf("failed to remove segment %d: %w", o.segment.baseOffset, err)
+		}
+	}
+	return nil
+}
+
+// offload is a closed segment as Offload found it. The files of segments
+// that haven't been uploaded are read while the log's locked, so they can
+// be uploaded without it even if the segment's truncated meanwhile.
+type offload struct {
+	segment  *segment
+	modified time.Time
+	// remote is the segment's .remote file once it's uploaded
+	remote *remoteSegment
+	index  []byte
+	store  *os.File
+}
+
+// closedSegments returns the closed segments with local files
+func (l *Log) closedSegments() (closed []*offload, err error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	defer func() {
+		if err != nil {
+			closeOffloads(closed)
+		}
+	}()
+	for _, s := range l.segments {
+		if s == l.activeSegment || !s.local() {
+			continue
+		}
+		fi, err := s.store.Stat()
+		if err != nil {
+			return closed, err
+		}
+		o := &offload{segment: s, modified: fi.ModTime()}
+		closed = append(closed, o)
+		if s.remote != nil {
+			continue
+		}
+		o.remote = &remoteSegment{
+			NextOffset: s.next(),
+			Bytes:      s.store.Size(),
+			Created:    s.index.created(),
+		}
+		if s.keyFile != "" {
+			id, err := ioutil.ReadFile(s.keyFile)
+			if err != nil {
+				return closed, err
+			}
+			o.remote.Key = string(id)
+		}
+		// closed segments aren't written to, but the index file is still
+		// padded to its max size
+		o.index = append([]byte(nil), s.index.bytes()...)
+		if o.store, err = os.Open(s.store.Name()); err != nil {
+			return closed, err
+		}
+	}
+	return closed, nil
+}
+
+func closeOffloads(closed []*offload) {
+	for _, o := range closed {
+		if o.store != nil {
+			o.store.Close()
+		}
+	}
+}
+
+// upload puts the segment's files in the object store, then records that
+// it's been uploaded in its .remote file
+func (l *Log) upload(ctx context.Context, o *offload) error {
+	s := o.segment
+	if err := l.Config.Tier.Store.Put(
+		ctx, l.objectKey(s, ".index"), bytes.NewReader(o.index), int64(len(o.index)),
+	); err != nil {
+		return err
+	}
+	if err := l.Config.Tier.Store.Put(
+		ctx, l.objectKey(s, ".store"),
+		io.NewSectionReader(o.store, 0, int64(o.remote.Bytes)), int64(o.remote.Bytes),
+	); err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	// segments truncated while they were uploading stay removed, along
+	// with what was uploaded
+	if !l.contains(s) {
+		l.mu.Unlock()
+		return l.deleteRemote(ctx, s)
+	}
+	defer l.mu.Unlock()
+	if err := writeRemoteSegment(l.Dir, s.baseOffset, o.remote); err != nil {
+		return err
+	}
+	s.remote = o.remote
+	return nil
+}
+
+// evict removes the local files of an uploaded segment
+func (l *Log) evict(s *segment) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.contains(s) || s.remote == nil {
+		return nil
+	}
+	if err := s.removeLocal(); err != nil {
+		return err
+	}
+	return l.manifest().write(l.Dir)
+}
+
+// deleteRemote removes the segment's files from the object store
+func (l *Log) deleteRemote(ctx context.Context, s *segment) error {
+	l.cache.drop(s.baseOffset)
+	for _, ext := range []string{".store", ".index"} {
+		if err := l.Config.Tier.Store.Delete(ctx, l.objectKey(s, ext)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *Log) contains(s *segment) bool {
+	for _, segment := range l.segments {
+		if segment == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *Log) objectKey(s *segment, ext string) string {
+	return fmt.Sprintf("%s%d%s", l.Config.Tier.Prefix, s.baseOffset, ext)
+}
+
+// readRemote reads the record from the remote segment's cached copy
+func (l *Log) readRemote(ctx context.Context, s *segment, off uint64) (*api.Record, error) {
+	cached, release, err := l.cache.acquire(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return cached.Read(off)
+}
+
+// startOffloading offloads segments every Tier.Interval until Close
+func (l *Log) startOffloading() {
+	interval := l.Config.Tier.Interval
+	if interval == 0 {
+		interval = defaultOffloadInterval
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	l.stopOffloading = func() {
+		cancel()
+		<-done
+	}
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if err := l.Offload(ctx); err != nil && ctx.Err() == nil {
+				zap.L().Named("log").Error(
+					"failed to offload segments", zap.String("dir", l.Dir), zap.Error(err),
+				)
+			}
+		}
+	}()
+}
+
+// segmentCache keeps the most recently read remote segments on local disk
+type segmentCache struct {
+	dir      string
+	store    ObjectStore
+	config   Config
+	max      int
+	mu       sync.Mutex
+	segments map[uint64]*cachedSegment
+	clock    uint64
+}
+
+type cachedSegment struct {
+	*segment
+	// dir is the directory the segment's downloaded to, its own so a
+	// segment that's downloaded again doesn't share files with its old copy
+	dir string
+	// ready is closed once the segment's downloaded, or failed to with err
+	ready chan struct{}
+	err   error
+	// refs is the number of reads using the segment, which keep it from
+	// being evicted or removed
+	refs int
+	used uint64
+	// dropped segments are removed from disk once their last read releases
+	// them
+	dropped bool
+}
+
+// newSegmentCache returns an empty cache in dir, removing whatever a
+// previous cache left there
+func newSegmentCache(dir string, c Config) (*segmentCache, error) {
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	max := c.Tier.CacheSegments
+	if max == 0 {
+		max = defaultCacheSegments
+	}
+	return &segmentCache{
+		dir:      dir,
+		store:    c.Tier.Store,
+		config:   c,
+		max:      max,
+		segments: make(map[uint64]*cachedSegment),
+	}, nil
+}
+
+// acquire returns the cached copy of the remote segment, downloading it if
+// it isn't cached, and a func to release it once it's been read. Segments
+// are downloaded without holding the cache's lock, reads of the same
+// segment wait for the one download.
+func (c *segmentCache) acquire(ctx context.Context, s *segment) (*segment, func(), error) {
+	c.mu.Lock()
+	cached, ok := c.segments[s.baseOffset]
+	if !ok {
+		cached = &cachedSegment{ready: make(chan struct{})}
+		c.segments[s.baseOffset] = cached
+	}
+	cached.refs++
+	c.clock++
+	cached.used = c.clock
+	c.mu.Unlock()
+
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			cached.refs--
+			if cached.refs == 0 && cached.dropped {
+				c.remove(cached)
+			}
+		})
+	}
+	if !ok {
+		c.fill(ctx, s, cached)
+	}
+	select {
+	case <-cached.ready:
+	case <-ctx.Done():
+		release()
+		return nil, nil, ctx.Err()
+	}
+	if cached.err != nil {
+		release()
+		return nil, nil, fmt.Errorf("failed to download segment %d: %w", s.baseOffset, cached.err)
+	}
+	return cached.segment, release, nil
+}
+
+// fill downloads the segment into cached. Segments that fail to download
+// are left out of the cache, for the next read to try again.
+func (c *segmentCache) fill(ctx context.Context, s *segment, cached *cachedSegment) {
+	segment, dir, err := c.download(ctx, s)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cached.segment, cached.dir, cached.err = segment, dir, err
+	if err != nil {
+		if c.segments[s.baseOffset] == cached {
+			delete(c.segments, s.baseOffset)
+		}
+		if dir != "" {
+			os.RemoveAll(dir)
+		}
+	}
+	close(cached.ready)
+	c.evict()
+}
+
+func (c *segmentCache) download(ctx context.Context, s *segment) (*segment, string, error) {
+	dir, err := ioutil.TempDir(c.dir, fmt.Sprintf("%d-", s.baseOffset))
+	if err != nil {
+		return nil, "", err
+	}
+	for _, ext := range []string{".store", ".index"} {
+		key := fmt.Sprintf("%s%d%s", s.config.Tier.Prefix, s.baseOffset, ext)
+		if err := c.get(ctx, key, segmentFile(dir, s.baseOffset, ext)); err != nil {
+			return nil, dir, err
+		}
+	}
+	if s.remote.Key != "" {
+		keyFile := segmentFile(dir, s.baseOffset, ".key")
+		if err := ioutil.WriteFile(keyFile, []byte(s.remote.Key), 0644); err != nil {
+			return nil, dir, err
+		}
+	}
+	segment, err := newSegment(dir, s.baseOffset, c.config)
+	return segment, dir, err
+}
+
+func (c *segmentCache) get(ctx context.Context, key, file string) error {
+	r, err := c.store.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	f, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), file)
+}
+
+// evict removes the least recently used segments that aren't being read
+// until the cache is back down to its max. Segments being downloaded are
+// being read by the read that's downloading them. The caller must hold the
+// lock.
+func (c *segmentCache) evict() {
+	for len(c.segments) > c.max {
+		var lru *cachedSegment
+		for _, cached := range c.segments {
+			if cached.refs == 0 && (lru == nil || cached.used < lru.used) {
+				lru = cached
+			}
+		}
+		if lru == nil {
+			return
+		}
+		delete(c.segments, lru.baseOffset)
+		c.remove(lru)
+	}
+}
+
+// drop removes the segment from the cache, once it's been removed from the
+// object store. A segment that's being read is removed from disk once the
+// reads release it.
+func (c *segmentCache) drop(baseOffset uint64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cached, ok := c.segments[baseOffset]
+	if !ok {
+		return
+	}
+	delete(c.segments, baseOffset)
+	if cached.refs > 0 {
+		cached.dropped = true
+		return
+	}
+	c.remove(cached)
+}
+
+// remove removes the cached segment's files, logging rather than returning
+// errors as nothing's waiting on them. The caller must hold the lock.
+func (c *segmentCache) remove(cached *cachedSegment) {
+	if cached.segment == nil {
+		return
+	}
+	if err := cached.Remove(); err != nil {
+		zap.L().Named("log").Error(
+			"failed to remove cached segment",
+			zap.Uint64("base_offset", cached.baseOffset), zap.Error(err),
+		)
+	}
+	if err := os.RemoveAll(cached.dir); err != nil {
+		zap.L().Named("log").Error(
+			"failed to remove cached segment", zap.String("dir", cached.dir), zap.Error(err),
+		)
+	}
+}
+
+// close closes the cached segments, leaving their files to be removed by
+// the next cache in the directory
+func (c *segmentCache) close() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for base, cached := range c.segments {
+		delete(c.segments, base)
+		if cached.segment == nil {
+			continue
+		}
+		if err := cached.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
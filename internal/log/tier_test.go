@@ -0,0 +1,436 @@
+package log
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	api "github.com/michael-diggin/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestTieredLog(t *testing.T) {
+	keyring, err := NewKeyring("1", map[string][]byte{"1": make([]byte, 32)})
+	require.NoError(t, err)
+	for _, k := range []*Keyring{nil, keyring} {
+		dir, err := ioutil.TempDir("", "tier-test")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		objects := newMemStore()
+		c := Config{Keyring: k}
+		c.Segment.MaxStoreBytes = 64
+		c.Tier.Store = objects
+		c.Tier.Prefix = "node-1/"
+		c.Tier.Interval = time.Hour
+		c.Tier.CacheSegments = 1
+		log, err := NewLog(dir, c)
+		require.NoError(t, err)
+
+		const records = 10
+		for i := 0; i < records; i++ {
+			_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+			require.NoError(t, err)
+		}
+		before := log.Stats()
+		require.NoError(t, log.Offload(context.Background()))
+
+		// every segment but the active one is only in the object store
+		stats := log.Stats()
+		require.Equal(t, before.Segments, stats.Segments)
+		require.Equal(t, before.Segments-1, stats.RemoteSegments)
+		require.Equal(t, before.Bytes, stats.Bytes+stats.RemoteBytes)
+		files, err := filepath.Glob(filepath.Join(dir, "*.store"))
+		require.NoError(t, err)
+		require.Len(t, files, 1)
+		require.Contains(t, objects.keys(), "node-1/0.store")
+
+		read := func(log *Log) {
+			// reading back and forth makes the cache of 1 download
+			// segments again
+			for _, off := range []uint64{0, records - 1, 1, 5, 0} {
+				record, err := log.Read(off)
+				require.NoError(t, err)
+				require.Equal(t, fmt.Sprintf("record %d", off), string(record.Value))
+			}
+			b, err := ioutil.ReadAll(log.Reader())
+			require.NoError(t, err)
+			for i := 0; i < records; i++ {
+				record := &api.Record{}
+				size := enc.Uint64(b)
+				require.NoError(t, proto.Unmarshal(b[lenWidth:lenWidth+size], record))
+				require.Equal(t, fmt.Sprintf("record %d", i), string(record.Value))
+				b = b[lenWidth+size:]
+			}
+		}
+		read(log)
+
+		// the log knows which segments are remote when it's reopened
+		require.NoError(t, log.Close())
+		log, err = NewLog(dir, c)
+		require.NoError(t, err)
+		require.Equal(t, stats.RemoteSegments, log.Stats().RemoteSegments)
+		read(log)
+		off, err := log.Append(&api.Record{Value: []byte("after")})
+		require.NoError(t, err)
+		require.Equal(t, uint64(records), off)
+
+		// truncated and removed segments are deleted from the object store
+		require.NoError(t, log.Truncate(4))
+		require.NotContains(t, objects.keys(), "node-1/0.store")
+		_, err = log.Read(0)
+		require.Error(t, err)
+		_, err = log.Read(5)
+		require.NoError(t, err)
+		require.NoError(t, log.Remove())
+		require.Empty(t, objects.keys())
+	}
+}
+
+func TestTierRetention(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tier-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 32
+	c.Tier.Store = newMemStore()
+	c.Tier.Retention = time.Hour
+	c.Tier.Interval = 10 * time.Millisecond
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Remove()
+
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	// segments are uploaded in the background but kept until they're old
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(filepath.Join(dir, "0.remote"))
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, 0, log.Stats().RemoteSegments)
+
+	old := time.Now().Add(-2 * time.Hour)
+	require.NoError(t, os.Chtimes(filepath.Join(dir, "0.store"), old, old))
+	require.Eventually(t, func() bool {
+		return log.Stats().RemoteSegments == 1
+	}, time.Second, 10*time.Millisecond)
+	record, err := log.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), record.Value)
+}
+
+func TestRemoteSegmentsNeedStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tier-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 32
+	c.Tier.Store = newMemStore()
+	c.Tier.Interval = time.Hour
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Offload(context.Background()))
+	require.NoError(t, log.Close())
+
+	c.Tier.Store = nil
+	_, err = NewLog(dir, c)
+	require.Error(t, err)
+}
+
+func TestTierOffloadWhileTruncating(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tier-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	objects := newMemStore()
+	c := Config{}
+	c.Segment.MaxStoreBytes = 32
+	c.Tier.Store = objects
+	c.Tier.Interval = time.Hour
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Remove()
+
+	done := make(chan struct{})
+	errc := make(chan error, 1)
+	go func() {
+		for {
+			select {
+			case <-done:
+				errc <- nil
+				return
+			default:
+			}
+			if err := log.Offload(context.Background()); err != nil {
+				errc <- err
+				return
+			}
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		off, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+		if i%10 == 9 {
+			require.NoError(t, log.Truncate(off-3))
+		}
+	}
+	close(done)
+	require.NoError(t, <-errc)
+	require.NoError(t, log.Offload(context.Background()))
+
+	// segments truncated while they were uploading don't leave objects
+	// behind
+	lowest, err := log.LowestOffset()
+	require.NoError(t, err)
+	for _, key := range objects.keys() {
+		var base uint64
+		_, err := fmt.Sscanf(key, "%d.", &base)
+		require.NoError(t, err)
+		require.True(t, base >= lowest, key)
+	}
+	for off := lowest; off < 100; off++ {
+		_, err := log.Read(off)
+		require.NoError(t, err)
+	}
+}
+
+func TestTierRestoreKeepsRemoteSegments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tier-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"leader", "follower"} {
+		require.NoError(t, os.Mkdir(filepath.Join(dir, name), 0755))
+	}
+	// the leader's log, which the follower's restored from
+	leader, err := NewLog(filepath.Join(dir, "leader"), Config{})
+	require.NoError(t, err)
+	defer leader.Remove()
+	appendRecords(t, leader, 0, 8)
+	snap, err := (&fsm{log: leader}).Snapshot()
+	require.NoError(t, err)
+	b, err := ioutil.ReadAll(snap.(*snapshot).reader)
+	require.NoError(t, err)
+
+	objects := newMemStore()
+	c := Config{}
+	c.Segment.MaxStoreBytes = 32
+	c.Tier.Store = objects
+	c.Tier.Interval = time.Hour
+	follower, err := NewLog(filepath.Join(dir, "follower"), c)
+	require.NoError(t, err)
+	defer follower.Remove()
+	appendRecords(t, follower, 0, 5)
+	require.NoError(t, follower.Offload(context.Background()))
+	remote := follower.Stats().RemoteSegments
+	require.NotZero(t, remote)
+	keys := objects.keys()
+
+	f := &fsm{log: follower}
+	require.NoError(t, f.Restore(ioutil.NopCloser(bytes.NewReader(b))))
+	// the offloaded segments are read from the object store as they were,
+	// the records after them are written locally
+	require.Equal(t, keys, objects.keys())
+	require.Equal(t, remote, follower.Stats().RemoteSegments)
+	it := follower.NewIterator(0)
+	defer it.Close()
+	for off := uint64(0); off < 8; off++ {
+		requireNext(t, it, off)
+	}
+	_, err = it.Next()
+	require.Equal(t, io.EOF, err)
+}
+
+// memStore is an ObjectStore in memory
+type memStore struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func newMemStore() *memStore {
+	return &memStore{objects: make(map[string][]byte)}
+}
+
+func (m *memStore) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if int64(len(b)) != size {
+		return fmt.Errorf("put %d bytes, want %d", len(b), size)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.objects[key] = b
+	return nil
+}
+
+func (m *memStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b, ok := m.objects[key]
+	if !ok {
+		return nil, errors.New("not found")
+	}
+	return ioutil.NopCloser(bytes.NewReader(b)), nil
+}
+
+func (m *memStore) Delete(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.objects, key)
+	return nil
+}
+
+func (m *memStore) keys() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys := make([]string, 0, len(m.objects))
+	for k := range m.objects {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestSegmentCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tier-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	objects := &blockingStore{memStore: newMemStore()}
+	c := Config{}
+	c.Segment.MaxStoreBytes = 32
+	c.Tier.Store = objects
+	c.Tier.Interval = time.Hour
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Remove()
+	for len(log.segments) < 3 {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Offload(context.Background()))
+	first, second := log.segments[0], log.segments[1]
+	ctx := context.Background()
+
+	// reads of a segment wait on the one download, while other segments
+	// can still be read
+	objects.block()
+	var wg sync.WaitGroup
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := log.readRemote(ctx, first, 0)
+			errs <- err
+		}()
+	}
+	require.Eventually(t, func() bool {
+		return objects.waiting() == 1
+	}, time.Second, time.Millisecond)
+	log.cache.mu.Lock()
+	require.Len(t, log.cache.segments, 1)
+	log.cache.mu.Unlock()
+	objects.unblock()
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+	require.Equal(t, 2, objects.gets())
+
+	// a dropped segment stays on disk until its reads release it
+	cached, release, err := log.cache.acquire(ctx, second)
+	require.NoError(t, err)
+	file := cached.store.Name()
+	log.cache.drop(second.baseOffset)
+	record, err := cached.Read(second.baseOffset)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), record.Value)
+	release()
+	release()
+	_, err = os.Stat(file)
+	require.True(t, os.IsNotExist(err))
+
+	// a failed download isn't cached
+	objects.fail = true
+	_, err = log.readRemote(ctx, second, second.baseOffset)
+	require.Error(t, err)
+	objects.fail = false
+	record, err = log.readRemote(ctx, second, second.baseOffset)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), record.Value)
+}
+
+// blockingStore is a memStore whose gets can be held up, and failed
+type blockingStore struct {
+	*memStore
+
+	mu      sync.Mutex
+	held    chan struct{}
+	blocked int
+	count   int
+	fail    bool
+}
+
+func (b *blockingStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	b.mu.Lock()
+	b.count++
+	held, fail := b.held, b.fail
+	if held != nil {
+		b.blocked++
+	}
+	b.mu.Unlock()
+	if held != nil {
+		<-held
+	}
+	if fail {
+		return nil, errors.New("failed")
+	}
+	return b.memStore.Get(ctx, key)
+}
+
+func (b *blockingStore) block() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.held = make(chan struct{})
+}
+
+func (b *blockingStore) unblock() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	close(b.held)
+	b.held = nil
+}
+
+func (b *blockingStore) waiting() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.blocked
+}
+
+func (b *blockingStore) gets() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.count
+}
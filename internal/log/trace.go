@@ -0,0 +1,29 @@
+package log
+
+import (
+	"context"
+
+	"github.com/michael-diggin/proglog/internal/tracing"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/michael-diggin/proglog/internal/log"
+
+// startSpan starts a child span of the trace in ctx. Nothing is traced when
+// ctx doesn't carry a trace, so Raft's own log entries don't start traces.
+func startSpan(ctx context.Context, name string) (context.Context, trace.Span) {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return ctx, trace.SpanFromContext(ctx)
+	}
+	return tracing.Tracer(tracerName).Start(ctx, name)
+}
+
+// endSpan records err, if any, on the span and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,200 @@
+// Package metrics serves an agent's log, Raft and gRPC metrics in the
+// Prometheus exposition format.
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	ocprom "contrib.go.opencensus.io/exporter/prometheus"
+	"github.com/hashicorp/raft"
+	"github.com/michael-diggin/proglog/internal/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "proglog"
+
+// StatsSource is implemented by log.DistributedLog
+type StatsSource interface {
+	LogStats() map[string]log.Stats
+	RaftStats() log.RaftStats
+}
+
+// NewHandler returns a handler serving the stats of source, the gRPC views
+// recorded by the server, which include the produce and consume rates and
+// latencies, and the Go runtime's metrics
+func NewHandler(source StatsSource) (http.Handler, error) {
+	registry := prometheus.NewRegistry()
+	for _, c := range []prometheus.Collector{
+		newCollector(source),
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	} {
+		if err := registry.Register(c); err != nil {
+			return nil, err
+		}
+	}
+	// the exporter registers itself and reads the OpenCensus views on scrape
+	_, err := ocprom.NewExporter(ocprom.Options{
+		Namespace: namespace,
+		Registry:  registry,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{}), nil
+}
+
+var (
+	logSegments = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "log", "segments"),
+		"Number of segments in the log.",
+		[]string{"log"}, nil,
+	)
+	logBytes = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "log", "bytes"),
+		"Bytes in the log's segment stores.",
+		[]string{"log"}, nil,
+	)
+	logRemoteSegments = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "log", "remote_segments"),
+		"Number of segments offloaded to the object store and removed locally.",
+		[]string{"log"}, nil,
+	)
+	logRemoteBytes = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "log", "remote_bytes"),
+		"Bytes in the stores of segments only in the object store.",
+		[]string{"log"}, nil,
+	)
+	logLowestOffset = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "log", "lowest_offset"),
+		"Lowest offset in the log.",
+		[]string{"log"}, nil,
+	)
+	logHighestOffset = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "log", "highest_offset"),
+		"Highest offset in the log, its high-water mark.",
+		[]string{"log"}, nil,
+	)
+	raftState = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "raft", "state"),
+		"Raft state of the server, 1 for the current state.",
+		[]string{"state"}, nil,
+	)
+	raftTerm = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "raft", "term"),
+		"Current Raft term.",
+		nil, nil,
+	)
+	raftLastIndex = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "raft", "last_index"),
+		"Index of the last entry in the Raft log.",
+		nil, nil,
+	)
+	raftCommitIndex = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "raft", "commit_index"),
+		"Index of the last committed Raft entry.",
+		nil, nil,
+	)
+	raftAppliedIndex = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "raft", "applied_index"),
+		"Index of the last Raft entry applied to the log.",
+		nil, nil,
+	)
+	raftLeaderLastContact = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "raft", "leader_last_contact_seconds"),
+		"Seconds since this follower last heard from the leader, only reported by followers.",
+		nil, nil,
+	)
+	raftFollowerLagEntries = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "raft", "follower_lag_entries"),
+		"Committed Raft entries the follower doesn't have yet, only reported by the leader.",
+		[]string{"follower"}, nil,
+	)
+	raftFollowerLastContact = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "raft", "follower_last_contact_seconds"),
+		"Seconds since the follower last answered the leader, only reported by the leader.",
+		[]string{"follower"}, nil,
+	)
+)
+
+var raftStates = []raft.RaftState{
+	raft.Follower,
+	raft.Candidate,
+	raft.Leader,
+	raft.Shutdown,
+}
+
+// collector reads the stats from its source on each scrape
+type collector struct {
+	source StatsSource
+}
+
+var _ prometheus.Collector = (*collector)(nil)
+
+func newCollector(source StatsSource) *collector {
+	return &collector{source: source}
+}
+
+func (c *collector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{
+		logSegments,
+		logBytes,
+		logRemoteSegments,
+		logRemoteBytes,
+		logLowestOffset,
+		logHighestOffset,
+		raftState,
+		raftTerm,
+		raftLastIndex,
+		raftCommitIndex,
+		raftAppliedIndex,
+		raftLeaderLastContact,
+		raftFollowerLagEntries,
+		raftFollowerLastContact,
+	} {
+		ch <- desc
+	}
+}
+
+func (c *collector) Collect(ch chan<- prometheus.Metric) {
+	for name, stats := range c.source.LogStats() {
+		gauge(ch, logSegments, float64(stats.Segments), name)
+		gauge(ch, logBytes, float64(stats.Bytes), name)
+		gauge(ch, logRemoteSegments, float64(stats.RemoteSegments), name)
+		gauge(ch, logRemoteBytes, float64(stats.RemoteBytes), name)
+		gauge(ch, logLowestOffset, float64(stats.LowestOffset), name)
+		gauge(ch, logHighestOffset, float64(stats.HighestOffset), name)
+	}
+
+	stats := c.source.RaftStats()
+	for _, state := range raftStates {
+		var v float64
+		if state == stats.State {
+			v = 1
+		}
+		gauge(ch, raftState, v, state.String())
+	}
+	gauge(ch, raftTerm, float64(stats.Term))
+	gauge(ch, raftLastIndex, float64(stats.LastIndex))
+	gauge(ch, raftCommitIndex, float64(stats.CommitIndex))
+	gauge(ch, raftAppliedIndex, float64(stats.AppliedIndex))
+	if stats.State == raft.Follower && !stats.LastContact.IsZero() {
+		gauge(ch, raftLeaderLastContact, time.Since(stats.LastContact).Seconds())
+	}
+	for id, follower := range stats.Followers {
+		var lag uint64
+		// followers can be ahead of the commit index with entries that
+		// aren't committed yet
+		if stats.CommitIndex > follower.LastIndex {
+			lag = stats.CommitIndex - follower.LastIndex
+		}
+		gauge(ch, raftFollowerLagEntries, float64(lag), id)
+		gauge(ch, raftFollowerLastContact, time.Since(follower.LastContact).Seconds(), id)
+	}
+}
+
+func gauge(ch chan<- prometheus.Metric, desc *prometheus.Desc, v float64, labels ...string) {
+	ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, v, labels...)
+}
@@ -0,0 +1,102 @@
+package metrics
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/michael-diggin/proglog/internal/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandler(t *testing.T) {
+	source := &stats{
+		logs: map[string]log.Stats{
+			"commit": {
+				Segments: 2, Bytes: 1024, RemoteSegments: 1, RemoteBytes: 512,
+				LowestOffset: 3, HighestOffset: 9,
+			},
+		},
+		raft: log.RaftStats{
+			State:        raft.Follower,
+			Term:         4,
+			LastIndex:    12,
+			CommitIndex:  11,
+			AppliedIndex: 10,
+			LastContact:  time.Now(),
+		},
+	}
+	handler, err := NewHandler(source)
+	require.NoError(t, err)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, err := ioutil.ReadAll(rec.Body)
+	require.NoError(t, err)
+
+	for _, want := range []string{
+		`proglog_log_segments{log="commit"} 2`,
+		`proglog_log_bytes{log="commit"} 1024`,
+		`proglog_log_remote_segments{log="commit"} 1`,
+		`proglog_log_remote_bytes{log="commit"} 512`,
+		`proglog_log_lowest_offset{log="commit"} 3`,
+		`proglog_log_highest_offset{log="commit"} 9`,
+		`proglog_raft_state{state="Follower"} 1`,
+		`proglog_raft_state{state="Leader"} 0`,
+		`proglog_raft_term 4`,
+		`proglog_raft_last_index 12`,
+		`proglog_raft_commit_index 11`,
+		`proglog_raft_applied_index 10`,
+		`proglog_raft_leader_last_contact_seconds`,
+	} {
+		require.Contains(t, string(body), want)
+	}
+	require.NotContains(t, string(body), `proglog_raft_follower_lag_entries`)
+}
+
+func TestHandlerLeader(t *testing.T) {
+	source := &stats{
+		raft: log.RaftStats{
+			State:       raft.Leader,
+			LastIndex:   12,
+			CommitIndex: 11,
+			Followers: map[string]log.FollowerStats{
+				"1": {LastIndex: 8, LastContact: time.Now()},
+				// ahead of the commit index, with an entry to commit
+				"2": {LastIndex: 12, LastContact: time.Now().Add(-time.Minute)},
+			},
+		},
+	}
+	handler, err := NewHandler(source)
+	require.NoError(t, err)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body, err := ioutil.ReadAll(rec.Body)
+	require.NoError(t, err)
+
+	for _, want := range []string{
+		`proglog_raft_follower_lag_entries{follower="1"} 3`,
+		`proglog_raft_follower_lag_entries{follower="2"} 0`,
+		`proglog_raft_follower_last_contact_seconds{follower="1"}`,
+		`proglog_raft_follower_last_contact_seconds{follower="2"} 60`,
+	} {
+		require.Contains(t, string(body), want)
+	}
+	require.NotContains(t, string(body), `proglog_raft_leader_last_contact_seconds`)
+}
+
+type stats struct {
+	logs map[string]log.Stats
+	raft log.RaftStats
+}
+
+func (s *stats) LogStats() map[string]log.Stats {
+	return s.logs
+}
+
+func (s *stats) RaftStats() log.RaftStats {
+	return s.raft
+}
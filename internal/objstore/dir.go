@@ -0,0 +1,67 @@
+package objstore
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Dir stores objects as files in a directory, keys being their paths
+type Dir struct {
+	path string
+}
+
+// NewDir returns a Dir storing objects under path, creating it if needed
+func NewDir(path string) (*Dir, error) {
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return nil, err
+	}
+	return &Dir{path: path}, nil
+}
+
+// Put writes the object to a temporary file before moving it into place, so
+// it's never seen partly written
+func (d *Dir) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	name := d.file(key)
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(name), ".put-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
+
+// Get opens the object's file
+func (d *Dir) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	f, err := os.Open(d.file(key))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return f, err
+}
+
+// Delete removes the object's file, if it exists
+func (d *Dir) Delete(ctx context.Context, key string) error {
+	err := os.Remove(d.file(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (d *Dir) file(key string) string {
+	// cleaning the key as an absolute path keeps it inside the directory
+	return filepath.Join(d.path, filepath.Clean("/"+key))
+}
@@ -0,0 +1,61 @@
+// Package objstore provides the object stores tiered storage offloads log
+// segments to: a directory on the local filesystem, for tests and shared
+// filesystems, and S3-compatible stores such as S3 itself or MinIO.
+package objstore
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+
+	"github.com/michael-diggin/proglog/internal/log"
+)
+
+// ErrNotFound is returned when getting objects that don't exist
+var ErrNotFound = errors.New("object not found")
+
+// Open returns the object store at the URL, one of:
+//
+//	file:///var/lib/proglog/tier
+//	s3://bucket?endpoint=minio:9000&region=us-east-1&insecure=true
+//
+// S3 credentials are taken from the AWS_ACCESS_KEY_ID and
+// AWS_SECRET_ACCESS_KEY or MINIO_ACCESS_KEY and MINIO_SECRET_KEY
+// environment variables. The endpoint defaults to AWS's.
+func Open(rawurl string) (log.ObjectStore, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid object store URL: %w", err)
+	}
+	switch u.Scheme {
+	case "file":
+		return NewDir(u.Path)
+	case "s3":
+		q := u.Query()
+		c := S3Config{
+			Endpoint:  q.Get("endpoint"),
+			Bucket:    u.Host,
+			Region:    q.Get("region"),
+			AccessKey: firstEnv("AWS_ACCESS_KEY_ID", "MINIO_ACCESS_KEY"),
+			SecretKey: firstEnv("AWS_SECRET_ACCESS_KEY", "MINIO_SECRET_KEY"),
+		}
+		if v := q.Get("insecure"); v != "" {
+			if c.Insecure, err = strconv.ParseBool(v); err != nil {
+				return nil, fmt.Errorf("invalid insecure parameter: %w", err)
+			}
+		}
+		return NewS3(c)
+	}
+	return nil, fmt.Errorf("unsupported object store: %q", u.Scheme)
+}
+
+func firstEnv(keys ...string) string {
+	for _, k := range keys {
+		if v := os.Getenv(k); v != "" {
+			return v
+		}
+	}
+	return ""
+}
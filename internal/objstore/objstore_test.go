@@ -0,0 +1,127 @@
+package objstore
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/michael-diggin/proglog/internal/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "objstore-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	store, err := Open("file://" + dir)
+	require.NoError(t, err)
+	testStore(t, store)
+
+	// keys can't escape the directory
+	require.NoError(t, store.Put(context.Background(), "../escaped", strings.NewReader("x"), 1))
+	_, err = os.Stat(dir + "/escaped")
+	require.NoError(t, err)
+}
+
+// TestS3 runs against the S3-compatible store in $PROGLOG_TEST_S3_URL, e.g.
+// a local MinIO, or an in-memory stand-in if it isn't set
+func TestS3(t *testing.T) {
+	rawurl := os.Getenv("PROGLOG_TEST_S3_URL")
+	if rawurl == "" {
+		srv := httptest.NewServer(newFakeS3())
+		defer srv.Close()
+		u, err := url.Parse(srv.URL)
+		require.NoError(t, err)
+		rawurl = fmt.Sprintf("s3://test?endpoint=%s&region=us-east-1&insecure=true", u.Host)
+	}
+	store, err := Open(rawurl)
+	require.NoError(t, err)
+	testStore(t, store)
+}
+
+func testStore(t *testing.T, store log.ObjectStore) {
+	t.Helper()
+	ctx := context.Background()
+	key := fmt.Sprintf("node-%d/0.store", time.Now().UnixNano())
+
+	_, err := store.Get(ctx, key)
+	require.Equal(t, ErrNotFound, err)
+
+	want := bytes.Repeat([]byte("segment"), 1000)
+	require.NoError(t, store.Put(ctx, key, bytes.NewReader(want), int64(len(want))))
+	r, err := store.Get(ctx, key)
+	require.NoError(t, err)
+	got, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	require.Equal(t, want, got)
+
+	require.NoError(t, store.Delete(ctx, key))
+	_, err = store.Get(ctx, key)
+	require.Equal(t, ErrNotFound, err)
+	require.NoError(t, store.Delete(ctx, key))
+}
+
+func TestOpen(t *testing.T) {
+	for _, rawurl := range []string{"ftp://host/dir", "s3://bucket?insecure=maybe", ":"} {
+		_, err := Open(rawurl)
+		require.Error(t, err, rawurl)
+	}
+}
+
+// fakeS3 serves the object API of a single path-style bucket, without
+// checking signatures
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{objects: make(map[string][]byte)}
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := r.URL.Path
+	switch r.Method {
+	case http.MethodPut:
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.objects[key] = b
+		w.Header().Set("ETag", `"etag"`)
+	case http.MethodGet, http.MethodHead:
+		b, ok := s.objects[key]
+		if !ok {
+			w.Header().Set("Content-Type", "application/xml")
+			w.WriteHeader(http.StatusNotFound)
+			if r.Method == http.MethodGet {
+				fmt.Fprintf(w, "<Error><Code>NoSuchKey</Code><Key>%s</Key></Error>", key)
+			}
+			return
+		}
+		w.Header().Set("ETag", `"etag"`)
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.Header().Set("Content-Length", fmt.Sprint(len(b)))
+		if r.Method == http.MethodGet {
+			w.Write(b)
+		}
+	case http.MethodDelete:
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
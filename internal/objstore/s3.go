@@ -0,0 +1,74 @@
+package objstore
+
+import (
+	"context"
+	"io"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// S3Config configures the S3-compatible store objects are kept in
+type S3Config struct {
+	// Endpoint is the host, and port if needed, of the S3 API. Defaults
+	// to AWS's.
+	Endpoint  string
+	Bucket    string
+	Region    string
+	AccessKey string
+	SecretKey string
+	// Insecure connects over plain HTTP, for local stand-ins
+	Insecure bool
+}
+
+// S3 stores objects in an S3 bucket
+type S3 struct {
+	client *minio.Client
+	bucket string
+}
+
+// NewS3 returns an S3 store for the bucket. The bucket must already exist.
+func NewS3(c S3Config) (*S3, error) {
+	if c.Endpoint == "" {
+		c.Endpoint = "s3.amazonaws.com"
+	}
+	client, err := minio.New(c.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(c.AccessKey, c.SecretKey, ""),
+		Secure: !c.Insecure,
+		Region: c.Region,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &S3{client: client, bucket: c.Bucket}, nil
+}
+
+// Put uploads the object, in parts if it's large
+func (s *S3) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	_, err := s.client.PutObject(ctx, s.bucket, key, r, size, minio.PutObjectOptions{
+		ContentType: "application/octet-stream",
+	})
+	return err
+}
+
+// Get downloads the object
+func (s *S3) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	obj, err := s.client.GetObject(ctx, s.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	// the object's fetched on its first use, where missing objects show up
+	if _, err := obj.Stat(); err != nil {
+		obj.Close()
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return obj, nil
+}
+
+// Delete removes the object. Deleting objects that don't exist succeeds.
+func (s *S3) Delete(ctx context.Context, key string) error {
+	return s.client.RemoveObject(ctx, s.bucket, key, minio.RemoveObjectOptions{})
+}
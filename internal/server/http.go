@@ -0,0 +1,436 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	api "github.com/michael-diggin/proglog/api/v1"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// tailPollInterval is how often a tail checks for new records once it has
+// caught up with the log
+const tailPollInterval = 100 * time.Millisecond
+
+// defaultFetchBytes is how many bytes of records a fetch returns by default
+const defaultFetchBytes = 1 << 20
+
+// defaultRequestBytes is the largest produce request accepted when there's
+// no max record size, gRPC's default max message size
+const defaultRequestBytes = 4 << 20
+
+// leaderHeader is the header the leader's address is returned in when a
+// produce is sent to a follower
+const leaderHeader = "Proglog-Leader"
+
+// NewHTTPHandler returns a handler serving the Log service as JSON over
+// HTTP, for clients that can't speak gRPC:
+//
+//	POST /v1/produce          body: ProduceRequest, returns ProduceResponse
+//	GET  /v1/consume?offset=N returns ConsumeResponse
+//	GET  /v1/tail?offset=N    streams records from N as server-sent events
+//	GET  /v1/fetch?offset=N&max_bytes=M
+//	                          returns records from N as they're stored
+//	GET  /v1/servers          returns GetServersResponse
+//	GET  /v1/backup           returns a tarball of the server's data dir
+//
+// Requests are authenticated and authorized the same way as gRPC requests.
+func NewHTTPHandler(config *Config) (http.Handler, error) {
+	srv, err := newgrpcServer(config)
+	if err != nil {
+		return nil, err
+	}
+	h := &httpHandler{srv: srv}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/produce", h.produce)
+	mux.HandleFunc("/v1/consume", h.consume)
+	mux.HandleFunc("/v1/tail", h.tail)
+	mux.HandleFunc("/v1/fetch", h.fetch)
+	mux.HandleFunc("/v1/servers", h.servers)
+	mux.HandleFunc("/v1/backup", h.backup)
+	return mux, nil
+}
+
+type httpHandler struct {
+	srv *grpcServer
+}
+
+func (h *httpHandler) produce(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	// the body's only read for callers that may produce
+	ctx, err := h.authenticate(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := h.srv.authorize(ctx, logResource, produceAction); err != nil {
+		writeError(w, err)
+		return
+	}
+	n := h.srv.maxRequestBytes()
+	if n == 0 {
+		n = defaultRequestBytes
+	}
+	// JSON encodes the record's value as base64, a third bigger
+	r.Body = http.MaxBytesReader(w, r.Body, int64(n)*4/3)
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, status.Error(codes.InvalidArgument, err.Error()))
+		return
+	}
+	req := &api.ProduceRequest{}
+	if err := protojson.Unmarshal(body, req); err != nil {
+		writeError(w, status.Error(codes.InvalidArgument, err.Error()))
+		return
+	}
+	if req.Record == nil {
+		writeError(w, status.Error(codes.InvalidArgument, "record is required"))
+		return
+	}
+	if err := h.srv.Quotas.admit(subject(ctx), produceOperation, proto.Size(req)); err != nil {
+		writeError(w, err)
+		return
+	}
+	res, err := h.srv.Produce(ctx, req)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, res)
+}
+
+func (h *httpHandler) consume(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	offset, err := offsetParam(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	ctx, err := h.authenticate(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := h.srv.Quotas.admit(subject(ctx), consumeOperation, 0); err != nil {
+		writeError(w, err)
+		return
+	}
+	res, err := h.srv.Consume(ctx, &api.ConsumeRequest{Offset: offset})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	h.srv.Quotas.charge(subject(ctx), consumeOperation, proto.Size(res))
+	writeJSON(w, res)
+}
+
+// tail streams records as server-sent events with the record's offset as
+// the event ID, so clients reconnecting with Last-Event-ID resume after the
+// last record they got
+func (h *httpHandler) tail(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	offset, err := offsetParam(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		last, err := strconv.ParseUint(id, 10, 64)
+		if err != nil {
+			writeError(w, status.Error(codes.InvalidArgument, "invalid Last-Event-ID"))
+			return
+		}
+		offset = last + 1
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, status.Error(codes.Unimplemented, "streaming unsupported"))
+		return
+	}
+	ctx, err := h.authenticate(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	// authorize before committing to the event stream
+	if err := h.srv.authorize(ctx, logResource, consumeAction); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	authorized := time.Now()
+	it := h.srv.iterator(offset)
+	defer it.Close()
+	ticker := time.NewTicker(tailPollInterval)
+	defer ticker.Stop()
+	for {
+		// like a consume stream, the tail checks it's still allowed every
+		// streamAuthorizeInterval
+		var err error
+		if time.Since(authorized) >= streamAuthorizeInterval {
+			err = h.srv.authorize(ctx, logResource, consumeAction)
+			authorized = time.Now()
+		}
+		var record *api.Record
+		if err == nil {
+			record, err = it.Next()
+		}
+		if err == io.EOF {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				continue
+			}
+		}
+		if err != nil {
+			fmt.Fprintf(w, "event: error\ndata: %s\n\n", status.Convert(err).Message())
+			flusher.Flush()
+			return
+		}
+		res := &api.ConsumeResponse{Record: record}
+		// like a consume stream, the tail slows down rather than failing
+		// when it's over quota
+		if err := h.srv.Quotas.wait(ctx, subject(ctx), consumeOperation, 0); err != nil {
+			return
+		}
+		data, err := protojson.Marshal(res.Record)
+		if err != nil {
+			return
+		}
+		if _, err := fmt.Fprintf(w, "id: %d\ndata: %s\n\n", offset, data); err != nil {
+			return
+		}
+		flusher.Flush()
+		h.srv.Quotas.charge(subject(ctx), consumeOperation, proto.Size(res))
+		offset++
+	}
+}
+
+// fetch writes the records from the offset in bulk as they're stored, for
+// consumers catching up, so they're sent without being decoded and, over
+// plain TCP, with sendfile. The body is frames to be read with
+// log.FrameReader and the Proglog-Next-Offset header the offset to fetch
+// from next.
+func (h *httpHandler) fetch(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	offset, err := offsetParam(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	maxBytes := uint64(defaultFetchBytes)
+	if v := r.URL.Query().Get("max_bytes"); v != "" {
+		if maxBytes, err = strconv.ParseUint(v, 10, 64); err != nil {
+			writeError(w, status.Error(codes.InvalidArgument, "invalid max_bytes"))
+			return
+		}
+	}
+	ctx, err := h.authenticate(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := h.srv.authorize(ctx, logResource, consumeAction); err != nil {
+		writeError(w, err)
+		return
+	}
+	f, ok := h.srv.CommitLog.(fetcher)
+	if !ok {
+		writeError(w, status.Error(codes.Unimplemented, "fetch unsupported"))
+		return
+	}
+	if err := h.srv.Quotas.admit(subject(ctx), consumeOperation, 0); err != nil {
+		writeError(w, err)
+		return
+	}
+	chunk, err := f.Fetch(offset, maxBytes)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer chunk.Close()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Proglog-Next-Offset", strconv.FormatUint(chunk.NextOffset, 10))
+	if chunk.Size >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(chunk.Size, 10))
+	}
+	n, _ := chunk.WriteTo(w)
+	h.srv.Quotas.charge(subject(ctx), consumeOperation, int(n))
+}
+
+func (h *httpHandler) servers(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	ctx, err := h.authenticate(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	res, err := h.srv.GetServers(ctx, &api.GetServersRequest{})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, res)
+}
+
+// backup streams a backup of the server's data dir. Errors once it's
+// started streaming can only be reported by cutting the backup short, which
+// restoring it finds.
+func (h *httpHandler) backup(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	ctx, err := h.authenticate(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := h.srv.authorize(ctx, clusterResource, adminAction); err != nil {
+		writeError(w, err)
+		return
+	}
+	if h.srv.Backuper == nil {
+		writeError(w, status.Error(codes.Unimplemented, "backups aren't supported"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-tar")
+	if err := h.srv.Backuper.Backup(w); err != nil {
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// authenticate returns the request's context carrying its subject. The
+// request's TLS state and Authorization header are passed to the
+// Authenticator as the gRPC peer and metadata they'd be over gRPC.
+func (h *httpHandler) authenticate(r *http.Request) (context.Context, error) {
+	p := &peer.Peer{Addr: remoteAddr(r.RemoteAddr)}
+	if r.TLS != nil {
+		p.AuthInfo = credentials.TLSInfo{State: *r.TLS}
+	}
+	ctx := peer.NewContext(r.Context(), p)
+	if v := r.Header.Get("Authorization"); v != "" {
+		ctx = metadata.NewIncomingContext(ctx, metadata.Pairs("authorization", v))
+	}
+	return h.srv.authenticate(ctx)
+}
+
+// remoteAddr is an http.Request's RemoteAddr as a net.Addr
+type remoteAddr string
+
+func (a remoteAddr) Network() string { return "tcp" }
+
+func (a remoteAddr) String() string { return string(a) }
+
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	return false
+}
+
+func offsetParam(r *http.Request) (uint64, error) {
+	v := r.URL.Query().Get("offset")
+	if v == "" {
+		return 0, nil
+	}
+	offset, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		return 0, status.Error(codes.InvalidArgument, "invalid offset")
+	}
+	return offset, nil
+}
+
+func writeJSON(w http.ResponseWriter, m proto.Message) {
+	b, err := protojson.Marshal(m)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// writeError writes err as a google.rpc.Status JSON body with the HTTP
+// status matching its gRPC code, and its RetryInfo as a Retry-After header.
+// Writes to a follower are misdirected, with the leader's address in the
+// Proglog-Leader header if it's known.
+func writeError(w http.ResponseWriter, err error) {
+	st := status.Convert(err)
+	b, _ := protojson.Marshal(st.Proto())
+	for _, d := range st.Details() {
+		if info, ok := d.(*errdetails.RetryInfo); ok {
+			secs := math.Ceil(info.RetryDelay.AsDuration().Seconds())
+			w.Header().Set("Retry-After", strconv.Itoa(int(secs)))
+		}
+	}
+	code := httpStatus(st.Code())
+	var notLeader api.ErrNotLeader
+	if errors.As(err, &notLeader) {
+		code = http.StatusMisdirectedRequest
+		if notLeader.Leader != "" {
+			w.Header().Set(leaderHeader, notLeader.Leader)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(b)
+}
+
+func httpStatus(code codes.Code) int {
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.InvalidArgument, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,299 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	api "github.com/michael-diggin/proglog/api/v1"
+	"github.com/michael-diggin/proglog/internal/auth"
+	"github.com/michael-diggin/proglog/internal/config"
+	"github.com/michael-diggin/proglog/internal/log"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestHTTPGateway(t *testing.T) {
+	for scenario, fn := range map[string]func(
+		t *testing.T, url string, rootClient, nobodyClient *http.Client,
+	){
+		"produce-consume succeeds":  testHTTPProduceConsume,
+		"consume past log fails":    testHTTPConsumePastBoundary,
+		"tail streams records":      testHTTPTail,
+		"fetch returns raw records": testHTTPFetch,
+		"servers lists the cluster": testHTTPServers,
+		"backup streams a tarball":  testHTTPBackup,
+		"unauthorized fails":        testHTTPUnauthorized,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			url, rootClient, nobodyClient, teardown := setupHTTPTest(t)
+			defer teardown()
+			fn(t, url, rootClient, nobodyClient)
+		})
+	}
+}
+
+func setupHTTPTest(t *testing.T) (string, *http.Client, *http.Client, func()) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "http-test")
+	require.NoError(t, err)
+	clog, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+
+	handler, err := NewHTTPHandler(&Config{
+		CommitLog:   clog,
+		Authorizer:  auth.New(config.ACLModelFile, config.ACLPolicyFile),
+		GetServerer: &getServers{},
+		Backuper:    &backuper{},
+	})
+	require.NoError(t, err)
+
+	serverTLSConfig, err := config.SetUpTLSConfig(config.TLSConfig{
+		CertFile:      config.ServerCertFile,
+		KeyFile:       config.ServerKeyFile,
+		CAFile:        config.CAFile,
+		ServerAddress: "127.0.0.1",
+		Server:        true,
+	})
+	require.NoError(t, err)
+	srv := httptest.NewUnstartedServer(handler)
+	srv.TLS = serverTLSConfig
+	srv.StartTLS()
+
+	newClient := func(crtPath, keyPath string) *http.Client {
+		tlsConfig, err := config.SetUpTLSConfig(config.TLSConfig{
+			CertFile:      crtPath,
+			KeyFile:       keyPath,
+			CAFile:        config.CAFile,
+			ServerAddress: "127.0.0.1",
+		})
+		require.NoError(t, err)
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	}
+	rootClient := newClient(config.RootClientCertFile, config.RootClientKeyFile)
+	nobodyClient := newClient(config.NobodyClientCertFile, config.NobodyClientKeyFile)
+
+	return srv.URL, rootClient, nobodyClient, func() {
+		srv.Close()
+		clog.Remove()
+	}
+}
+
+func testHTTPProduceConsume(t *testing.T, url string, client, _ *http.Client) {
+	res, err := client.Post(url+"/v1/produce", "application/json",
+		strings.NewReader(`{"record":{"Value":"aGVsbG8gd29ybGQ="}}`))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	produce := &api.ProduceResponse{}
+	readJSON(t, res, produce)
+	require.Equal(t, uint64(0), produce.Offset)
+
+	res, err = client.Get(fmt.Sprintf("%s/v1/consume?offset=%d", url, produce.Offset))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	consume := &api.ConsumeResponse{}
+	readJSON(t, res, consume)
+	require.Equal(t, []byte("hello world"), consume.Record.Value)
+}
+
+func testHTTPConsumePastBoundary(t *testing.T, url string, client, _ *http.Client) {
+	res, err := client.Get(url + "/v1/consume?offset=1")
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusNotFound, res.StatusCode)
+
+	res, err = client.Get(url + "/v1/produce")
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusMethodNotAllowed, res.StatusCode)
+}
+
+func testHTTPTail(t *testing.T, url string, client, _ *http.Client) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url+"/v1/tail", nil)
+	require.NoError(t, err)
+	req.Header.Set("Last-Event-ID", "0")
+	res, err := client.Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+
+	// produced after the tail started, the first is skipped by Last-Event-ID
+	for _, v := range []string{"Zmlyc3Q=", "c2Vjb25k"} {
+		res, err := client.Post(url+"/v1/produce", "application/json",
+			strings.NewReader(fmt.Sprintf(`{"record":{"Value":"%s"}}`, v)))
+		require.NoError(t, err)
+		res.Body.Close()
+		require.Equal(t, http.StatusOK, res.StatusCode)
+	}
+
+	scanner := bufio.NewScanner(res.Body)
+	require.True(t, scanner.Scan())
+	require.Equal(t, "id: 1", scanner.Text())
+	require.True(t, scanner.Scan())
+	record := &api.Record{}
+	data := strings.TrimPrefix(scanner.Text(), "data: ")
+	require.NoError(t, protojson.Unmarshal([]byte(data), record))
+	require.Equal(t, []byte("second"), record.Value)
+	require.Equal(t, uint64(1), record.Offset)
+}
+
+func testHTTPFetch(t *testing.T, url string, client, _ *http.Client) {
+	for _, v := range []string{"Zmlyc3Q=", "c2Vjb25k", "dGhpcmQ="} {
+		res, err := client.Post(url+"/v1/produce", "application/json",
+			strings.NewReader(fmt.Sprintf(`{"record":{"Value":"%s"}}`, v)))
+		require.NoError(t, err)
+		res.Body.Close()
+		require.Equal(t, http.StatusOK, res.StatusCode)
+	}
+
+	fetch := func(query string) ([]string, string) {
+		res, err := client.Get(url + "/v1/fetch?" + query)
+		require.NoError(t, err)
+		defer res.Body.Close()
+		require.Equal(t, http.StatusOK, res.StatusCode)
+		frames := log.NewFrameReader(res.Body)
+		var values []string
+		for {
+			record, err := frames.Next()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			values = append(values, string(record.Value))
+		}
+		return values, res.Header.Get("Proglog-Next-Offset")
+	}
+	values, next := fetch("offset=0")
+	require.Equal(t, []string{"first", "second", "third"}, values)
+	require.Equal(t, "3", next)
+	// at least one record is returned, however small max_bytes is
+	values, next = fetch("offset=1&max_bytes=1")
+	require.Equal(t, []string{"second"}, values)
+	require.Equal(t, "2", next)
+
+	res, err := client.Get(url + "/v1/fetch?offset=3")
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusNotFound, res.StatusCode)
+}
+
+func testHTTPServers(t *testing.T, url string, client, _ *http.Client) {
+	res, err := client.Get(url + "/v1/servers")
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	servers := &api.GetServersResponse{}
+	readJSON(t, res, servers)
+	require.Equal(t, 1, len(servers.Servers))
+	require.True(t, servers.Servers[0].IsLeader)
+}
+
+func testHTTPBackup(t *testing.T, url string, client, _ *http.Client) {
+	res, err := client.Get(url + "/v1/backup")
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, "application/x-tar", res.Header.Get("Content-Type"))
+	b, err := ioutil.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.Equal(t, "backup", string(b))
+}
+
+func testHTTPUnauthorized(t *testing.T, url string, _, client *http.Client) {
+	res, err := client.Post(url+"/v1/produce", "application/json",
+		strings.NewReader(`{"record":{"Value":"aGVsbG8gd29ybGQ="}}`))
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusForbidden, res.StatusCode)
+
+	res, err = client.Get(url + "/v1/tail")
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusForbidden, res.StatusCode)
+
+	res, err = client.Get(url + "/v1/backup")
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusForbidden, res.StatusCode)
+}
+
+func TestHTTPProduceChecks(t *testing.T) {
+	large := `{"record":{"Value":"` + strings.Repeat("A", 200<<10) + `"}}`
+	small := `{"record":{"Value":"aGk="}}`
+	for scenario, test := range map[string]struct {
+		subject string
+		body    string
+		code    int
+		leader  string
+	}{
+		"anonymous produces fail before they're read": {"", large, http.StatusForbidden, ""},
+		"large produces fail":                         {"root", large, http.StatusBadRequest, ""},
+		"produces to followers are misdirected":       {"root", small, http.StatusMisdirectedRequest, "127.0.0.1:8400"},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			handler, err := NewHTTPHandler(&Config{
+				CommitLog:      follower{leader: "127.0.0.1:8400"},
+				Authorizer:     auth.New(config.ACLModelFile, config.ACLPolicyFile),
+				Authenticator:  subjectAuthenticator(test.subject),
+				MaxRecordBytes: 8,
+			})
+			require.NoError(t, err)
+			req := httptest.NewRequest(http.MethodPost, "/v1/produce", strings.NewReader(test.body))
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			require.Equal(t, test.code, rec.Code)
+			require.Equal(t, test.leader, rec.Header().Get(leaderHeader))
+		})
+	}
+}
+
+// follower is a commit log on a server that isn't the leader
+type follower struct {
+	leader string
+}
+
+func (f follower) Append(*api.Record) (uint64, error) {
+	return 0, api.ErrNotLeader{Leader: f.leader}
+}
+
+func (f follower) Read(off uint64) (*api.Record, error) {
+	return nil, api.ErrOffsetOutOfRange{Offset: off}
+}
+
+// subjectAuthenticator authenticates every request as the subject
+type subjectAuthenticator string
+
+func (s subjectAuthenticator) Authenticate(ctx context.Context) (string, error) {
+	return string(s), nil
+}
+
+func readJSON(t *testing.T, res *http.Response, m proto.Message) {
+	t.Helper()
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.NoError(t, protojson.Unmarshal(b, m))
+}
+
+type getServers struct{}
+
+func (getServers) GetServers() ([]*api.Server, error) {
+	return []*api.Server{{Id: "0", RpcAddr: "127.0.0.1:8400", IsLeader: true}}, nil
+}
+
+type backuper struct{}
+
+func (backuper) Backup(w io.Writer) error {
+	_, err := io.WriteString(w, "backup")
+	return err
+}
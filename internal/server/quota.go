@@ -0,0 +1,356 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/michael-diggin/proglog/internal/config"
+	"go.uber.org/zap"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// defaultQuotaSubject is the subject whose quota applies to subjects
+// without their own
+const defaultQuotaSubject = "*"
+
+// Quota limits how fast a subject can produce and consume, in bytes and
+// requests per second. Zero values are unlimited. Streamed messages each
+// count as a request.
+type Quota struct {
+	ProduceBytes    float64 `json:"produce_bytes"`
+	ProduceRequests float64 `json:"produce_requests"`
+	ConsumeBytes    float64 `json:"consume_bytes"`
+	ConsumeRequests float64 `json:"consume_requests"`
+}
+
+// Quotas enforces each subject's Quota. Unary requests over quota fail
+// with codes.ResourceExhausted and a RetryInfo detail saying when to retry,
+// streams are slowed down to stay within it.
+type Quotas struct {
+	file string
+
+	mu      sync.Mutex
+	quotas  map[string]Quota
+	buckets map[string]*quotaBuckets
+	now     func() time.Time
+
+	watcher io.Closer
+}
+
+// NewQuotas returns Quotas enforcing the quotas by subject. The quota of
+// the "*" subject applies to subjects without their own.
+func NewQuotas(quotas map[string]Quota) *Quotas {
+	q := &Quotas{now: time.Now}
+	q.SetQuotas(quotas)
+	return q
+}
+
+// LoadQuotas reads Quotas from a JSON file of quotas by subject, e.g.
+//
+//	{"*": {"produce_bytes": 1048576}, "root": {"produce_requests": 1000}}
+func LoadQuotas(file string) (*Quotas, error) {
+	q := NewQuotas(nil)
+	q.file = file
+	if err := q.Reload(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// SetQuotas replaces the quotas, resetting every subject's usage
+func (q *Quotas) SetQuotas(quotas map[string]Quota) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.quotas = quotas
+	q.buckets = make(map[string]*quotaBuckets)
+}
+
+// Reload replaces the quotas with the quota file's
+func (q *Quotas) Reload() error {
+	b, err := ioutil.ReadFile(q.file)
+	if err != nil {
+		return fmt.Errorf("failed to read quota file: %w", err)
+	}
+	var quotas map[string]Quota
+	if err := json.Unmarshal(b, &quotas); err != nil {
+		return fmt.Errorf("failed to parse quota file: %w", err)
+	}
+	q.SetQuotas(quotas)
+	return nil
+}
+
+// Watch reloads the quotas whenever the quota file changes, until Close is
+// called. Quota files that fail to load are logged and ignored.
+func (q *Quotas) Watch() (err error) {
+	q.watcher, err = config.WatchFile(q.file, func() {
+		logger := zap.L().Named("server")
+		if err := q.Reload(); err != nil {
+			logger.Error("failed to reload quotas", zap.Error(err))
+			return
+		}
+		logger.Info("reloaded quotas", zap.String("file", q.file))
+	})
+	return err
+}
+
+// Close stops watching the quota file
+func (q *Quotas) Close() error {
+	if q == nil || q.watcher == nil {
+		return nil
+	}
+	return q.watcher.Close()
+}
+
+type quotaOperation int
+
+const (
+	produceOperation quotaOperation = iota
+	consumeOperation
+)
+
+func (o quotaOperation) String() string {
+	if o == produceOperation {
+		return produceAction
+	}
+	return consumeAction
+}
+
+// quotaOperations maps the Log service's methods to the quota they use
+var quotaOperations = map[string]quotaOperation{
+	"Produce":       produceOperation,
+	"ProduceStream": produceOperation,
+	"Consume":       consumeOperation,
+	"ConsumeStream": consumeOperation,
+}
+
+// quotaBuckets holds a subject's request and byte buckets by operation
+type quotaBuckets [2]struct {
+	requests *bucket
+	bytes    *bucket
+}
+
+func (q *Quotas) bucketsFor(subject string) *quotaBuckets {
+	b, ok := q.buckets[subject]
+	if ok {
+		return b
+	}
+	quota, ok := q.quotas[subject]
+	if !ok {
+		quota = q.quotas[defaultQuotaSubject]
+	}
+	now := q.now()
+	b = &quotaBuckets{}
+	b[produceOperation].requests = newBucket(quota.ProduceRequests, now)
+	b[produceOperation].bytes = newBucket(quota.ProduceBytes, now)
+	b[consumeOperation].requests = newBucket(quota.ConsumeRequests, now)
+	b[consumeOperation].bytes = newBucket(quota.ConsumeBytes, now)
+	q.buckets[subject] = b
+	return b
+}
+
+// reserve takes a request and n bytes from the subject's quota for the
+// operation, or returns how long until they're available. Consumes
+// reserve no bytes, they're charged once the records have been read.
+func (q *Quotas) reserve(subject string, op quotaOperation, n int) time.Duration {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	b := &q.bucketsFor(subject)[op]
+	now := q.now()
+	wait := b.requests.wait(now, 1)
+	if w := b.bytes.wait(now, float64(n)); w > wait {
+		wait = w
+	}
+	if wait > 0 {
+		return wait
+	}
+	b.requests.take(now, 1)
+	b.bytes.take(now, float64(n))
+	return 0
+}
+
+// charge takes n bytes from the subject's quota for the operation after
+// the fact, holding off its next requests until it's paid them back. Nil
+// Quotas, like the ones below, are unlimited.
+func (q *Quotas) charge(subject string, op quotaOperation, n int) {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.bucketsFor(subject)[op].bytes.take(q.now(), float64(n))
+}
+
+// admit reserves a request and n bytes, failing with ResourceExhausted if
+// the subject is over quota
+func (q *Quotas) admit(subject string, op quotaOperation, n int) error {
+	if q == nil {
+		return nil
+	}
+	wait := q.reserve(subject, op, n)
+	if wait == 0 {
+		return nil
+	}
+	st := status.Newf(codes.ResourceExhausted, "%s exceeded its %s quota", subject, op)
+	if d, err := st.WithDetails(&errdetails.RetryInfo{
+		RetryDelay: durationpb.New(wait),
+	}); err == nil {
+		st = d
+	}
+	return st.Err()
+}
+
+// wait blocks until the subject's quota has a request and n bytes
+func (q *Quotas) wait(ctx context.Context, subject string, op quotaOperation, n int) error {
+	if q == nil {
+		return nil
+	}
+	for {
+		wait := q.reserve(subject, op, n)
+		if wait == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// UnaryServerInterceptor enforces quotas on unary requests. It must run
+// after the request has been authenticated.
+func (q *Quotas) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(
+		ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler,
+	) (interface{}, error) {
+		op, ok := quotaOperations[path.Base(info.FullMethod)]
+		if !ok {
+			return handler(ctx, req)
+		}
+		subject := subject(ctx)
+		var n int
+		if op == produceOperation {
+			n = proto.Size(req.(proto.Message))
+		}
+		if err := q.admit(subject, op, n); err != nil {
+			return nil, err
+		}
+		res, err := handler(ctx, req)
+		if err == nil && op == consumeOperation {
+			q.charge(subject, op, proto.Size(res.(proto.Message)))
+		}
+		return res, err
+	}
+}
+
+// StreamServerInterceptor slows streams down to keep them within quota. It
+// must run after the stream has been authenticated.
+func (q *Quotas) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(
+		srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler,
+	) error {
+		op, ok := quotaOperations[path.Base(info.FullMethod)]
+		if !ok {
+			return handler(srv, stream)
+		}
+		return handler(srv, &quotaStream{
+			ServerStream: stream,
+			quotas:       q,
+			subject:      subject(stream.Context()),
+			op:           op,
+		})
+	}
+}
+
+// quotaStream holds back produced messages until they're within quota and
+// consumed messages until the previous ones have been paid for
+type quotaStream struct {
+	grpc.ServerStream
+	quotas  *Quotas
+	subject string
+	op      quotaOperation
+}
+
+func (s *quotaStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	if s.op != produceOperation {
+		return nil
+	}
+	return s.quotas.wait(s.Context(), s.subject, s.op, proto.Size(m.(proto.Message)))
+}
+
+func (s *quotaStream) SendMsg(m interface{}) error {
+	if s.op != consumeOperation {
+		return s.ServerStream.SendMsg(m)
+	}
+	if err := s.quotas.wait(s.Context(), s.subject, s.op, 0); err != nil {
+		return err
+	}
+	if err := s.ServerStream.SendMsg(m); err != nil {
+		return err
+	}
+	s.quotas.charge(s.subject, s.op, proto.Size(m.(proto.Message)))
+	return nil
+}
+
+// bucket is a token bucket refilled at rate tokens per second, holding up
+// to a second's worth. A nil bucket is unlimited.
+type bucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(rate float64, now time.Time) *bucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &bucket{rate: rate, tokens: rate, last: now}
+}
+
+func (b *bucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+}
+
+// wait returns how long until the bucket has n tokens, or is full for
+// requests bigger than it
+func (b *bucket) wait(now time.Time, n float64) time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.refill(now)
+	if n > b.rate {
+		n = b.rate
+	}
+	if b.tokens >= n {
+		return 0
+	}
+	return time.Duration(math.Ceil((n - b.tokens) / b.rate * float64(time.Second)))
+}
+
+// take removes n tokens, leaving the bucket in debt if it doesn't have them
+func (b *bucket) take(now time.Time, n float64) {
+	if b == nil {
+		return
+	}
+	b.refill(now)
+	b.tokens -= n
+}
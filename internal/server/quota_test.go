@@ -0,0 +1,145 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	api "github.com/michael-diggin/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestQuotas(t *testing.T) {
+	q := NewQuotas(map[string]Quota{
+		"*":    {ProduceRequests: 2},
+		"root": {ProduceBytes: 100, ConsumeRequests: 1},
+	})
+	now := time.Unix(0, 0)
+	q.now = func() time.Time { return now }
+
+	// the default quota applies to subjects without their own
+	require.NoError(t, q.admit("nobody", produceOperation, 1<<20))
+	require.NoError(t, q.admit("nobody", produceOperation, 1<<20))
+	err := q.admit("nobody", produceOperation, 0)
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+	require.Equal(t, 500*time.Millisecond, retryDelay(t, err))
+
+	// a subject's usage doesn't count against anyone else's
+	require.NoError(t, q.admit("root", produceOperation, 60))
+	err = q.admit("root", produceOperation, 60)
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+	require.Equal(t, 200*time.Millisecond, retryDelay(t, err))
+	now = now.Add(200 * time.Millisecond)
+	require.NoError(t, q.admit("root", produceOperation, 60))
+
+	// requests bigger than the bucket go through once it's full
+	now = now.Add(time.Second)
+	require.NoError(t, q.admit("root", produceOperation, 1000))
+	err = q.admit("root", produceOperation, 1)
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+
+	// consumes are charged after the fact
+	require.NoError(t, q.admit("root", consumeOperation, 0))
+	q.charge("root", consumeOperation, 1<<20)
+	require.Error(t, q.admit("root", consumeOperation, 0))
+
+	// replacing the quotas resets usage
+	q.SetQuotas(map[string]Quota{"root": {ProduceBytes: 100}})
+	require.NoError(t, q.admit("root", produceOperation, 60))
+	require.NoError(t, q.admit("nobody", produceOperation, 0))
+
+	var unlimited *Quotas
+	require.NoError(t, unlimited.admit("root", produceOperation, 1<<20))
+	require.NoError(t, unlimited.Close())
+}
+
+func TestQuotasWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quotas-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "quotas.json")
+	err = ioutil.WriteFile(file, []byte(`{"root": {"produce_requests": 1}}`), 0600)
+	require.NoError(t, err)
+
+	q, err := LoadQuotas(file)
+	require.NoError(t, err)
+	require.NoError(t, q.Watch())
+	defer q.Close()
+	require.NoError(t, q.admit("root", produceOperation, 0))
+	require.Error(t, q.admit("root", produceOperation, 0))
+
+	// broken quota files are ignored
+	err = ioutil.WriteFile(file, []byte(`{"root":`), 0600)
+	require.NoError(t, err)
+	time.Sleep(100 * time.Millisecond)
+	require.Error(t, q.admit("root", produceOperation, 0))
+
+	err = ioutil.WriteFile(file, []byte(`{}`), 0600)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return q.admit("root", produceOperation, 0) == nil
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestQuotaInterceptors(t *testing.T) {
+	quotas := NewQuotas(map[string]Quota{
+		"root": {ProduceRequests: 1, ConsumeBytes: 1},
+	})
+	client, _, _, teardown := setupTest(t, func(cfg *Config) {
+		cfg.Quotas = quotas
+	})
+	defer teardown()
+	ctx := context.Background()
+
+	record := &api.Record{Value: []byte("hello world")}
+	_, err := client.Produce(ctx, &api.ProduceRequest{Record: record})
+	require.NoError(t, err)
+	_, err = client.Produce(ctx, &api.ProduceRequest{Record: record})
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+	require.True(t, retryDelay(t, err) > 0)
+
+	// the first consume puts root over its byte quota until it's paid back
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 0})
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+
+	// streams are slowed down instead
+	quotas.SetQuotas(map[string]Quota{"root": {ProduceRequests: 10}})
+	stream, err := client.ProduceStream(ctx)
+	require.NoError(t, err)
+	start := time.Now()
+	for i := 0; i < 12; i++ {
+		require.NoError(t, stream.Send(&api.ProduceRequest{Record: record}))
+		_, err := stream.Recv()
+		require.NoError(t, err)
+	}
+	require.True(t, time.Since(start) >= 100*time.Millisecond)
+}
+
+func TestWriteErrorRetryAfter(t *testing.T) {
+	q := NewQuotas(map[string]Quota{"root": {ProduceRequests: 0.5}})
+	require.NoError(t, q.admit("root", produceOperation, 0))
+	w := httptest.NewRecorder()
+	writeError(w, q.admit("root", produceOperation, 0))
+	require.Equal(t, 429, w.Code)
+	require.Equal(t, "2", w.Header().Get("Retry-After"))
+}
+
+func retryDelay(t *testing.T, err error) time.Duration {
+	t.Helper()
+	for _, d := range status.Convert(err).Details() {
+		if info, ok := d.(*errdetails.RetryInfo); ok {
+			return info.RetryDelay.AsDuration()
+		}
+	}
+	t.Fatal("no RetryInfo in error details")
+	return 0
+}
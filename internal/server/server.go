@@ -1,15 +1,19 @@
 package server
 
 import (
+	"bufio"
 	"context"
+	"io"
+	"sync"
 	"time"
 
 	api "github.com/michael-diggin/proglog/api/v1"
+	"github.com/michael-diggin/proglog/internal/auth"
+	"github.com/michael-diggin/proglog/internal/log"
+	"github.com/michael-diggin/proglog/internal/tracing"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/health"
-	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
 
 	healthpb "google.golang.org/grpc/health/grpc_health_v1"
@@ -21,14 +25,30 @@ import (
 	"go.opencensus.io/plugin/ocgrpc"
 	"go.opencensus.io/stats/view"
 	"go.opencensus.io/trace"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
 
+// Requests are authorized as an action on one of the resources. Policies
+// can match resources with casbin's keyMatch patterns, like "*". There are
+// no topics yet: every record is in the one log, so produces and consumes
+// are all authorized on the log resource.
 const (
-	objectWildCard = "*"
+	logResource     = "log"
+	clusterResource = "cluster"
+	policyResource  = "policy"
+
 	produceAction  = "produce"
 	consumeAction  = "consume"
+	describeAction = "describe"
+	adminAction    = "admin"
+
+	// wildcardResource is the object every request was authorized on
+	// before there were resources. Models that match objects exactly, with
+	// r.obj == p.obj, only allow requests through policies on it, so it's
+	// still authorized on when a request's resource isn't.
+	wildcardResource = "*"
 )
 
 type CommitLog interface {
@@ -36,18 +56,86 @@ type CommitLog interface {
 	Read(uint64) (*api.Record, error)
 }
 
+// contextReader is implemented by commit logs that trace reads as part of
+// the request's trace
+type contextReader interface {
+	ReadContext(context.Context, uint64) (*api.Record, error)
+}
+
+// iterable is implemented by commit logs that read records in order without
+// looking up each one
+type iterable interface {
+	NewIterator(offset uint64) *log.Iterator
+}
+
+// fetcher is implemented by commit logs that can return records in bulk as
+// they're stored
+type fetcher interface {
+	Fetch(offset, maxBytes uint64) (*log.Chunk, error)
+}
+
 type Authorizer interface {
 	Authorize(subject, object, action string) error
 }
 
+// policyGetter is implemented by authorizers that can return their policy
+type policyGetter interface {
+	Policy() []byte
+}
+
+// PolicySetter sets the ACL policy of every server in the cluster
+type PolicySetter interface {
+	SetPolicy(policy []byte) error
+}
+
+// Authenticator identifies the subject making the request in ctx
+type Authenticator interface {
+	Authenticate(ctx context.Context) (string, error)
+}
+
+// Backuper writes a backup of the server's data dir
+type Backuper interface {
+	Backup(w io.Writer) error
+}
+
 type GetServerer interface {
 	GetServers() ([]*api.Server, error)
 }
 
+type ServerWatcher interface {
+	WatchServers(done <-chan struct{}) <-chan []*api.Server
+}
+
 type Config struct {
-	CommitLog   CommitLog
-	Authorizer  Authorizer
-	GetServerer GetServerer
+	CommitLog  CommitLog
+	Authorizer Authorizer
+	// Authenticator defaults to taking the subject from the client
+	// certificate's common name
+	Authenticator Authenticator
+	GetServerer   GetServerer
+	ServerWatcher ServerWatcher
+	PolicySetter  PolicySetter
+	// Backuper, if set, serves backups over gRPC and HTTP
+	Backuper Backuper
+	// Quotas, if set, limits the rate each subject produces and consumes at
+	Quotas *Quotas
+	// MaxRecordBytes is the largest record value produces may have, 0 is
+	// unlimited. Requests are allowed to be this big plus some overhead,
+	// raising or lowering gRPC's default max of 4MB.
+	MaxRecordBytes uint64
+}
+
+// maxRequestOverhead is how much bigger than MaxRecordBytes a produce
+// request may be, for its record's headers and the request's framing
+const maxRequestOverhead = 64 << 10
+
+// maxRequestBytes returns the largest request the server accepts, or 0 for
+// the default
+func (c *Config) maxRequestBytes() int {
+	if c.MaxRecordBytes == 0 {
+		return 0
+	}
+	return int(c.MaxRecordBytes) + maxRequestOverhead
 }
 
 var _ api.LogServer = (*grpcServer)(nil)
@@ -67,22 +155,46 @@ func NewGRPCSever(config *Config, opts ...grpc.ServerOption) (*grpc.Server, erro
 		}),
 	}
 
-	trace.ApplyConfig(trace.Config{DefaultSampler: trace.AlwaysSample()})
+	srv, err := newgrpcServer(config)
+	if err != nil {
+		return nil, err
+	}
+
 	if err := view.Register(ocgrpc.DefaultServerViews...); err != nil {
 		return nil, err
 	}
 
-	opts = append(opts, grpc.StreamInterceptor(
-		grpc_middleware.ChainStreamServer(
-			grpc_ctxtags.StreamServerInterceptor(),
-			grpc_zap.StreamServerInterceptor(logger, zapOpts...),
-			grpc_auth.StreamServerInterceptor(authenticate),
-		)), grpc.UnaryInterceptor(grpc_middleware.ChainUnaryServer(
+	streamInterceptors := []grpc.StreamServerInterceptor{
+		otelgrpc.StreamServerInterceptor(),
+		grpc_ctxtags.StreamServerInterceptor(),
+		grpc_zap.StreamServerInterceptor(logger, zapOpts...),
+		grpc_auth.StreamServerInterceptor(srv.authenticate),
+	}
+	unaryInterceptors := []grpc.UnaryServerInterceptor{
+		otelgrpc.UnaryServerInterceptor(),
 		grpc_ctxtags.UnaryServerInterceptor(),
 		grpc_zap.UnaryServerInterceptor(logger, zapOpts...),
-		grpc_auth.UnaryServerInterceptor(authenticate),
-	)),
-		grpc.StatsHandler(&ocgrpc.ServerHandler{}),
+		grpc_auth.UnaryServerInterceptor(srv.authenticate),
+	}
+	// quotas are kept per subject, so they're enforced once the request's
+	// been authenticated
+	if config.Quotas != nil {
+		streamInterceptors = append(streamInterceptors, config.Quotas.StreamServerInterceptor())
+		unaryInterceptors = append(unaryInterceptors, config.Quotas.UnaryServerInterceptor())
+	}
+
+	if n := config.maxRequestBytes(); n > 0 {
+		// prepended so the caller's options take precedence
+		opts = append([]grpc.ServerOption{grpc.MaxRecvMsgSize(n)}, opts...)
+	}
+	opts = append(opts,
+		grpc.StreamInterceptor(grpc_middleware.ChainStreamServer(streamInterceptors...)),
+		grpc.UnaryInterceptor(grpc_middleware.ChainUnaryServer(unaryInterceptors...)),
+		// OpenCensus only records the metrics views, traces are recorded
+		// by the OpenTelemetry interceptors
+		grpc.StatsHandler(&ocgrpc.ServerHandler{
+			StartOptions: trace.StartOptions{Sampler: trace.NeverSample()},
+		}),
 	)
 	gsrv := grpc.NewServer(opts...)
 
@@ -90,23 +202,26 @@ func NewGRPCSever(config *Config, opts ...grpc.ServerOption) (*grpc.Server, erro
 	hsrv.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
 	healthpb.RegisterHealthServer(gsrv, hsrv)
 
-	srv, err := newgrpcServer(config)
-	if err != nil {
-		return nil, err
-	}
 	api.RegisterLogServer(gsrv, srv)
 	return gsrv, nil
 }
 
 func newgrpcServer(config *Config) (srv *grpcServer, err error) {
+	if config.Authenticator == nil {
+		config.Authenticator = auth.NewTLS(auth.CommonName)
+	}
 	return &grpcServer{Config: config}, nil
 }
 
 // Produce implements the Produce endpoint
 func (s *grpcServer) Produce(ctx context.Context, req *api.ProduceRequest) (*api.ProduceResponse, error) {
-	if err := s.Authorizer.Authorize(subject(ctx), objectWildCard, produceAction); err != nil {
+	if err := s.authorize(ctx, logResource, produceAction); err != nil {
 		return nil, err
 	}
+	if err := api.CheckRecordSize(req.Record, s.MaxRecordBytes); err != nil {
+		return nil, err
+	}
+	tracing.Inject(ctx, req.Record)
 	offset, err := s.CommitLog.Append(req.Record)
 	if err != nil {
 		return nil, err
@@ -116,17 +231,26 @@ func (s *grpcServer) Produce(ctx context.Context, req *api.ProduceRequest) (*api
 
 // Consume implements the Consume endpoint
 func (s *grpcServer) Consume(ctx context.Context, req *api.ConsumeRequest) (*api.ConsumeResponse, error) {
-	if err := s.Authorizer.Authorize(subject(ctx), objectWildCard, consumeAction); err != nil {
+	if err := s.authorize(ctx, logResource, consumeAction); err != nil {
 		return nil, err
 	}
-	record, err := s.CommitLog.Read(req.Offset)
+	var record *api.Record
+	var err error
+	if r, ok := s.CommitLog.(contextReader); ok {
+		record, err = r.ReadContext(ctx, req.Offset)
+	} else {
+		record, err = s.CommitLog.Read(req.Offset)
+	}
 	if err != nil {
 		return nil, err
 	}
 	return &api.ConsumeResponse{Record: record}, nil
 }
 
-// ProduceStream implements the streaming endpoint
+// ProduceStream implements the streaming endpoint. Each record is checked
+// against MaxRecordBytes as it's produced. A stream's records aren't limited
+// in total: each is its own raft entry, so there's no batch for a server to
+// bound, and how fast a stream produces is left to the subject's Quota.
 func (s *grpcServer) ProduceStream(stream api.Log_ProduceStreamServer) error {
 	for {
 		req, err := stream.Recv()
@@ -145,28 +269,92 @@ func (s *grpcServer) ProduceStream(stream api.Log_ProduceStreamServer) error {
 
 // ConsumeStream impelements the streaming endpoint
 func (s *grpcServer) ConsumeStream(req *api.ConsumeRequest, stream api.Log_ConsumeStreamServer) error {
+	ctx := stream.Context()
+	if err := s.authorize(ctx, logResource, consumeAction); err != nil {
+		return err
+	}
+	authorized := time.Now()
+	it := s.iterator(req.Offset)
+	defer it.Close()
+	ticker := time.NewTicker(streamPollInterval)
+	defer ticker.Stop()
 	for {
-		select {
-		case <-stream.Context().Done():
-			return nil
-		default:
-			res, err := s.Consume(stream.Context(), req)
-			switch err.(type) {
-			case nil:
-			case api.ErrOffsetOutOfRange:
-				continue
-			default:
+		// the policy's checked again every streamAuthorizeInterval rather
+		// than for every record, so streams stop soon after they're no
+		// longer allowed
+		if time.Since(authorized) >= streamAuthorizeInterval {
+			if err := s.authorize(ctx, logResource, consumeAction); err != nil {
 				return err
 			}
-			if err = stream.Send(res); err != nil {
-				return err
+			authorized = time.Now()
+		}
+		record, err := it.Next()
+		if err == io.EOF {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-ticker.C:
+				continue
 			}
-			req.Offset++
 		}
+		if err != nil {
+			return err
+		}
+		if err = stream.Send(&api.ConsumeResponse{Record: record}); err != nil {
+			return err
+		}
+	}
+}
+
+// streamPollInterval is how often a consume stream checks for new records
+// once it has caught up
+const streamPollInterval = 10 * time.Millisecond
+
+// streamAuthorizeInterval is how often a consume stream checks it's still
+// allowed
+const streamAuthorizeInterval = time.Second
+
+// recordIterator reads records in order, returning io.EOF once it's read
+// the last one
+type recordIterator interface {
+	Next() (*api.Record, error)
+	Close() error
+}
+
+// iterator returns an iterator of the commit log's records from offset,
+// reading them one at a time if the commit log doesn't have iterators
+func (s *grpcServer) iterator(offset uint64) recordIterator {
+	if l, ok := s.CommitLog.(iterable); ok {
+		return l.NewIterator(offset)
 	}
+	return &readIterator{log: s.CommitLog, offset: offset}
+}
+
+type readIterator struct {
+	log    CommitLog
+	offset uint64
+}
+
+func (it *readIterator) Next() (*api.Record, error) {
+	record, err := it.log.Read(it.offset)
+	if _, ok := err.(api.ErrOffsetOutOfRange); ok {
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	it.offset++
+	return record, nil
+}
+
+func (it *readIterator) Close() error {
+	return nil
 }
 
 func (s *grpcServer) GetServers(ctx context.Context, req *api.GetServersRequest) (*api.GetServersResponse, error) {
+	if err := s.authorizeDescribe(ctx); err != nil {
+		return nil, err
+	}
 	servers, err := s.GetServerer.GetServers()
 	if err != nil {
 		return nil, err
@@ -174,16 +362,140 @@ func (s *grpcServer) GetServers(ctx context.Context, req *api.GetServersRequest)
 	return &api.GetServersResponse{Servers: servers}, nil
 }
 
-func authenticate(ctx context.Context) (context.Context, error) {
-	peer, ok := peer.FromContext(ctx)
+// WatchServers streams the cluster's servers every time they change
+func (s *grpcServer) WatchServers(req *api.WatchServersRequest, stream api.Log_WatchServersServer) error {
+	if s.ServerWatcher == nil {
+		return status.Error(codes.Unimplemented, "method WatchServers not implemented")
+	}
+	ctx := stream.Context()
+	if err := s.authorizeDescribe(ctx); err != nil {
+		return err
+	}
+	servers := s.ServerWatcher.WatchServers(ctx.Done())
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case srvs := <-servers:
+			if err := stream.Send(&api.WatchServersResponse{Servers: srvs}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// GetPolicy returns the ACL policy in effect on this server
+func (s *grpcServer) GetPolicy(ctx context.Context, req *api.GetPolicyRequest) (*api.GetPolicyResponse, error) {
+	if err := s.authorize(ctx, policyResource, adminAction); err != nil {
+		return nil, err
+	}
+	getter, ok := s.Authorizer.(policyGetter)
 	if !ok {
-		return ctx, status.New(codes.Unknown, "couldn't find peer info").Err()
+		return nil, status.Error(codes.Unimplemented, "method GetPolicy not implemented")
+	}
+	return &api.GetPolicyResponse{Policy: string(getter.Policy())}, nil
+}
+
+// SetPolicy replaces the ACL policy on every server in the cluster
+func (s *grpcServer) SetPolicy(ctx context.Context, req *api.SetPolicyRequest) (*api.SetPolicyResponse, error) {
+	if err := s.authorize(ctx, policyResource, adminAction); err != nil {
+		return nil, err
+	}
+	if s.PolicySetter == nil {
+		return nil, status.Error(codes.Unimplemented, "method SetPolicy not implemented")
 	}
-	if peer.AuthInfo == nil {
-		return context.WithValue(ctx, subjectContextKey{}, ""), nil
+	if err := s.PolicySetter.SetPolicy([]byte(req.Policy)); err != nil {
+		return nil, err
+	}
+	return &api.SetPolicyResponse{}, nil
+}
+
+// Backup streams a backup of the server's data dir, the same tarball the
+// HTTP gateway serves, in chunks of up to backupChunkBytes
+func (s *grpcServer) Backup(req *api.BackupRequest, stream api.Log_BackupServer) error {
+	if err := s.authorize(stream.Context(), clusterResource, adminAction); err != nil {
+		return err
+	}
+	if s.Backuper == nil {
+		return status.Error(codes.Unimplemented, "backups aren't supported")
+	}
+	w := bufio.NewWriterSize(backupWriter{stream}, backupChunkBytes)
+	if err := s.Backuper.Backup(w); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// backupChunkBytes is how much of a backup is sent in each response
+const backupChunkBytes = 256 << 10
+
+// backupWriter sends writes as chunks of the backup, splitting those
+// bigger than backupChunkBytes
+type backupWriter struct {
+	stream api.Log_BackupServer
+}
+
+func (w backupWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > backupChunkBytes {
+			chunk = chunk[:backupChunkBytes]
+		}
+		if err := w.stream.Send(&api.BackupResponse{Chunk: chunk}); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		p = p[len(chunk):]
+	}
+	return n, nil
+}
+
+// authorizeDescribe authorizes describing the cluster. Subjects that may
+// produce or consume may describe it too, since clients need its servers
+// to route their requests, so policies without describe rules keep working.
+func (s *grpcServer) authorizeDescribe(ctx context.Context) error {
+	err := s.authorize(ctx, clusterResource, describeAction)
+	if err == nil {
+		return nil
+	}
+	for _, action := range []string{produceAction, consumeAction} {
+		if s.authorize(ctx, logResource, action) == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// authorize authorizes the request's subject to act on the resource, or on
+// wildcardResource for models that only have policies on it
+func (s *grpcServer) authorize(ctx context.Context, resource, action string) error {
+	sub := subject(ctx)
+	err := s.Authorizer.Authorize(sub, resource, action)
+	if err == nil {
+		return nil
+	}
+	if s.Authorizer.Authorize(sub, wildcardResource, action) != nil {
+		return err
+	}
+	wildcardOnce.Do(func() {
+		zap.L().Named("server").Warn(
+			"authorized on the * object rather than the request's resource, "+
+				"the ACL model should match objects with keyMatch(r.obj, p.obj)",
+			zap.String("subject", sub), zap.String("resource", resource),
+		)
+	})
+	return nil
+}
+
+// wildcardOnce warns once that requests are authorized on wildcardResource
+var wildcardOnce sync.Once
+
+// authenticate stores the request's subject in its context
+func (s *grpcServer) authenticate(ctx context.Context) (context.Context, error) {
+	subject, err := s.Authenticator.Authenticate(ctx)
+	if err != nil {
+		return ctx, err
 	}
-	tlsInfo := peer.AuthInfo.(credentials.TLSInfo)
-	subject := tlsInfo.State.VerifiedChains[0][0].Subject.CommonName
 	return context.WithValue(ctx, subjectContextKey{}, subject), nil
 }
 
@@ -1,11 +1,14 @@
 package server
 
 import (
+	"bytes"
 	"context"
 	"flag"
+	"io"
 	"io/ioutil"
 	"net"
 	"os"
+	"sync"
 	"testing"
 	"time"
 
@@ -16,6 +19,7 @@ import (
 	"github.com/stretchr/testify/require"
 	"go.opencensus.io/examples/exporter"
 	"go.uber.org/zap"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
@@ -44,6 +48,7 @@ func TestServer(t *testing.T) {
 		"produce-consume stream succeeds": testProduceConsumeStream,
 		"consume past log fails":          testConsumePastBoundary,
 		"unauthorized fails":              testUnauthorized,
+		"admin replaces policy":           testSetPolicy,
 	} {
 		t.Run(scenario, func(t *testing.T) {
 			rootClient, nobodyClient, config, teardown := setupTest(t, nil)
@@ -97,7 +102,8 @@ func setupTest(t *testing.T, fn func(*Config)) (api.LogClient, api.LogClient, *C
 
 	authorizer := auth.New(config.ACLModelFile, config.ACLPolicyFile)
 
-	cfg := &Config{CommitLog: clog, Authorizer: authorizer}
+	// the servers in a cluster replicate policies, a lone one sets its own
+	cfg := &Config{CommitLog: clog, Authorizer: authorizer, PolicySetter: authorizer}
 	if fn != nil {
 		fn(cfg)
 	}
@@ -174,6 +180,11 @@ func testConsumePastBoundary(t *testing.T, client, _ api.LogClient, config *Conf
 	got := status.Code(err)
 	want := codes.NotFound
 	require.Equal(t, want, got)
+	// the error says which offsets there are to consume
+	lowest, next, ok := api.OffsetRange(err)
+	require.True(t, ok)
+	require.Equal(t, uint64(0), lowest)
+	require.Equal(t, produce.Offset+1, next)
 }
 
 func testProduceConsumeStream(t *testing.T, client, _ api.LogClient, config *Config) {
@@ -220,4 +231,199 @@ func testUnauthorized(t *testing.T, _, client api.LogClient, config *Config) {
 	require.Error(t, err)
 	require.Nil(t, consume)
 	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	_, err = client.GetServers(ctx, &api.GetServersRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	_, err = client.SetPolicy(ctx, &api.SetPolicyRequest{Policy: "p, nobody, *, admin"})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func testSetPolicy(t *testing.T, rootClient, nobodyClient api.LogClient, config *Config) {
+	ctx := context.Background()
+	res, err := rootClient.GetPolicy(ctx, &api.GetPolicyRequest{})
+	require.NoError(t, err)
+	require.Contains(t, res.Policy, "p, root, *, produce")
+
+	_, err = rootClient.SetPolicy(ctx, &api.SetPolicyRequest{Policy: "p, root, log"})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	policy := "p, root, *, admin\np, nobody, log, produce\n"
+	_, err = rootClient.SetPolicy(ctx, &api.SetPolicyRequest{Policy: policy})
+	require.NoError(t, err)
+
+	_, err = nobodyClient.Produce(ctx,
+		&api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}},
+	)
+	require.NoError(t, err)
+	_, err = rootClient.Produce(ctx,
+		&api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}},
+	)
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	res, err = rootClient.GetPolicy(ctx, &api.GetPolicyRequest{})
+	require.NoError(t, err)
+	require.Equal(t, policy, res.Policy)
+}
+
+func TestServerMaxRecordBytes(t *testing.T) {
+	client, _, _, teardown := setupTest(t, func(cfg *Config) {
+		cfg.MaxRecordBytes = 8
+	})
+	defer teardown()
+	ctx := context.Background()
+
+	_, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	details := status.Convert(err).Details()
+	require.Len(t, details, 1)
+	violations := details[0].(*errdetails.BadRequest).FieldViolations
+	require.Equal(t, "record.value", violations[0].Field)
+
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello")},
+	})
+	require.NoError(t, err)
+
+	// streams fail on the first record that's too large, with the same error
+	stream, err := client.ProduceStream(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello")},
+	}))
+	require.NoError(t, stream.Send(&api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	}))
+	_, err = stream.Recv()
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, api.ErrRecordTooLarge{Size: 11, Max: 8}.GRPCStatus().Proto(), status.Convert(err).Proto())
+
+	// requests far bigger than the max are refused before they're read
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: make([]byte, 2*maxRequestOverhead)},
+	})
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+}
+
+func TestServerExactObjectModel(t *testing.T) {
+	// models from before there were resources match objects exactly, with
+	// policies on the * object
+	model, err := ioutil.TempFile("", "model-*.conf")
+	require.NoError(t, err)
+	defer os.Remove(model.Name())
+	_, err = model.WriteString(`[request_definition]
+r = sub, obj, act
+
+[policy_definition]
+p = sub, obj, act
+
+[policy_effect]
+e = some(where (p.eft == allow))
+
+[matchers]
+m = r.sub == p.sub && r.obj == p.obj && r.act == p.act
+`)
+	require.NoError(t, err)
+	require.NoError(t, model.Close())
+
+	var authorizer *countingAuthorizer
+	rootClient, nobodyClient, _, teardown := setupTest(t, func(cfg *Config) {
+		authorizer = &countingAuthorizer{
+			Authorizer: auth.New(model.Name(), config.ACLPolicyFile),
+		}
+		cfg.Authorizer = authorizer
+	})
+	defer teardown()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const records = 10
+	for i := 0; i < records; i++ {
+		_, err := rootClient.Produce(ctx,
+			&api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}},
+		)
+		require.NoError(t, err)
+	}
+	_, err = nobodyClient.Produce(ctx,
+		&api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}},
+	)
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	// a stream's authorized once rather than for every record
+	authorizer.reset()
+	stream, err := rootClient.ConsumeStream(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	for i := 0; i < records; i++ {
+		_, err := stream.Recv()
+		require.NoError(t, err)
+	}
+	// the log resource is denied, then the * object allowed
+	require.Equal(t, 2, authorizer.count())
+}
+
+// countingAuthorizer counts the requests it authorizes
+type countingAuthorizer struct {
+	Authorizer
+
+	mu    sync.Mutex
+	calls int
+}
+
+func (a *countingAuthorizer) Authorize(subject, object, action string) error {
+	a.mu.Lock()
+	a.calls++
+	a.mu.Unlock()
+	return a.Authorizer.Authorize(subject, object, action)
+}
+
+func (a *countingAuthorizer) reset() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.calls = 0
+}
+
+func (a *countingAuthorizer) count() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.calls
+}
+
+func TestServerBackup(t *testing.T) {
+	backup := bytes.Repeat([]byte("backup"), backupChunkBytes)
+	rootClient, nobodyClient, _, teardown := setupTest(t, func(cfg *Config) {
+		cfg.Backuper = bytesBackuper(backup)
+	})
+	defer teardown()
+	ctx := context.Background()
+
+	// backups bigger than a chunk are sent in chunks
+	stream, err := rootClient.Backup(ctx, &api.BackupRequest{})
+	require.NoError(t, err)
+	var got []byte
+	for {
+		res, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		require.LessOrEqual(t, len(res.Chunk), backupChunkBytes)
+		got = append(got, res.Chunk...)
+	}
+	require.Equal(t, backup, got)
+
+	stream, err = nobodyClient.Backup(ctx, &api.BackupRequest{})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+// bytesBackuper backs up as its bytes
+type bytesBackuper []byte
+
+func (b bytesBackuper) Backup(w io.Writer) error {
+	_, err := w.Write(b)
+	return err
 }
@@ -0,0 +1,121 @@
+// Package tracing sets up OpenTelemetry tracing and carries trace context
+// in record headers, so a record's produce, Raft apply and segment writes on
+// every server end up in the producer's trace.
+package tracing
+
+import (
+	"context"
+	"fmt"
+
+	api "github.com/michael-diggin/proglog/api/v1"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const serviceName = "proglog"
+
+// propagator carries trace context in record headers. It's used directly,
+// rather than through the global propagator, so clients that haven't set
+// one up still propagate their traces.
+var propagator = propagation.TraceContext{}
+
+type Config struct {
+	// Endpoint is the host:port of the OTLP/HTTP collector spans are
+	// exported to. Spans aren't recorded when it's empty.
+	Endpoint string
+	// Insecure exports spans over plain HTTP
+	Insecure bool
+	// SampleRatio is the fraction of new traces that are sampled, traces
+	// started by a producer keep the producer's sampling decision
+	SampleRatio float64
+	// NodeName identifies the server in the spans' resource
+	NodeName string
+}
+
+// Setup installs the global propagator and, if an endpoint is configured,
+// a tracer provider exporting to it. The returned func flushes and stops
+// the exporter.
+func Setup(ctx context.Context, config Config) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagator)
+	if config.Endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(config.Endpoint)}
+	if config.Insecure {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up trace exporter: %w", err)
+	}
+	res := resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceNameKey.String(serviceName),
+		semconv.ServiceInstanceIDKey.String(config.NodeName),
+	)
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(
+			sdktrace.TraceIDRatioBased(config.SampleRatio),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// Tracer returns the named tracer from the global provider
+func Tracer(name string) trace.Tracer {
+	return otel.Tracer(name)
+}
+
+// Inject writes the trace context of ctx into the record's headers, unless
+// they already carry one
+func Inject(ctx context.Context, record *api.Record) {
+	if trace.SpanContextFromContext(Extract(context.Background(), record)).IsValid() {
+		return
+	}
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return
+	}
+	if record.Headers == nil {
+		record.Headers = make(map[string]string)
+	}
+	propagator.Inject(ctx, headerCarrier(record.Headers))
+}
+
+// Extract returns ctx with the trace context carried in the record's
+// headers
+func Extract(ctx context.Context, record *api.Record) context.Context {
+	if len(record.Headers) == 0 {
+		return ctx
+	}
+	return propagator.Extract(ctx, headerCarrier(record.Headers))
+}
+
+// headerCarrier adapts record headers to propagation.TextMapCarrier
+type headerCarrier map[string]string
+
+var _ propagation.TextMapCarrier = headerCarrier(nil)
+
+func (c headerCarrier) Get(key string) string {
+	return c[key]
+}
+
+func (c headerCarrier) Set(key, value string) {
+	c[key] = value
+}
+
+func (c headerCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
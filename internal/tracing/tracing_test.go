@@ -0,0 +1,110 @@
+package tracing
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	api "github.com/michael-diggin/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/trace"
+	collectorpb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestHeadersCarryTrace(t *testing.T) {
+	record := &api.Record{Value: []byte("hello world")}
+	Inject(context.Background(), record)
+	require.Empty(t, record.Headers)
+
+	sc := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{1},
+		SpanID:     trace.SpanID{2},
+		TraceFlags: trace.FlagsSampled,
+	})
+	ctx := trace.ContextWithSpanContext(context.Background(), sc)
+	Inject(ctx, record)
+	require.Contains(t, record.Headers, "traceparent")
+
+	got := trace.SpanContextFromContext(Extract(context.Background(), record))
+	require.Equal(t, sc.TraceID(), got.TraceID())
+	require.Equal(t, sc.SpanID(), got.SpanID())
+	require.True(t, got.IsSampled())
+
+	// the producer's trace isn't replaced
+	other := trace.ContextWithSpanContext(context.Background(), trace.NewSpanContext(
+		trace.SpanContextConfig{TraceID: trace.TraceID{3}, SpanID: trace.SpanID{4}},
+	))
+	Inject(other, record)
+	got = trace.SpanContextFromContext(Extract(context.Background(), record))
+	require.Equal(t, sc.TraceID(), got.TraceID())
+}
+
+func TestSetupExportsSpans(t *testing.T) {
+	collector := &collector{}
+	srv := httptest.NewServer(collector)
+	defer srv.Close()
+
+	shutdown, err := Setup(context.Background(), Config{
+		Endpoint:    strings.TrimPrefix(srv.URL, "http://"),
+		Insecure:    true,
+		SampleRatio: 1,
+		NodeName:    "0",
+	})
+	require.NoError(t, err)
+
+	ctx, parent := Tracer("test").Start(context.Background(), "produce")
+	record := &api.Record{}
+	Inject(ctx, record)
+	_, child := Tracer("test").Start(Extract(context.Background(), record), "raft.Apply")
+	child.End()
+	parent.End()
+	require.NoError(t, shutdown(context.Background()))
+
+	spans := collector.spans()
+	require.Equal(t, []string{"raft.Apply", "produce"}, spans)
+}
+
+// collector is an OTLP/HTTP collector stub that records span names
+type collector struct {
+	mu    sync.Mutex
+	names []string
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/v1/traces" {
+		http.NotFound(w, r)
+		return
+	}
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var req collectorpb.ExportTraceServiceRequest
+	if err := proto.Unmarshal(b, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, rs := range req.ResourceSpans {
+		for _, ils := range rs.InstrumentationLibrarySpans {
+			for _, span := range ils.Spans {
+				c.names = append(c.names, span.Name)
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.WriteHeader(http.StatusOK)
+}
+
+func (c *collector) spans() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.names
+}